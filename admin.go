@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"mezon-go-bot/internal/recording"
+	"mezon-go-bot/internal/rtc"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// registerAdminAPI serves the /admin/ endpoints, every request must carry token as a bearer token
+func registerAdminAPI(mux *http.ServeMux, token string) {
+	auth := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux.HandleFunc("GET /admin/recordings", auth(listRecordingsHandler))
+	mux.HandleFunc("GET /admin/recordings/{id}", auth(getRecordingHandler))
+	mux.HandleFunc("GET /admin/recordings/{id}/{file}", auth(recordingFileHandler))
+	mux.HandleFunc("GET /admin/stats", auth(streamStatsHandler))
+	// the counters of expvar: cmdline, memstats, radio_station_signaling and rtc_streams
+	mux.HandleFunc("GET /admin/vars", auth(expvar.Handler().ServeHTTP))
+}
+
+// streamStatsHandler reports the RTCP stats of the open broadcasts and calls, the kind and channel_id
+// parameters filter them
+func streamStatsHandler(w http.ResponseWriter, r *http.Request) {
+	kind, channelId := r.URL.Query().Get("kind"), r.URL.Query().Get("channel_id")
+
+	streams := []rtc.StreamStats{}
+	for _, s := range rtc.AllStreamStats() {
+		if (kind == "" || s.Kind == kind) && (channelId == "" || s.ChannelId == channelId) {
+			streams = append(streams, s)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"streams": streams})
+}
+
+// listRecordingsHandler lists the recordings, newest first. The kind, clan_id and channel_id parameters
+// filter them, since (RFC 3339) drops older ones.
+func listRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	archive := bot.Recordings()
+	if archive == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording is disabled, see RECORDING_DIR"})
+		return
+	}
+
+	q := r.URL.Query()
+	filter := recording.Filter{Kind: q.Get("kind"), ClanId: q.Get("clan_id"), ChannelId: q.Get("channel_id")}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be RFC 3339"})
+			return
+		}
+		filter.Since = t
+	}
+
+	recordings := archive.List(filter)
+	if recordings == nil {
+		recordings = []recording.Recording{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recordings": recordings})
+}
+
+func getRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	archive := bot.Recordings()
+	if archive == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording is disabled, see RECORDING_DIR"})
+		return
+	}
+
+	rec, err := archive.Get(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, recordingStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// recordingFileHandler downloads a file of a recording
+func recordingFileHandler(w http.ResponseWriter, r *http.Request) {
+	archive := bot.Recordings()
+	if archive == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording is disabled, see RECORDING_DIR"})
+		return
+	}
+
+	path, err := archive.File(r.PathValue("id"), r.PathValue("file"))
+	if err != nil {
+		writeJSON(w, recordingStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+func recordingStatus(err error) int {
+	if errors.Is(err, recording.ErrNoSuchRecording) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"mezon-go-bot/config"
 	"mezon-go-bot/internal/constants"
 	"mezon-go-bot/internal/helper"
+	"mezon-go-bot/internal/ingest"
+	"mezon-go-bot/internal/library"
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/player"
+	"mezon-go-bot/internal/recording"
 	"mezon-go-bot/internal/rtc"
+	"mezon-go-bot/internal/settings"
+	"mezon-go-bot/internal/soundboard"
+	"mezon-go-bot/internal/tts"
 	"mezon-go-bot/internal/websocket"
+	"sync"
+	"time"
 
+	"github.com/antihax/optional"
 	mezonsdk "github.com/nccasia/mezon-go-sdk"
 	"github.com/nccasia/mezon-go-sdk/configs"
+	swagger "github.com/nccasia/mezon-go-sdk/mezon-api"
 	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
 	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/rtapi"
 	"github.com/pion/webrtc/v4"
@@ -23,6 +37,19 @@ type IBot interface {
 	Logger() *zap.Logger
 	Config() *config.AppConfig
 	MezonClient() *mezonsdk.Client
+	Settings() settings.IStore
+	Library() *library.Library
+	Ingest() *ingest.Pipeline
+	Soundboard() *soundboard.Board
+	TTS() *tts.Synthesizer
+	Recordings() *recording.Archive
+	RecordingNotice() string
+	Reply(msg *api.ChannelMessage, text string) error
+	ReplyWithId(msg *api.ChannelMessage, text string) (string, error)
+	EditMessage(msg *api.ChannelMessage, messageId, text string) error
+	SendMessage(clanId, channelId string, text string) error
+	VoiceChannel(clanId, userId string) (string, error)
+	Announce(clanId, channelId, text string) error
 }
 
 type Bot struct {
@@ -30,6 +57,23 @@ type Bot struct {
 	commands map[string]CommandHandler
 	logger   *zap.Logger
 	mzn      *mezonsdk.Client
+	socket   mezonsdk.IWSConnection
+	settings settings.IStore
+	library  *library.Library
+	ingest   *ingest.Pipeline
+	board    *soundboard.Board
+	tts      *tts.Synthesizer // nil without TTS_ENGINE
+
+	// archive is nil without RECORDING_DIR, nothing is recorded without a notice to play first
+	archive         *recording.Archive
+	recordingNotice string
+
+	// echoes waits for the own messages the socket sends back, the only way to learn their id. Identical
+	// replies in a channel wait in the order they were sent, the socket echoes them in that order.
+	echoMu sync.Mutex
+	echoes map[string][]chan string // map[channelId/text]message id
+	// replyMu keeps the waiters of echoes in the order their replies go out
+	replyMu sync.Mutex
 
 	// checkin
 	callService rtc.ICallService
@@ -50,6 +94,232 @@ func (b *Bot) Config() *config.AppConfig {
 	return b.cfg
 }
 
+// Settings implements IBot.
+func (b *Bot) Settings() settings.IStore {
+	return b.settings
+}
+
+// Library implements IBot.
+func (b *Bot) Library() *library.Library {
+	return b.library
+}
+
+// Ingest implements IBot.
+func (b *Bot) Ingest() *ingest.Pipeline {
+	return b.ingest
+}
+
+// Soundboard implements IBot.
+func (b *Bot) Soundboard() *soundboard.Board {
+	return b.board
+}
+
+// TTS implements IBot.
+func (b *Bot) TTS() *tts.Synthesizer {
+	return b.tts
+}
+
+// Recordings implements IBot.
+func (b *Bot) Recordings() *recording.Archive {
+	return b.archive
+}
+
+// RecordingNotice implements IBot. It is the file played to tell a channel or a caller they are recorded.
+func (b *Bot) RecordingNotice() string {
+	return b.recordingNotice
+}
+
+// Announce implements IBot. It speaks text in a voice channel with the default voice, in the language
+// setting of the channel: over the queue playing there, which is ducked meanwhile, and then it returns
+// once the text was spoken; queued on its own otherwise.
+func (b *Bot) Announce(clanId, channelId, text string) error {
+	voice := tts.Voice{Lang: b.settings.Get(clanId, channelId).Language}
+	return say([]broadcastTarget{{ClanId: clanId, ChannelId: channelId}}, text, voice, b.cfg.BotId, b.cfg.BotName)
+}
+
+// Reply implements IBot.
+func (b *Bot) Reply(msg *api.ChannelMessage, text string) error {
+	return b.sendChannelMessage(&rtapi.ChannelMessageSend{
+		ClanId:    msg.GetClanId(),
+		ChannelId: msg.GetChannelId(),
+		Mode:      msg.GetMode(),
+		IsPublic:  msg.GetIsPublic(),
+	}, text)
+}
+
+// SendMessage implements IBot.
+func (b *Bot) SendMessage(clanId, channelId string, text string) error {
+	return b.sendChannelMessage(&rtapi.ChannelMessageSend{
+		ClanId:    clanId,
+		ChannelId: channelId,
+		Mode:      constants.STREAM_MODE_CHANNEL,
+		IsPublic:  true,
+	}, text)
+}
+
+// voiceChannelPageSize is how many voice channel users VoiceChannel asks for at a time
+const voiceChannelPageSize = 100
+
+// VoiceChannel implements IBot. It returns the voice channel the user is in, "" when none or when
+// the bot runs without a mezon client.
+func (b *Bot) VoiceChannel(clanId, userId string) (string, error) {
+	if b.mzn == nil {
+		return "", nil
+	}
+
+	// the list has no cursor of its own: the id of the last user pages on, and a page without new
+	// users means the server ignored it
+	seen := make(map[string]bool)
+	cursor := ""
+	for {
+		opts := &swagger.MezonListPTTChannelUsersOpts{
+			ClanId: optional.NewString(clanId),
+			Limit:  optional.NewInt32(voiceChannelPageSize),
+		}
+		if cursor != "" {
+			opts.Cursor = optional.NewString(cursor)
+		}
+		users, _, err := b.mzn.Api.MezonListPTTChannelUsers(context.Background(), opts)
+		if err != nil {
+			return "", err
+		}
+
+		fresh := false
+		for _, u := range users.PttChannelUsers {
+			if u.UserId == userId {
+				return u.ChannelId, nil
+			}
+			if !seen[u.Id] {
+				seen[u.Id], fresh = true, true
+			}
+		}
+		if len(users.PttChannelUsers) < voiceChannelPageSize || !fresh {
+			return "", nil
+		}
+		cursor = users.PttChannelUsers[len(users.PttChannelUsers)-1].Id
+	}
+}
+
+// ReplyWithId implements IBot. The message id is "" when the message did not come back in time, it
+// then can not be edited.
+func (b *Bot) ReplyWithId(msg *api.ChannelMessage, text string) (string, error) {
+	key := msg.GetChannelId() + "/" + text
+	echo := make(chan string, 1)
+	defer b.dropEcho(key, echo)
+
+	b.replyMu.Lock()
+	b.echoMu.Lock()
+	b.echoes[key] = append(b.echoes[key], echo)
+	b.echoMu.Unlock()
+	err := b.Reply(msg, text)
+	b.replyMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case id := <-echo:
+		return id, nil
+	case <-time.After(constants.MESSAGE_ECHO_TIMEOUT):
+		b.logger.Warn("[ReplyWithId] message not echoed", zap.String("channelId", msg.GetChannelId()))
+		return "", nil
+	}
+}
+
+// EditMessage implements IBot.
+func (b *Bot) EditMessage(msg *api.ChannelMessage, messageId, text string) error {
+	if b.socket == nil {
+		return errors.New("socket is not connected")
+	}
+
+	content, err := websocket.EncodeContent(text)
+	if err != nil {
+		return err
+	}
+
+	return b.socket.SendMessage(&rtapi.Envelope{Message: &rtapi.Envelope_ChannelMessageUpdate{ChannelMessageUpdate: &rtapi.ChannelMessageUpdate{
+		ClanId:    msg.GetClanId(),
+		ChannelId: msg.GetChannelId(),
+		MessageId: messageId,
+		Content:   content,
+		Mode:      msg.GetMode(),
+		IsPublic:  msg.GetIsPublic(),
+	}}})
+}
+
+// dropEcho stops waiting for the echo, once it came or the reply gave up
+func (b *Bot) dropEcho(key string, echo chan string) {
+	b.echoMu.Lock()
+	defer b.echoMu.Unlock()
+
+	waiting := b.echoes[key]
+	for i, c := range waiting {
+		if c == echo {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(b.echoes, key)
+	} else {
+		b.echoes[key] = waiting
+	}
+}
+
+// onEcho hands the id of an own message to the oldest ReplyWithId waiting for it
+func (b *Bot) onEcho(msg *api.ChannelMessage) {
+	var content websocket.MsgContent
+	if err := json.Unmarshal([]byte(msg.GetContent()), &content); err != nil {
+		return
+	}
+
+	b.echoMu.Lock()
+	defer b.echoMu.Unlock()
+
+	key := msg.GetChannelId() + "/" + content.Content
+	waiting := b.echoes[key]
+	if len(waiting) == 0 {
+		return
+	}
+	waiting[0] <- msg.GetMessageId()
+	if len(waiting) == 1 {
+		delete(b.echoes, key)
+	} else {
+		b.echoes[key] = waiting[1:]
+	}
+}
+
+// onChannelMessage runs commands, own messages are only echoes
+func (b *Bot) onChannelMessage(e *rtapi.Envelope) error {
+	msg := e.GetChannelMessage()
+	if msg.GetSenderId() == b.cfg.BotId {
+		b.onEcho(msg)
+		return nil
+	}
+
+	go func() {
+		err := b.handleCommand(msg)
+		if err != nil {
+			b.logger.Error("Error handling command", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func (b *Bot) sendChannelMessage(msg *rtapi.ChannelMessageSend, text string) error {
+	if b.socket == nil {
+		return errors.New("socket is not connected")
+	}
+
+	content, err := websocket.EncodeContent(text)
+	if err != nil {
+		return err
+	}
+	msg.Content = content
+
+	return b.socket.SendMessage(&rtapi.Envelope{Message: &rtapi.Envelope_ChannelMessageSend{ChannelMessageSend: msg}})
+}
+
 // RegisterCmd implements IBot.
 func (b *Bot) RegisterCmd(prefix string, cmdHandler CommandHandler) {
 	if b.commands == nil {
@@ -79,12 +349,97 @@ func NewBot(cfg *config.AppConfig, logger *zap.Logger) (IBot, error) {
 		return nil, err
 	}
 
-	return &Bot{
+	return newBot(cfg, logger, mzClient)
+}
+
+// NewSimulatedBot builds a bot without a mezon connection, replies go to socket
+func NewSimulatedBot(cfg *config.AppConfig, logger *zap.Logger, socket mezonsdk.IWSConnection) (*Bot, error) {
+	b, err := newBot(cfg, logger, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	b.socket = socket
+	socket.SetOnChannelMessage(b.onChannelMessage)
+	return b, nil
+}
+
+func newBot(cfg *config.AppConfig, logger *zap.Logger, mzClient *mezonsdk.Client) (*Bot, error) {
+	store, err := settings.NewFileStore(cfg.SettingsFile, settings.Settings{
+		BroadcastChannelId: cfg.ChannelId,
+		Language:           cfg.TtsLang,
+		Prefix:             constants.DEFAULT_COMMAND_PREFIX,
+	})
+	if err != nil {
+		logger.Error("[NewBot] load settings error", zap.Error(err))
+		return nil, err
+	}
+
+	pipeline := ingest.New(cfg.TranscodeCacheDir, cfg.FfmpegPath, cfg.OpusencPath)
+	logger.Info("[NewBot] audio encoders", zap.String("tools", pipeline.Tools()))
+	if pipeline.CanProcess() {
+		rtc.SetProcessor(pipeline.OpenProcessed)
+		rtc.SetCodec(pipeline)
+	}
+	if cfg.JingleFile != "" {
+		jingle, err := loadJingle(pipeline, cfg.JingleFile)
+		if err != nil {
+			logger.Error("[NewBot] load jingle error", zap.String("file", cfg.JingleFile), zap.Error(err))
+			return nil, err
+		}
+		player.SetJingle(jingle)
+	}
+
+	lib, err := library.Open(cfg.MediaDir, cfg.LibraryIndex, func(path string) (string, error) {
+		return pipeline.Ingest(context.Background(), path)
+	}, ingest.Supported)
+	if err != nil {
+		logger.Error("[NewBot] open media library error", zap.Error(err))
+		return nil, err
+	}
+
+	board, err := soundboard.Open(cfg.SoundboardDir)
+	if err != nil {
+		logger.Error("[NewBot] open soundboard error", zap.Error(err))
+		return nil, err
+	}
+
+	var synth *tts.Synthesizer
+	if cfg.TtsEngine != "" {
+		if synth, err = newSynthesizer(cfg, pipeline); err != nil {
+			logger.Error("[NewBot] tts engine error", zap.String("engine", cfg.TtsEngine), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	var archive *recording.Archive
+	if cfg.RecordingDir != "" {
+		if archive, err = recording.Open(cfg.RecordingDir, cfg.RecordingRetention); err != nil {
+			logger.Error("[NewBot] open recordings error", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	b := &Bot{
 		cfg:      cfg,
 		commands: make(map[string]CommandHandler),
+		echoes:   make(map[string][]chan string),
 		mzn:      mzClient,
 		logger:   logger,
-	}, nil
+		settings: store,
+		library:  lib,
+		ingest:   pipeline,
+		board:    board,
+		tts:      synth,
+		archive:  archive,
+	}
+	if archive != nil {
+		b.recordingNotice = b.loadRecordingNotice()
+		if b.recordingNotice == "" {
+			logger.Warn("[NewBot] no recording notice, nothing will be recorded")
+		}
+	}
+	return b, nil
 }
 
 func (b *Bot) Start() {
@@ -93,32 +448,137 @@ func (b *Bot) Start() {
 		b.logger.Error("[NewBot] can not create socket", zap.Error(err))
 		return
 	}
-	socket.SetOnChannelMessage(func(e *rtapi.Envelope) error {
-		go func() {
-			err := b.handleCommand(e.GetChannelMessage())
-			if err != nil {
-				b.logger.Error("Error handling command", zap.Error(err))
-			}
-		}()
-		return nil
-	})
+	b.socket = socket
+	socket.SetOnChannelMessage(b.onChannelMessage)
 
 	callService := rtc.NewCallService(b.cfg.BotId, socket, webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{constants.ICE_MEZON},
 	})
 	socket.SetOnWebrtcSignalingFwd(callService.OnWebsocketEvent)
 	callService.SetOnImage(CheckinHandler, constants.NUM_IMAGE_SNAPSHOT)
-	callService.SetAcceptCallFileAudio(constants.CHECKIN_ACCEPT_CALL_AUDIO_PATH)
-	callService.SetExitCallFileAudio(constants.CHECKIN_EXIT_CALL_AUDIO_PATH)
-	callService.SetCheckinSuccessFileAudio(constants.CHECKIN_CHECKIN_SUCCESS_AUDIO_PATH)
-	callService.SetCheckinFailFileAudio(constants.CHECKIN_CHECKIN_FAIL_AUDIO_PATH)
+	prompts := b.callPrompts("")
+	callService.SetAcceptCallFileAudio(prompts.AcceptCall)
+	callService.SetExitCallFileAudio(prompts.ExitCall)
+	callService.SetCheckinSuccessFileAudio(prompts.CheckinSuccess)
+	callService.SetCheckinFailFileAudio(prompts.CheckinFail)
+	if b.cfg.TtsPrompts && b.tts != nil {
+		// spoken in the language of the channel called in, the settings may change while the bot runs
+		callService.SetPrompts(b.callPrompts)
+	}
+	if b.archive != nil {
+		callService.SetRecorder(b.callRecorded, b.recordCall, b.recordingNotice)
+	}
 }
 
-type CommandHandler func(command string, args []string) error
+// callRecorded reports whether check-in calls on channelId are recorded. Calls belong to CLAN_ID.
+func (b *Bot) callRecorded(channelId string) bool {
+	return b.recordingNotice != "" && b.settings.Get(b.cfg.ClanId, channelId).RecordingEnabled()
+}
+
+// recordCall starts the recording of a check-in call, once the caller heard the notice
+func (b *Bot) recordCall(channelId, userId string) rtc.CallRecorder {
+	if !b.callRecorded(channelId) {
+		return nil
+	}
+	session, err := b.archive.Start(recording.KindCall, b.cfg.ClanId, []string{channelId}, userId)
+	if err != nil {
+		b.logger.Error("[checkin] start recording error", zap.String("channelId", channelId), zap.Error(err))
+		return nil
+	}
+	b.logger.Info("[checkin] recording", zap.String("id", session.Id()), zap.String("channelId", channelId), zap.String("userId", userId))
+	return session
+}
+
+// loadJingle converts the jingle once and measures it, so every queue plays it at the loudness target
+func loadJingle(pipeline *ingest.Pipeline, path string) (*player.Item, error) {
+	converted, err := pipeline.Ingest(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := media.ProbeOgg(converted)
+	if err != nil {
+		return nil, err
+	}
+
+	jingle := &player.Item{Title: "jingle", Path: converted, Duration: info.Duration}
+	if pipeline.CanProcess() {
+		loudness, err := pipeline.Loudness(context.Background(), converted)
+		if err != nil {
+			return nil, err
+		}
+		jingle.Gain = loudness.Gain()
+	}
+	return jingle, nil
+}
+
+// newSynthesizer starts the TTS_ENGINE, renders are encoded by the ingest pipeline
+func newSynthesizer(cfg *config.AppConfig, pipeline *ingest.Pipeline) (*tts.Synthesizer, error) {
+	engine, err := tts.NewEngine(cfg.TtsEngine, cfg.TtsPath, cfg.TtsVoiceDir)
+	if err != nil {
+		return nil, err
+	}
+	return tts.New(engine, pipeline.EncodeWav, cfg.TtsCacheDir, tts.Voice{Name: cfg.TtsVoice, Lang: cfg.TtsLang}), nil
+}
+
+// callPrompts are the check-in prompts of a call in a channel of CLAN_ID, "" for the clan
+func (b *Bot) callPrompts(channelId string) rtc.CallPrompts {
+	lang := b.settings.Get(b.cfg.ClanId, channelId).Language
+	return rtc.CallPrompts{
+		AcceptCall:     b.prompt(constants.CHECKIN_ACCEPT_CALL_AUDIO_PATH, constants.CHECKIN_ACCEPT_CALL_TEXT, lang),
+		ExitCall:       b.prompt(constants.CHECKIN_EXIT_CALL_AUDIO_PATH, constants.CHECKIN_EXIT_CALL_TEXT, lang),
+		CheckinSuccess: b.prompt(constants.CHECKIN_CHECKIN_SUCCESS_AUDIO_PATH, constants.CHECKIN_CHECKIN_SUCCESS_TEXT, lang),
+		CheckinFail:    b.prompt(constants.CHECKIN_CHECKIN_FAIL_AUDIO_PATH, constants.CHECKIN_CHECKIN_FAIL_TEXT, lang),
+	}
+}
+
+// prompt is the loudness normalized copy of a prompt: text spoken in lang with TTS_PROMPTS, else the file
+// at path. The file is kept when the text can not be spoken.
+func (b *Bot) prompt(path, text, lang string) string {
+	if b.cfg.TtsPrompts && b.tts != nil {
+		if spoken, ok := b.speak(text, lang); ok {
+			path = spoken
+		}
+	}
+	return b.normalized(path)
+}
+
+// loadRecordingNotice is RECORDING_NOTICE_FILE, else the notice spoken by the TTS engine, "" without either
+func (b *Bot) loadRecordingNotice() string {
+	if b.cfg.RecordingNoticeFile != "" {
+		return b.normalized(b.cfg.RecordingNoticeFile)
+	}
+	if b.tts != nil {
+		if spoken, ok := b.speak(constants.RECORDING_NOTICE_TEXT, b.settings.Get(b.cfg.ClanId, "").Language); ok {
+			return b.normalized(spoken)
+		}
+	}
+	return ""
+}
+
+func (b *Bot) speak(text, lang string) (string, bool) {
+	spoken, err := b.tts.Render(context.Background(), text, tts.Voice{Lang: lang})
+	if err != nil {
+		b.logger.Error("[NewBot] speak prompt error", zap.String("text", text), zap.Error(err))
+		return "", false
+	}
+	return spoken, true
+}
+
+// normalized is the loudness normalized copy of a prompt file, the file itself when it can not be made
+func (b *Bot) normalized(path string) string {
+	normalized, err := b.ingest.Normalized(context.Background(), path)
+	if err != nil {
+		b.logger.Error("[NewBot] normalize prompt error", zap.String("file", path), zap.Error(err))
+		return path
+	}
+	return normalized
+}
+
+type CommandHandler func(msg *api.ChannelMessage, command string, args []string) error
 
 func (b *Bot) handleCommand(msg *api.ChannelMessage) error {
 	content := msg.GetContent()
-	if len(content) == 0 || len(content) >= 64 || content == "{}" {
+	if len(content) == 0 || len(content) >= constants.MAX_COMMAND_LENGTH || content == "{}" {
 		return nil
 	}
 
@@ -128,11 +588,17 @@ func (b *Bot) handleCommand(msg *api.ChannelMessage) error {
 	}
 
 	if msgContent.Content != "" {
-		command, args := helper.ExtractMessage(msgContent.Content)
+		s := b.settings.Get(msg.GetClanId(), msg.GetChannelId())
+		command, args := helper.ExtractMessage(s.Prefix, msgContent.Content)
 		b.logger.Debug("[ExtractMessage]", zap.String("command", command), zap.Any("args", args))
 
+		// settings must stay reachable, otherwise a bad modules value locks admins out
+		if command != constants.SETTINGS_COMMAND && !s.ModuleEnabled(command) {
+			return nil
+		}
+
 		if handler, exists := b.commands[command]; exists {
-			return handler(command, args)
+			return handler(msg, command, args)
 		}
 	}
 
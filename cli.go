@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mezon-go-bot/config"
+	"mezon-go-bot/internal/constants"
+	"mezon-go-bot/internal/ingest"
+	"mezon-go-bot/internal/logger"
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/player"
+	radiostation "mezon-go-bot/internal/radio-station"
+	"mezon-go-bot/internal/rtc"
+	"mezon-go-bot/internal/tts"
+	"mezon-go-bot/internal/websocket"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const cliUsage = `usage: mezon-go-bot <command> [flags]
+
+commands:
+  run                          start the bot (default)
+  check-config                 validate the .env config and assets
+  play <file|url> --channel <id>
+                               broadcast one audio file or stream to the radio station and exit
+  transcode <file>...          convert audio files to streamable ogg/opus (cached)
+  simulate-command "<text>" [--station <addr>]
+                               run a chat message through the command pipeline offline
+  probe-audio <file>           check an ogg/opus file can be streamed
+  protocol-doc [-o <file>]     print the radio station protocol document
+`
+
+const cliUsageFooter = `
+run "mezon-go-bot <command> -h" for the flags of a command
+`
+
+// cliMockUsage lists the commands of a build with the mock tag, see cli_mock.go
+var cliMockUsage string
+
+type cliCommand func(args []string) error
+
+var commands = map[string]cliCommand{
+	"run":              cliRun,
+	"check-config":     cliCheckConfig,
+	"play":             cliPlay,
+	"transcode":        cliTranscode,
+	"simulate-command": cliSimulateCommand,
+	"probe-audio":      cliProbeAudio,
+	"protocol-doc":     cliProtocolDoc,
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, cliUsage, cliMockUsage, cliUsageFooter)
+}
+
+func runCli(args []string) error {
+
+	// no subcommand keeps the original behaviour
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cliRun(args)
+	}
+
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	// -h printed the flags, which is not a failure
+	if err := cmd(args[1:]); !errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return nil
+}
+
+// parseFlags parses flags placed before, between or after positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func cliRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	configPath := fs.String("config", ".", "directory containing the .env file")
+	port := fs.String("port", "8080", "http port for the health endpoint")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	return runBot(*configPath, *port)
+}
+
+func cliCheckConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	configPath := fs.String("config", ".", "directory containing the .env file")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := config.ReadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	problems := cfg.Validate()
+	assets := []string{
+		constants.CHECKIN_ACCEPT_CALL_AUDIO_PATH,
+		constants.CHECKIN_EXIT_CALL_AUDIO_PATH,
+		constants.CHECKIN_CHECKIN_SUCCESS_AUDIO_PATH,
+		constants.CHECKIN_CHECKIN_FAIL_AUDIO_PATH,
+	}
+	if cfg.RecordingNoticeFile != "" {
+		assets = append(assets, cfg.RecordingNoticeFile)
+	}
+	for _, asset := range assets {
+		info, err := media.ProbeOgg(asset)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", asset, err))
+			continue
+		}
+		for _, p := range info.Problems() {
+			problems = append(problems, fmt.Errorf("%s: %s", asset, p))
+		}
+	}
+
+	pipeline := ingest.New(cfg.TranscodeCacheDir, cfg.FfmpegPath, cfg.OpusencPath)
+	if cfg.JingleFile != "" {
+		if _, err := loadJingle(pipeline, cfg.JingleFile); err != nil {
+			problems = append(problems, fmt.Errorf("JINGLE_FILE %s: %w", cfg.JingleFile, err))
+		}
+	}
+
+	if cfg.TtsEngine != "" {
+		synth, err := newSynthesizer(cfg, pipeline)
+		if err == nil {
+			_, err = synth.Render(context.Background(), constants.CHECKIN_CHECKIN_SUCCESS_TEXT, tts.Voice{})
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TTS_ENGINE %s: %w", cfg.TtsEngine, err))
+		}
+	}
+
+	fmt.Println("audio encoders:", pipeline.Tools())
+
+	if len(problems) == 0 {
+		fmt.Println("config ok")
+		return nil
+	}
+
+	for _, p := range problems {
+		fmt.Println("-", p)
+	}
+	return fmt.Errorf("%d config problem(s)", len(problems))
+}
+
+func cliPlay(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ContinueOnError)
+	configPath := fs.String("config", ".", "directory containing the .env file")
+	channelId := fs.String("channel", "", "voice channel id, defaults to CHANNEL_ID")
+	clanId := fs.String("clan", "", "clan id, defaults to CLAN_ID")
+	limit := fs.Duration("for", 0, "stop after this long, a live stream otherwise plays until interrupted")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: play <file|url> --channel <id>")
+	}
+
+	cfg, err := config.ReadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *channelId == "" {
+		*channelId = cfg.ChannelId
+	}
+	if *clanId == "" {
+		*clanId = cfg.ClanId
+	}
+
+	log := logger.NewLogger(cfg.LogFile)
+	defer log.Sync()
+
+	wsConn, err := newStationConnection(cfg, *clanId, *channelId)
+	if err != nil {
+		return fmt.Errorf("radio station connect: %w", err)
+	}
+
+	rtcConn, err := rtc.NewStreamingRTCConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{constants.ICE_GOOGLE},
+	}, wsConn, *clanId, *channelId, cfg.BotId, cfg.BotName)
+	if err != nil {
+		wsConn.Close()
+		return fmt.Errorf("new streaming rtc connection: %w", err)
+	}
+	defer rtcConn.Close(*channelId)
+
+	// Ctrl-C stops the stream right away and still closes the connection
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *limit > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *limit)
+		defer cancel()
+	}
+
+	err = playCliSource(ctx, log, rtcConn, ingest.New(cfg.TranscodeCacheDir, cfg.FfmpegPath, cfg.OpusencPath), positional[0], *channelId)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// playCliSource plays a file, a downloaded URL or a live stream on conn
+func playCliSource(ctx context.Context, log *zap.Logger, conn rtc.IStreamingRTCConnection, pipeline *ingest.Pipeline, source, channelId string) error {
+	if !isStreamURL(source) {
+		path, err := pipeline.Ingest(ctx, source)
+		if err != nil {
+			return err
+		}
+		log.Info("[play] broadcasting", zap.String("file", path), zap.String("channelId", channelId))
+		return conn.PlayAudioTrack(ctx, path, nil)
+	}
+
+	info, err := pipeline.ProbeURL(ctx, source)
+	if err != nil {
+		return err
+	}
+	if !info.Live {
+		path, err := pipeline.IngestURL(ctx, source, info.Name)
+		if err != nil {
+			return err
+		}
+		log.Info("[play] broadcasting", zap.String("url", source), zap.String("file", path), zap.String("channelId", channelId))
+		return conn.PlayAudioTrack(ctx, path, nil)
+	}
+
+	live, err := pipeline.OpenLive(ctx, source, func(title string) {
+		log.Info("[play] live title", zap.String("title", title))
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("[play] broadcasting live", zap.String("url", source), zap.String("station", info.Name), zap.String("channelId", channelId))
+	return conn.PlaySource(ctx, live, nil)
+}
+
+func cliSimulateCommand(args []string) error {
+	fs := flag.NewFlagSet("simulate-command", flag.ContinueOnError)
+	configPath := fs.String("config", ".", "directory containing the .env file")
+	clanId := fs.String("clan", "", "clan id of the simulated message, defaults to CLAN_ID")
+	channelId := fs.String("channel", "", "text channel id of the simulated message, defaults to CHANNEL_ID")
+	senderId := fs.String("user", "", "sender id of the simulated message")
+	station := fs.String("station", "", "radio station address (host:port) instead of STN_DOMAIN, such as a mock-station; its certificate is not verified")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errors.New(`usage: simulate-command "<text>"`)
+	}
+
+	cfg, err := config.ReadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *clanId == "" {
+		*clanId = cfg.ClanId
+	}
+	if *channelId == "" {
+		*channelId = cfg.ChannelId
+	}
+	if *station != "" {
+		cfg.StnDomain, cfg.InsecureSkip = *station, true
+	}
+
+	log := logger.NewLogger(cfg.LogFile)
+	defer log.Sync()
+
+	simBot, err := NewSimulatedBot(cfg, log, websocket.NewFakeSocket(os.Stdout, cfg.BotId))
+	if err != nil {
+		return err
+	}
+	bot = simBot
+	registerCommands(bot)
+
+	content, err := websocket.EncodeContent(strings.Join(positional, " "))
+	if err != nil {
+		return err
+	}
+
+	err = simBot.handleCommand(&api.ChannelMessage{
+		ClanId:    *clanId,
+		ChannelId: *channelId,
+		SenderId:  *senderId,
+		Content:   content,
+		Mode:      constants.STREAM_MODE_CHANNEL,
+		IsPublic:  true,
+	})
+
+	// playback runs in the background, keep the process alive until the queue is done
+	player.Wait()
+	return err
+}
+
+func cliTranscode(args []string) error {
+	fs := flag.NewFlagSet("transcode", flag.ContinueOnError)
+	configPath := fs.String("config", ".", "directory containing the .env file")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errors.New("usage: transcode <file>...")
+	}
+
+	cfg, err := config.ReadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pipeline := ingest.New(cfg.TranscodeCacheDir, cfg.FfmpegPath, cfg.OpusencPath)
+	failed := 0
+	for _, path := range positional {
+		out, err := pipeline.Ingest(ctx, path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s -> %s\n", path, out)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed", failed)
+	}
+	return nil
+}
+
+func cliProbeAudio(args []string) error {
+	fs := flag.NewFlagSet("probe-audio", flag.ContinueOnError)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errors.New("usage: probe-audio <file>...")
+	}
+
+	failed := 0
+	for _, path := range positional {
+		info, err := media.ProbeOgg(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: %d ch, %d Hz input, pre-skip %d, %d packets (%s-%s), duration %s\n",
+			path, info.Channels, info.SampleRate, info.PreSkip, info.Packets,
+			info.MinPacketDuration, info.MaxPacketDuration, info.Duration)
+		for _, p := range info.Problems() {
+			fmt.Printf("  - %s\n", p)
+		}
+		if len(info.Problems()) > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) can not be streamed", failed)
+	}
+	return nil
+}
+
+func cliProtocolDoc(args []string) error {
+	fs := flag.NewFlagSet("protocol-doc", flag.ContinueOnError)
+	output := fs.String("o", "", "output file, stdout when empty")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return radiostation.WriteProtocolDoc(os.Stdout)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return radiostation.WriteProtocolDoc(file)
+}
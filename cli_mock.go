@@ -0,0 +1,100 @@
+//go:build mock
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mezon-go-bot/internal/ingest/mockradio"
+	"mezon-go-bot/internal/radio-station/mockstation"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// the offline stand-ins are left out of the bot binary, go build -tags mock adds them
+
+func init() {
+	commands["mock-station"] = cliMockStation
+	commands["mock-radio"] = cliMockRadio
+	cliMockUsage = `  mock-station [--addr <addr>] run a local radio station that records what it receives
+  mock-radio <file>            serve a file as a looping internet radio stream with ICY titles
+`
+}
+
+func cliMockStation(args []string) error {
+	fs := flag.NewFlagSet("mock-station", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8443", "listen address")
+	out := fs.String("out", "recordings", "directory for the received audio")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	station, err := mockstation.New(*addr, *out)
+	if err != nil {
+		return err
+	}
+	defer station.Close()
+
+	fmt.Printf("mock radio station on wss://%s/ws, recording to %s\n", station.Domain(), *out)
+	fmt.Printf("point the bot at it with STN_DOMAIN=%s and INSECURE_SKIP=true\n", station.Domain())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	for _, rec := range station.Recordings() {
+		state := "talking"
+		switch {
+		case rec.Left:
+			state = "left"
+		case !rec.Talking:
+			state = "silent"
+		}
+		fmt.Printf("%s: %d packets, %d bytes, %s, %s -> %s\n", rec.ChannelId, rec.Packets, rec.Bytes, rec.Duration, state, rec.Path)
+		if rec.Dropped > 0 {
+			fmt.Printf("%s: %d packets dropped, sent before the station let the bot talk\n", rec.ChannelId, rec.Dropped)
+		}
+		if rec.VideoCodec != "" {
+			fmt.Printf("%s: %s, %d frames, %d keyframes -> %s\n", rec.ChannelId, rec.VideoCodec, rec.VideoFrames, rec.Keyframes, rec.VideoPath)
+		}
+	}
+	return nil
+}
+
+func cliMockRadio(args []string) error {
+	fs := flag.NewFlagSet("mock-radio", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8000", "listen address")
+	name := fs.String("name", "", "station name (icy-name), defaults to the file name")
+	metaint := fs.Int("metaint", 16000, "bytes of audio between ICY metadata blocks, 0 disables them")
+	drop := fs.Duration("drop", 0, "close every connection after this long to test reconnects")
+	bitrate := fs.Int("bitrate", 0, "send rate in kbit/s, taken from the duration of an ogg file by default")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mock-radio <file> [--addr <addr>] [--drop <duration>]")
+	}
+
+	radio, err := mockradio.New(*addr, positional[0], mockradio.Options{
+		Name:      *name,
+		MetaInt:   *metaint,
+		DropAfter: *drop,
+		ByteRate:  *bitrate * 1000 / 8,
+	})
+	if err != nil {
+		return err
+	}
+	defer radio.Close()
+
+	fmt.Printf("mock radio on %s\n", radio.URL())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	fmt.Printf("%d connection(s) served\n", radio.Listeners())
+	return nil
+}
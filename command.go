@@ -1,76 +1,822 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/fs"
 	"mezon-go-bot/config"
 	"mezon-go-bot/internal/constants"
+	"mezon-go-bot/internal/helper"
+	"mezon-go-bot/internal/ingest"
+	"mezon-go-bot/internal/library"
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+	"mezon-go-bot/internal/player"
 	radiostation "mezon-go-bot/internal/radio-station"
+	"mezon-go-bot/internal/recording"
 	"mezon-go-bot/internal/rtc"
+	"mezon-go-bot/internal/settings"
+	"mezon-go-bot/internal/soundboard"
+	"mezon-go-bot/internal/tts"
+	"mezon-go-bot/internal/websocket"
 	"mezon-go-bot/pkg/clients"
+	"mezon-go-bot/pkg/responses"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nccasia/mezon-go-sdk/configs"
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
 	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 )
 
-func Ncc8Handler(command string, args []string) error {
-	// Load Config
-	cfg := config.LoadConfig()
+func Ncc8Handler(msg *api.ChannelMessage, command string, args []string) error {
+	cfg := bot.Config()
+	if len(args) == 0 {
+		return nil
+	}
 
-	wsConn, err := radiostation.NewWSConnection(&configs.Config{
-		BasePath:     bot.Config().StnDomain,
-		Timeout:      15,
-		InsecureSkip: bot.Config().InsecureSkip,
-		UseSSL:       false,
-	}, cfg.ClanId, cfg.ChannelId, bot.Config().BotId, cfg.BotName, cfg.Token)
+	clanId := msg.GetClanId()
+	if clanId == "" {
+		clanId = cfg.ClanId
+	}
+	targets, args, err := broadcastTargets(msg, clanId, args)
 	if err != nil {
-		bot.Logger().Error("[ncc8] radiostation new ws signaling error", zap.Error(err))
-		return err
+		return bot.Reply(msg, err.Error())
+	}
+	if len(args) == 0 {
+		return nil
 	}
 
 	switch args[0] {
 	case constants.NCC8_ARG_PLAY:
-
-		rtcConn, err := rtc.NewStreamingRTCConnection(webrtc.Configuration{
-			ICEServers: []webrtc.ICEServer{constants.ICE_GOOGLE},
-		}, wsConn, cfg.ClanId, cfg.ChannelId, bot.Config().BotId, "NCC8")
+		items, err := uploadedItems(msg)
 		if err != nil {
-			bot.Logger().Error("[ncc8] new streaming rtc connection error", zap.Error(err))
-			return err
+			return bot.Reply(msg, err.Error())
+		}
+		if len(items) == 0 && len(args) == 2 && isStreamURL(args[1]) {
+			item, err := resolveURLItem(args[1])
+			if err != nil {
+				return bot.Reply(msg, err.Error())
+			}
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			item, err := resolveNcc8Item(strings.Join(args[1:], " "))
+			if err != nil {
+				return bot.Reply(msg, err.Error())
+			}
+			items = append(items, item)
 		}
 
-		// TODO: get mp3 by args[1]
-		// TODO: ffmpeg convert mp3 to ogg: ffmpeg -i test.mp3 -c:a libopus -page_duration 20000 test.ogg
-		err = rtcConn.SendAudioTrack("audio/ncc8.ogg")
+		p, err := player.Get(targetChannelIds(targets), ncc8Opener(cfg, targets), ncc8Hooks(msg))
 		if err != nil {
-			bot.Logger().Error("[ncc8] send audio file error", zap.Error(err))
-			return err
+			return bot.Reply(msg, err.Error())
+		}
+		// a running queue keeps its volume, it may have been changed for the session
+		if !p.Running() {
+			p.SetVolume(channelVolume(targets))
+		}
+		for _, item := range items {
+			item.RequestedBy, item.RequestedByName = msg.GetSenderId(), senderName(msg)
+			item.Gain = normalizedGain(item)
+			if pos := p.Enqueue(item); pos > 0 {
+				if err := bot.Reply(msg, fmt.Sprintf("queued #%d: %s (%s)", pos, item.Title, itemLength(item))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case constants.NCC8_ARG_SEARCH:
+		if len(args) < 2 {
+			return bot.Reply(msg, "usage: ncc8 search <text>")
+		}
+		found := bot.Library().Search(strings.Join(args[1:], " "))
+		if len(found) == 0 {
+			return bot.Reply(msg, "no episode found")
+		}
+		if len(found) > constants.NCC8_LIST_PAGE_SIZE {
+			found = found[:constants.NCC8_LIST_PAGE_SIZE]
+		}
+		return bot.Reply(msg, formatEpisodes(found))
+
+	case constants.NCC8_ARG_LIST:
+		page := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return bot.Reply(msg, "usage: ncc8 list [page]")
+			}
+			page = n
+		}
+		episodes, pages := bot.Library().Page(page, constants.NCC8_LIST_PAGE_SIZE)
+		if pages == 0 {
+			return bot.Reply(msg, "the library is empty")
+		}
+		if len(episodes) == 0 {
+			return bot.Reply(msg, fmt.Sprintf("page %d of %d does not exist", page, pages))
+		}
+		return bot.Reply(msg, fmt.Sprintf("%spage %d/%d", formatEpisodes(episodes), page, pages))
+
+	case constants.NCC8_ARG_VOLUME:
+		return volumeControl(msg, targets, args)
+
+	case constants.NCC8_ARG_ANNOUNCE:
+		return announce(msg, targets)
+
+	case constants.NCC8_ARG_STATS:
+		return streamStats(msg, targets[0].ChannelId)
+	}
+
+	return playerControl(msg, targets[0].ChannelId, args)
+}
+
+// announce mixes the audio file attached to the command over what the target channels hear, their
+// music is ducked under it
+func announce(msg *api.ChannelMessage, targets []broadcastTarget) error {
+	items, err := uploadedItems(msg)
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	if len(items) == 0 {
+		return bot.Reply(msg, "usage: ncc8 announce, with an audio file attached")
+	}
+	p, ok := player.Lookup(targets[0].ChannelId)
+	if !ok {
+		return bot.Reply(msg, player.ErrNotPlaying.Error())
+	}
+
+	for _, item := range items {
+		item.Gain = normalizedGain(item)
+		bot.Logger().Info("[ncc8] announce", zap.Strings("channelIds", p.ChannelIds()), zap.String("title", item.Title),
+			zap.String("by", msg.GetSenderId()))
+		if err := p.Announce(context.Background(), item); err != nil {
+			return bot.Reply(msg, err.Error())
 		}
+	}
+	return nil
+}
+
+// streamStats replies how the radio station receives each channel of the session playing in channelId
+func streamStats(msg *api.ChannelMessage, channelId string) error {
+	p, ok := player.Lookup(channelId)
+	if !ok {
+		return bot.Reply(msg, player.ErrNotPlaying.Error())
+	}
+
+	var sb strings.Builder
+	for _, id := range p.ChannelIds() {
+		stats, ok := rtc.StatsOf(rtc.StreamBroadcast, id)
+		switch {
+		case !ok:
+			fmt.Fprintf(&sb, "%s: not connected\n", id)
+		case stats.Audio.Reports == 0:
+			fmt.Fprintf(&sb, "%s: no receiver report yet\n", id)
+		default:
+			fmt.Fprintf(&sb, "%s: audio %s", id, formatTrackStats(stats.Audio))
+			if stats.Video != nil && stats.Video.Reports > 0 {
+				fmt.Fprintf(&sb, "; video %s", formatTrackStats(*stats.Video))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return bot.Reply(msg, sb.String())
+}
+
+func formatTrackStats(t rtc.TrackStats) string {
+	s := fmt.Sprintf("loss %.1f%% (avg %.1f%%, %d lost), jitter %.1f ms", t.FractionLost*100, t.AvgFractionLost*100,
+		t.PacketsLost, t.JitterMs)
+	if t.RttMs > 0 {
+		s += fmt.Sprintf(", rtt %.1f ms", t.RttMs)
+	}
+	return s + fmt.Sprintf(", %d reports", t.Reports)
+}
 
+// playerControl runs the queue and playback commands shared by ncc8 and movie on the player covering
+// channelId, a broadcast to several channels is controlled from any of them
+func playerControl(msg *api.ChannelMessage, channelId string, args []string) error {
+	p, ok := player.Lookup(channelId)
+	if !ok {
+		return bot.Reply(msg, player.ErrNotPlaying.Error())
+	}
+
+	switch args[0] {
 	case constants.NCC8_ARG_STOP:
-		rtcConn, ok := rtc.MapStreamingRtcConn.Load(cfg.ChannelId)
-		if !ok {
-			bot.Logger().Error("Connection not found for channelId", zap.String("channelId", cfg.ChannelId))
-			return err
+		if err := p.Stop(senderName(msg)); err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		bot.Logger().Info("[ncc8] stopped", zap.Strings("channelIds", p.ChannelIds()), zap.String("by", msg.GetSenderId()))
+
+	case constants.NCC8_ARG_QUEUE:
+		current, pending := p.Queue()
+		if current == nil && len(pending) == 0 {
+			return bot.Reply(msg, "the queue is empty")
 		}
 
-		if conn, ok := rtcConn.(*rtc.StreamingRTCConn); ok {
-			conn.Close(cfg.ChannelId)
-			bot.Logger().Info("Connection closed for channelId", zap.String("channelId", cfg.ChannelId))
-		} else {
-			bot.Logger().Error("Error casting connection", zap.String("channelId", cfg.ChannelId))
+		var sb strings.Builder
+		if current != nil {
+			fmt.Fprintf(&sb, "now playing: %s\n", current.Title)
 		}
+		for i, item := range pending {
+			fmt.Fprintf(&sb, "%d. %s\n", i+1, item.Title)
+		}
+		return bot.Reply(msg, sb.String())
 
-		_, ok = rtc.MapStreamingRtcConn.Load(cfg.ChannelId)
-		if !ok {
-			bot.Logger().Info("Channel ID successfully removed from the map", zap.String("channelId", cfg.ChannelId))
+	case constants.NCC8_ARG_SKIP:
+		// the end of the item is announced by the now playing message
+		if _, err := p.Skip(senderName(msg)); err != nil {
+			return bot.Reply(msg, err.Error())
 		}
 
+	case constants.NCC8_ARG_REMOVE:
+		if len(args) < 2 {
+			return bot.Reply(msg, "usage: ncc8 remove <n>")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return bot.Reply(msg, "usage: ncc8 remove <n>")
+		}
+		item, err := p.Remove(n)
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		return bot.Reply(msg, fmt.Sprintf("removed %s", item.Title))
+
+	case constants.NCC8_ARG_CLEAR:
+		return bot.Reply(msg, fmt.Sprintf("cleared %d item(s)", p.Clear()))
+
+	case constants.NCC8_ARG_LOOP:
+		if p.ToggleLoop() {
+			return bot.Reply(msg, "loop on")
+		}
+		return bot.Reply(msg, "loop off")
+
+	case constants.NCC8_ARG_PAUSE:
+		paused, err := p.Pause()
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if !paused {
+			return bot.Reply(msg, "already paused")
+		}
+		return bot.Reply(msg, "paused")
+
+	case constants.NCC8_ARG_RESUME:
+		resumed, err := p.Resume()
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if !resumed {
+			return bot.Reply(msg, "not paused")
+		}
+		return bot.Reply(msg, "resumed")
+
+	case constants.NCC8_ARG_SEEK:
+		if len(args) < 2 {
+			return bot.Reply(msg, "usage: ncc8 seek <m:ss>")
+		}
+		to, err := helper.ParseTimestamp(args[1])
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if err := p.Seek(to); err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		return bot.Reply(msg, fmt.Sprintf("seek to %s", helper.FormatTimestamp(to)))
+
+	case constants.NCC8_ARG_NOW:
+		item, pos, dur, err := p.Position()
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if item.Open != nil {
+			return bot.Reply(msg, fmt.Sprintf("%s %s / live", item.Title, helper.FormatTimestamp(pos)))
+		}
+		return bot.Reply(msg, fmt.Sprintf("%s %s / %s", item.Title, helper.FormatTimestamp(pos), helper.FormatTimestamp(dur)))
 	}
 
 	return nil
 }
 
+// volumeControl shows or sets the volume of the target channels. Admins keep it as their volume setting,
+// others only change the volume of the playing queue. The playing item takes it right away.
+func volumeControl(msg *api.ChannelMessage, targets []broadcastTarget, args []string) error {
+	store := bot.Settings()
+	if len(args) < 2 {
+		return bot.Reply(msg, fmt.Sprintf("volume: %d%%", store.Get(targets[0].ClanId, targets[0].ChannelId).VolumePercent()))
+	}
+	if !bot.Ingest().CanProcess() {
+		return bot.Reply(msg, "can not change the volume without ffmpeg")
+	}
+	percent, err := settings.ParseVolume(args[1])
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	p, playing := player.Lookup(targets[0].ChannelId)
+
+	if !bot.Config().IsAdmin(msg.GetSenderId()) {
+		if !playing {
+			return bot.Reply(msg, "only admins can set the volume of a channel, others can change it while something plays")
+		}
+		p.SetVolume(float64(percent) / 100)
+		bot.Logger().Info("[ncc8] session volume", zap.Strings("channelIds", p.ChannelIds()), zap.Int("percent", percent),
+			zap.String("by", msg.GetSenderId()))
+		return bot.Reply(msg, fmt.Sprintf("volume: %d%% for now, the channel keeps %d%%", percent,
+			store.Get(targets[0].ClanId, targets[0].ChannelId).VolumePercent()))
+	}
+
+	for _, t := range targets {
+		if err := store.Set(t.ClanId, t.ChannelId, settings.KEY_VOLUME, args[1]); err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+	}
+	volume := channelVolume(targets)
+	if playing {
+		p.SetVolume(volume)
+	}
+
+	bot.Logger().Info("[ncc8] volume", zap.Strings("channelIds", targetChannelIds(targets)), zap.Float64("volume", volume),
+		zap.String("by", msg.GetSenderId()))
+	return bot.Reply(msg, fmt.Sprintf("volume: %.0f%%", volume*100))
+}
+
+// channelVolume is the volume setting of the first target, a broadcast plays one stream for all
+func channelVolume(targets []broadcastTarget) float64 {
+	return float64(bot.Settings().Get(targets[0].ClanId, targets[0].ChannelId).VolumePercent()) / 100
+}
+
+// normalizedGain brings a file item to the loudness target, live items are normalized as they play. Files
+// are measured at ingest in the background, one whose analysis has not finished yet plays as it is.
+func normalizedGain(item player.Item) float64 {
+	if item.Open != nil || item.Path == "" || !bot.Ingest().CanProcess() {
+		return 0
+	}
+
+	loudness, ok := bot.Ingest().KnownLoudness(item.Path)
+	if !ok {
+		bot.Logger().Info("[ncc8] loudness not measured yet, playing at unity gain", zap.String("path", item.Path))
+		return 0
+	}
+	return loudness.Gain()
+}
+
+// MovieHandler plays movies (#rapchieuphim) from MOVIE_DIR on the same channels as ncc8. They share the
+// channel queue with ncc8, so every other subcommand is the ncc8 one.
+func MovieHandler(msg *api.ChannelMessage, command string, args []string) error {
+	cfg := bot.Config()
+	if len(args) == 0 {
+		return nil
+	}
+
+	clanId := msg.GetClanId()
+	if clanId == "" {
+		clanId = cfg.ClanId
+	}
+	targets, args, err := broadcastTargets(msg, clanId, args)
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch args[0] {
+	case constants.MOVIE_ARG_PLAY:
+		if len(args) < 2 {
+			return bot.Reply(msg, "usage: movie play <name>")
+		}
+		item, err := resolveMovie(cfg.MovieDir, strings.Join(args[1:], " "))
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+
+		item.RequestedBy, item.RequestedByName = msg.GetSenderId(), senderName(msg)
+		item.Gain = normalizedGain(item)
+		p, err := player.Get(targetChannelIds(targets), ncc8Opener(cfg, targets), ncc8Hooks(msg))
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		// a running queue keeps its volume, it may have been changed for the session
+		if !p.Running() {
+			p.SetVolume(channelVolume(targets))
+		}
+		if pos := p.Enqueue(item); pos > 0 {
+			return bot.Reply(msg, fmt.Sprintf("queued #%d: %s (%s)", pos, item.Title, itemLength(item)))
+		}
+		return nil
+
+	case constants.MOVIE_ARG_LIST:
+		movies, err := movieFiles(cfg.MovieDir)
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if len(movies) == 0 {
+			return bot.Reply(msg, "no movie found")
+		}
+
+		var sb strings.Builder
+		for _, path := range movies {
+			fmt.Fprintln(&sb, movieName(path))
+		}
+		return bot.Reply(msg, sb.String())
+
+	case constants.NCC8_ARG_VOLUME:
+		return volumeControl(msg, targets, args)
+	}
+
+	return playerControl(msg, targets[0].ChannelId, args)
+}
+
+// resolveMovie finds a movie by file name, or a unique partial match, and prepares its streams
+func resolveMovie(dir, query string) (player.Item, error) {
+	movies, err := movieFiles(dir)
+	if err != nil {
+		return player.Item{}, err
+	}
+
+	var found []string
+	for _, path := range movies {
+		name := movieName(path)
+		if strings.EqualFold(name, query) {
+			found = []string{path}
+			break
+		}
+		if strings.Contains(strings.ToLower(name), strings.ToLower(query)) {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return player.Item{}, fmt.Errorf("movie not found: %s", query)
+	case 1:
+	default:
+		return player.Item{}, fmt.Errorf("%d movies match %q, try movie list", len(found), query)
+	}
+
+	video, sound, err := bot.Ingest().IngestVideo(context.Background(), found[0])
+	if err != nil {
+		bot.Logger().Error("[movie] ingest error", zap.String("file", found[0]), zap.Error(err))
+		return player.Item{}, fmt.Errorf("can not play %s: %v", movieName(found[0]), err)
+	}
+
+	item := player.Item{Title: movieName(found[0]), Path: sound, Video: video}
+	if sound != "" {
+		if info, err := media.ProbeOgg(sound); err == nil {
+			item.Duration = info.Duration
+		}
+	} else if duration, err := media.ProbeIVF(video); err == nil {
+		item.Duration = duration
+	}
+	return item, nil
+}
+
+// movieFiles lists the movies under dir, sorted by path
+func movieFiles(dir string) ([]string, error) {
+	var movies []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && ingest.SupportedVideo(path) {
+			movies = append(movies, path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return movies, err
+}
+
+func movieName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// resolveNcc8Item finds an episode by number, "latest" (also the default), file name, title or a unique search match
+func resolveNcc8Item(query string) (player.Item, error) {
+	lib := bot.Library()
+
+	var episode library.Episode
+	var err error
+	if number, convErr := strconv.Atoi(query); convErr == nil {
+		episode, err = lib.Episode(number)
+	} else if query == "" || query == constants.NCC8_ARG_LATEST {
+		episode, err = lib.Latest()
+	} else if episode, err = lib.Lookup(query); errors.Is(err, library.ErrNotFound) {
+		switch found := lib.Search(query); len(found) {
+		case 0:
+		case 1:
+			episode, err = found[0], nil
+		default:
+			return player.Item{}, fmt.Errorf("%d episodes match %q, try ncc8 search", len(found), query)
+		}
+	}
+	if err != nil {
+		return player.Item{}, err
+	}
+
+	return player.Item{
+		Title:    episodeTitle(episode),
+		Path:     episode.Stream,
+		Duration: episode.Duration,
+	}, nil
+}
+
+// itemLength is the duration shown in replies, live streams have none
+func itemLength(item player.Item) string {
+	if item.Open != nil {
+		return "live"
+	}
+	return helper.FormatTimestamp(item.Duration)
+}
+
+func isStreamURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// resolveURLItem plays a live stream (internet radio) as it comes and downloads anything else like an upload
+func resolveURLItem(url string) (player.Item, error) {
+	info, err := bot.Ingest().ProbeURL(context.Background(), url)
+	if err != nil {
+		bot.Logger().Error("[ncc8] probe url error", zap.String("url", url), zap.Error(err))
+		return player.Item{}, fmt.Errorf("can not open %s: %v", url, err)
+	}
+
+	if !info.Live {
+		path, err := bot.Ingest().IngestURL(context.Background(), url, info.Name)
+		if err != nil {
+			bot.Logger().Error("[ncc8] ingest url error", zap.String("url", url), zap.Error(err))
+			return player.Item{}, fmt.Errorf("can not use %s: %v", info.Name, err)
+		}
+
+		item := player.Item{Title: strings.TrimSuffix(info.Name, filepath.Ext(info.Name)), Path: path}
+		if probe, err := media.ProbeOgg(path); err == nil {
+			item.Duration = probe.Duration
+		}
+		return item, nil
+	}
+
+	return player.Item{
+		Title: info.Name,
+		Path:  url,
+		Open: func(ctx context.Context, onTitle func(title string)) (media.Source, error) {
+			live, err := bot.Ingest().OpenLive(ctx, url, onTitle)
+			if err != nil {
+				return nil, err
+			}
+			return live, nil
+		},
+	}, nil
+}
+
+// uploadedItems transcodes the audio files attached to a play command
+func uploadedItems(msg *api.ChannelMessage) ([]player.Item, error) {
+	attachments, err := websocket.DecodeAttachments(msg.GetAttachments())
+	if err != nil {
+		bot.Logger().Error("[ncc8] decode attachments error", zap.Error(err))
+		return nil, nil
+	}
+
+	var items []player.Item
+	for _, a := range attachments {
+		if !ingest.Supported(a.GetFilename()) {
+			continue
+		}
+
+		path, err := bot.Ingest().IngestURL(context.Background(), a.GetUrl(), a.GetFilename())
+		if err != nil {
+			bot.Logger().Error("[ncc8] ingest upload error", zap.String("file", a.GetFilename()), zap.Error(err))
+			return nil, fmt.Errorf("can not use %s: %v", a.GetFilename(), err)
+		}
+
+		item := player.Item{
+			Title: strings.TrimSuffix(a.GetFilename(), filepath.Ext(a.GetFilename())),
+			Path:  path,
+		}
+		if info, err := media.ProbeOgg(path); err == nil {
+			item.Duration = info.Duration
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func episodeTitle(e library.Episode) string {
+	if e.Number > 0 {
+		return fmt.Sprintf("#%d %s", e.Number, e.Title)
+	}
+	return e.Title
+}
+
+func formatEpisodes(episodes []library.Episode) string {
+	var sb strings.Builder
+	for _, e := range episodes {
+		fmt.Fprintf(&sb, "%s (%s)\n", episodeTitle(e), helper.FormatTimestamp(e.Duration))
+	}
+	return sb.String()
+}
+
+// broadcastTarget is a voice channel ncc8 and movie stream to
+type broadcastTarget struct {
+	ClanId    string
+	ChannelId string
+}
+
+// errForeignClan refuses a --channel of another clan to whoever is not an admin
+var errForeignClan = errors.New("only admins can target a channel of another clan")
+
+// broadcastTargets removes the --channel flags from args and returns the channels the command applies
+// to: the flagged ones (<channel_id> in this clan or, for admins, <clan_id>/<channel_id>), else the voice
+// channel of the sender, else the broadcast channel setting
+func broadcastTargets(msg *api.ChannelMessage, clanId string, args []string) ([]broadcastTarget, []string, error) {
+	var targets []broadcastTarget
+	var rest []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i++ {
+		if args[i] != constants.NCC8_FLAG_CHANNEL || i+1 == len(args) {
+			rest = append(rest, args[i])
+			continue
+		}
+
+		i++
+		target := broadcastTarget{ClanId: clanId, ChannelId: args[i]}
+		if clan, channel, ok := strings.Cut(args[i], "/"); ok {
+			if clan != clanId && !bot.Config().IsAdmin(msg.GetSenderId()) {
+				return nil, nil, errForeignClan
+			}
+			target = broadcastTarget{ClanId: clan, ChannelId: channel}
+		}
+		if !seen[target.ChannelId] {
+			seen[target.ChannelId] = true
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) > 0 {
+		return targets, rest, nil
+	}
+
+	channelId, err := bot.VoiceChannel(clanId, msg.GetSenderId())
+	if err != nil {
+		bot.Logger().Error("[ncc8] list voice channel users error", zap.Error(err))
+	}
+	if channelId == "" {
+		channelId = bot.Settings().Get(clanId, msg.GetChannelId()).BroadcastChannelId
+	}
+	return []broadcastTarget{{ClanId: clanId, ChannelId: channelId}}, rest, nil
+}
+
+func targetChannelIds(targets []broadcastTarget) []string {
+	ids := make([]string, len(targets))
+	for i, t := range targets {
+		ids[i] = t.ChannelId
+	}
+	return ids
+}
+
+// ncc8Opener connects the target channels once per playback session, every queued item reuses it.
+// Several channels share one broadcast, so each packet is read and paced once for all of them.
+func ncc8Opener(cfg *config.AppConfig, targets []broadcastTarget) player.Opener {
+	iceConfig := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{constants.ICE_GOOGLE},
+	}
+
+	return func() (rtc.IStreamingRTCConnection, error) {
+		if len(targets) == 1 {
+			clanId, channelId := targets[0].ClanId, targets[0].ChannelId
+			wsConn, err := newStationConnection(cfg, clanId, channelId)
+			if err != nil {
+				bot.Logger().Error("[ncc8] radiostation new ws signaling error", zap.Error(err))
+				return nil, err
+			}
+
+			rtcConn, err := rtc.NewStreamingRTCConnection(iceConfig, wsConn, clanId, channelId, cfg.BotId, constants.NCC8_DISPLAY_NAME)
+			if err != nil {
+				wsConn.Close()
+				bot.Logger().Error("[ncc8] new streaming rtc connection error", zap.Error(err))
+				return nil, err
+			}
+			recordBroadcast(rtcConn, targets)
+			return rtcConn, nil
+		}
+
+		var joined []rtc.BroadcastTarget
+		for _, t := range targets {
+			wsConn, err := newStationConnection(cfg, t.ClanId, t.ChannelId)
+			if err != nil {
+				for _, j := range joined {
+					j.Ws.Close()
+				}
+				bot.Logger().Error("[ncc8] radiostation new ws signaling error", zap.String("channelId", t.ChannelId), zap.Error(err))
+				return nil, fmt.Errorf("channel %s: %w", t.ChannelId, err)
+			}
+			joined = append(joined, rtc.BroadcastTarget{ClanId: t.ClanId, ChannelId: t.ChannelId, Ws: wsConn})
+		}
+
+		rtcConn, err := rtc.NewBroadcast(iceConfig, joined, cfg.BotId, constants.NCC8_DISPLAY_NAME)
+		if err != nil {
+			bot.Logger().Error("[ncc8] new broadcast error", zap.Error(err))
+			return nil, err
+		}
+		recordBroadcast(rtcConn, targets)
+		return rtcConn, nil
+	}
+}
+
+// recordBroadcast records a playback session when every target channel records. The listeners hear the
+// notice first, the session is recorded only once it played.
+func recordBroadcast(conn rtc.IStreamingRTCConnection, targets []broadcastTarget) {
+	archive := bot.Recordings()
+	if archive == nil || bot.RecordingNotice() == "" {
+		return
+	}
+	for _, t := range targets {
+		if !bot.Settings().Get(t.ClanId, t.ChannelId).RecordingEnabled() {
+			return
+		}
+	}
+
+	// the notice is only heard once the station connected and let the bot talk, before it is lost
+	ctx, cancel := context.WithTimeout(context.Background(), constants.NCC8_READY_TIMEOUT)
+	defer cancel()
+	if err := conn.WaitReady(ctx); err != nil {
+		bot.Logger().Error("[ncc8] station not ready for the recording notice, not recording", zap.Error(err))
+		return
+	}
+	if err := conn.SendAudioTrack(bot.RecordingNotice()); err != nil {
+		bot.Logger().Error("[ncc8] play recording notice error, not recording", zap.Error(err))
+		return
+	}
+	session, err := archive.Start(recording.KindBroadcast, targets[0].ClanId, targetChannelIds(targets), "")
+	if err != nil {
+		bot.Logger().Error("[ncc8] start recording error", zap.Error(err))
+		return
+	}
+	conn.Record(session)
+	bot.Logger().Info("[ncc8] recording", zap.String("id", session.Id()), zap.Strings("channelIds", targetChannelIds(targets)))
+}
+
+var (
+	stationTokensOnce sync.Once
+	stationTokens     radiostation.TokenSource
+)
+
+func stationConfig(cfg *config.AppConfig) *configs.Config {
+	return &configs.Config{
+		BasePath:     cfg.StnDomain,
+		Timeout:      15,
+		InsecureSkip: cfg.InsecureSkip,
+		UseSSL:       false,
+	}
+}
+
+// stationTokenSource is shared by every connection so a refreshed token is reused across reconnects
+func stationTokenSource(cfg *config.AppConfig) radiostation.TokenSource {
+	stationTokensOnce.Do(func() {
+		if cfg.StnAuthMode == config.STN_AUTH_EXCHANGE {
+			stationTokens = radiostation.NewExchangeTokenSource(stationConfig(cfg), cfg.StnAuthPath, cfg.ApiKey, cfg.BotId, cfg.BotName)
+			return
+		}
+		stationTokens = radiostation.NewStaticTokenSource(cfg.Token)
+	})
+	return stationTokens
+}
+
+// stopStationTokens ends the background token renewal on shutdown, no token source is created afterwards
+func stopStationTokens() {
+	stationTokensOnce.Do(func() {})
+	if stationTokens != nil {
+		stationTokens.Stop()
+	}
+}
+
+// newStationConnection joins the channel on the shared radio station socket and reports its state to the health check
+func newStationConnection(cfg *config.AppConfig, clanId, channelId string) (radiostation.IWSConnection, error) {
+	// the exchange protocol takes the token as a header, the legacy static token stays in the query string
+	inHeader := cfg.StnAuthMode == config.STN_AUTH_EXCHANGE
+
+	wsConn, err := radiostation.Join(stationConfig(cfg), clanId, channelId, cfg.BotId, cfg.BotName, cfg.Token,
+		radiostation.WithKeepalive(cfg.StnPingInterval, cfg.StnPongTimeout),
+		radiostation.WithTokenSource(stationTokenSource(cfg), inHeader))
+	if errors.Is(err, radiostation.ErrSessionExists) {
+		return nil, err
+	}
+	if err != nil {
+		stationHealth.Set(cfg.StnDomain, radiostation.StateDisconnected)
+		return nil, err
+	}
+
+	stationHealth.Set(cfg.StnDomain, wsConn.State())
+	wsConn.SetOnStateChange(func(state radiostation.ConnectionState) {
+		stationHealth.Set(cfg.StnDomain, state)
+	})
+	return wsConn, nil
+}
+
 func CheckinHandler(imageBase64 string) error {
 	res, err := clients.CheckinApi(imageBase64)
 	if err != nil {
@@ -81,6 +827,7 @@ func CheckinHandler(imageBase64 string) error {
 	bot.Logger().Info("[CheckinApi] send image", zap.Any("info", res))
 	if res.Probability >= constants.CHECKIN_PROBABILITY_SUCCESS {
 		bot.Logger().Info("[CheckinApi] checkin success", zap.Any("info", res))
+		notifyCheckin(res)
 
 		// return error close send image base64 to function
 		return errors.New("checkin success")
@@ -89,3 +836,309 @@ func CheckinHandler(imageBase64 string) error {
 	// return nil -> continue send image base64 to function
 	return nil
 }
+
+// notifyCheckin posts a successful checkin to the checkin channel and notification targets of the default clan
+func notifyCheckin(res *responses.CheckinRes) {
+	clanId := bot.Config().ClanId
+	s := bot.Settings().Get(clanId, "")
+	if !s.ModuleEnabled(constants.CHECKIN_MODULE) {
+		return
+	}
+
+	text := fmt.Sprintf("%s %s checked in", res.LastName, res.FirstName)
+	targets := append([]string{s.CheckinChannelId}, s.NotifyChannelIds...)
+	for _, channelId := range targets {
+		if channelId == "" {
+			continue
+		}
+		if err := bot.SendMessage(clanId, channelId, text); err != nil {
+			bot.Logger().Error("[CheckinApi] notify error", zap.String("channelId", channelId), zap.Error(err))
+		}
+	}
+}
+
+// SoundboardHandler plays short clips into the voice channel of the sender (same channel rules as ncc8),
+// over the queue when one plays there. Admins add clips from an attachment; admins and whoever added a clip
+// remove it.
+func SoundboardHandler(msg *api.ChannelMessage, command string, args []string) error {
+	if len(args) == 0 {
+		return bot.Reply(msg, "usage: sb <clip> | add <name> [cooldown] | list | remove <name>")
+	}
+	board := bot.Soundboard()
+
+	switch args[0] {
+	case constants.SB_ARG_LIST:
+		clips := board.List()
+		if len(clips) == 0 {
+			return bot.Reply(msg, "no clips yet, add one with sb add <name>")
+		}
+		var sb strings.Builder
+		for _, c := range clips {
+			fmt.Fprintf(&sb, "%s (%s, cooldown %s)\n", c.Name, helper.FormatTimestamp(c.Duration), c.Cooldown)
+		}
+		return bot.Reply(msg, sb.String())
+
+	case constants.SB_ARG_ADD:
+		if !bot.Config().IsAdmin(msg.GetSenderId()) {
+			return bot.Reply(msg, "only admins can add clips")
+		}
+		if len(args) < 2 || len(args) > 3 {
+			return bot.Reply(msg, "usage: sb add <name> [cooldown], with an audio file attached")
+		}
+		var cooldown time.Duration
+		if len(args) == 3 {
+			d, err := time.ParseDuration(args[2])
+			if err != nil || d < 0 {
+				return bot.Reply(msg, "cooldown must be a duration like 30s")
+			}
+			cooldown = d
+		}
+
+		items, err := uploadedItems(msg)
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if len(items) == 0 {
+			return bot.Reply(msg, "usage: sb add <name> [cooldown], with an audio file attached")
+		}
+		clip, err := board.Add(args[1], items[0].Path, cooldown, msg.GetSenderId())
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		bot.Logger().Info("[sb] added", zap.String("clip", clip.Name), zap.Duration("duration", clip.Duration), zap.String("by", msg.GetSenderId()))
+		return bot.Reply(msg, fmt.Sprintf("added %s (%s, cooldown %s)", clip.Name, helper.FormatTimestamp(clip.Duration), clip.Cooldown))
+
+	case constants.SB_ARG_REMOVE:
+		if len(args) != 2 {
+			return bot.Reply(msg, "usage: sb remove <name>")
+		}
+		clip, err := board.Get(args[1])
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		if !bot.Config().IsAdmin(msg.GetSenderId()) && clip.AddedBy != msg.GetSenderId() {
+			return bot.Reply(msg, "only admins and whoever added a clip can remove it")
+		}
+		if _, err := board.Remove(clip.Name); err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		bot.Logger().Info("[sb] removed", zap.String("clip", clip.Name), zap.String("by", msg.GetSenderId()))
+		return bot.Reply(msg, fmt.Sprintf("removed %s", clip.Name))
+	}
+
+	return playClip(msg, args)
+}
+
+// playClip plays a clip in the target channel: mixed over the queue when one plays, on its own otherwise
+func playClip(msg *api.ChannelMessage, args []string) error {
+	cfg := bot.Config()
+	clanId := msg.GetClanId()
+	if clanId == "" {
+		clanId = cfg.ClanId
+	}
+	targets, args, err := broadcastTargets(msg, clanId, args)
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	if len(args) != 1 {
+		return bot.Reply(msg, "usage: sb <clip>")
+	}
+	// the clip plays in the targets, their soundboard_users decide
+	for _, t := range targets {
+		if !bot.Settings().Get(t.ClanId, t.ChannelId).SoundboardAllowed(msg.GetSenderId()) {
+			return bot.Reply(msg, "you are not allowed to use the soundboard there")
+		}
+	}
+
+	clip, wait, err := bot.Soundboard().Use(args[0], targets[0].ChannelId)
+	if errors.Is(err, soundboard.ErrCoolingDown) {
+		return bot.Reply(msg, fmt.Sprintf("%s is cooling down, %s left", clip.Name, wait.Round(time.Second)))
+	}
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+
+	item := player.Item{
+		Title:           "sb: " + clip.Name,
+		Path:            bot.Soundboard().Path(clip),
+		Duration:        clip.Duration,
+		RequestedBy:     msg.GetSenderId(),
+		RequestedByName: senderName(msg),
+	}
+	item.Gain = normalizedGain(item)
+	bot.Logger().Info("[sb] play", zap.String("clip", clip.Name), zap.Strings("channelIds", targetChannelIds(targets)),
+		zap.String("by", msg.GetSenderId()))
+
+	err = overlay(targets, item, mixer.Effect)
+	if errors.Is(err, rtc.ErrNoMixer) {
+		return bot.Reply(msg, "clips can not play over the queue without ffmpeg")
+	}
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	return nil
+}
+
+// overlay mixes item as role over the queue playing in the target channels and returns once it played.
+// Without a queue there, item is queued on its own.
+func overlay(targets []broadcastTarget, item player.Item, role mixer.Role) error {
+	p, ok := player.Lookup(targets[0].ChannelId)
+	if !ok || !p.Running() {
+		var err error
+		if p, err = player.Get(targetChannelIds(targets), ncc8Opener(bot.Config(), targets), player.Hooks{}); err != nil {
+			return err
+		}
+		if !p.Running() {
+			p.SetVolume(channelVolume(targets))
+			p.Enqueue(item)
+			return nil
+		}
+	}
+
+	if role == mixer.Voice {
+		return p.Announce(context.Background(), item)
+	}
+	return p.PlayEffect(context.Background(), item)
+}
+
+var errNoTTS = errors.New("text to speech is not set up, see TTS_ENGINE")
+
+// SayHandler speaks text in the voice channel of the sender (same channel rules as ncc8), over the queue
+// when one plays there
+func SayHandler(msg *api.ChannelMessage, command string, args []string) error {
+	if bot.TTS() == nil {
+		return bot.Reply(msg, errNoTTS.Error())
+	}
+	clanId := msg.GetClanId()
+	if clanId == "" {
+		clanId = bot.Config().ClanId
+	}
+	targets, args, err := broadcastTargets(msg, clanId, args)
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+
+	var voice tts.Voice
+	var words []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == constants.SAY_FLAG_VOICE && i+1 < len(args):
+			i++
+			voice.Name = args[i]
+		case args[i] == constants.SAY_FLAG_LANG && i+1 < len(args):
+			i++
+			voice.Lang = args[i]
+		default:
+			words = append(words, args[i])
+		}
+	}
+	if len(words) == 0 {
+		return bot.Reply(msg, "usage: say [--lang <code>] [--voice <name>] <text>")
+	}
+	if voice.Lang == "" {
+		voice.Lang = bot.Settings().Get(clanId, msg.GetChannelId()).Language
+	}
+
+	err = say(targets, strings.Join(words, " "), voice, msg.GetSenderId(), senderName(msg))
+	if errors.Is(err, rtc.ErrNoMixer) {
+		return bot.Reply(msg, "text can not be spoken over the queue without ffmpeg")
+	}
+	if err != nil {
+		return bot.Reply(msg, err.Error())
+	}
+	return nil
+}
+
+// say renders text and speaks it in the target channels as an announcement, see overlay
+func say(targets []broadcastTarget, text string, voice tts.Voice, byId, byName string) error {
+	if bot.TTS() == nil {
+		return errNoTTS
+	}
+	path, err := bot.TTS().Render(context.Background(), text, voice)
+	if err != nil {
+		bot.Logger().Error("[say] render error", zap.String("voice", voice.String()), zap.Error(err))
+		return err
+	}
+
+	item := player.Item{
+		Title:           tts.Title(text),
+		Path:            path,
+		RequestedBy:     byId,
+		RequestedByName: byName,
+	}
+	if info, err := media.ProbeOgg(path); err == nil {
+		item.Duration = info.Duration
+	}
+	item.Gain = normalizedGain(item)
+	bot.Logger().Info("[say] speak", zap.String("title", item.Title), zap.Strings("channelIds", targetChannelIds(targets)),
+		zap.String("by", byId))
+	return overlay(targets, item, mixer.Voice)
+}
+
+func SettingsHandler(msg *api.ChannelMessage, command string, args []string) error {
+	if !bot.Config().IsAdmin(msg.GetSenderId()) {
+		return bot.Reply(msg, "only admins can manage settings")
+	}
+
+	if len(args) == 0 {
+		return bot.Reply(msg, "usage: settings get <key> | set [--channel] <key> [value] | list")
+	}
+
+	clanId := msg.GetClanId()
+	store := bot.Settings()
+
+	switch args[0] {
+	case constants.SETTINGS_ARG_GET:
+		if len(args) < 2 {
+			return bot.Reply(msg, "usage: settings get <key>")
+		}
+
+		value, err := store.Get(clanId, msg.GetChannelId()).Value(args[1])
+		if err != nil {
+			return bot.Reply(msg, err.Error())
+		}
+		return bot.Reply(msg, fmt.Sprintf("%s = %s", args[1], value))
+
+	case constants.SETTINGS_ARG_SET:
+		args = args[1:]
+		channelId := ""
+		if len(args) > 0 && args[0] == constants.SETTINGS_FLAG_CHANNEL {
+			channelId = msg.GetChannelId()
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return bot.Reply(msg, "usage: settings set [--channel] <key> [value]")
+		}
+
+		value := strings.Join(args[1:], " ")
+		if err := store.Set(clanId, channelId, args[0], value); err != nil {
+			bot.Logger().Error("[settings] set error", zap.String("key", args[0]), zap.Error(err))
+			return bot.Reply(msg, err.Error())
+		}
+
+		bot.Logger().Info("[settings] updated", zap.String("clanId", clanId), zap.String("channelId", channelId),
+			zap.String("key", args[0]), zap.String("value", value), zap.String("by", msg.GetSenderId()))
+		return bot.Reply(msg, fmt.Sprintf("%s = %s", args[0], value))
+
+	case constants.SETTINGS_ARG_LIST:
+		effective := store.Get(clanId, msg.GetChannelId())
+		clan := store.Scope(clanId, "")
+		channel := store.Scope(clanId, msg.GetChannelId())
+
+		var sb strings.Builder
+		for _, key := range settings.Keys {
+			value, _ := effective.Value(key)
+
+			source := "default"
+			if v, _ := channel.Value(key); v != "" {
+				source = "channel"
+			} else if v, _ := clan.Value(key); v != "" {
+				source = "clan"
+			}
+			fmt.Fprintf(&sb, "%s = %s (%s)\n", key, value, source)
+		}
+		return bot.Reply(msg, sb.String())
+	}
+
+	return bot.Reply(msg, fmt.Sprintf("unknown settings action: %s", args[0]))
+}
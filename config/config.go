@@ -1,14 +1,23 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 var Cfg = &AppConfig{}
 
+const (
+	STN_AUTH_STATIC   = "static"
+	STN_AUTH_EXCHANGE = "exchange"
+)
+
 type AppConfig struct {
 	MznDomain    string `json:"mzn_domain" mapstructure:"mzn_domain"`
 	StnDomain    string `json:"stn_domain" mapstructure:"stn_domain"`
@@ -21,29 +30,166 @@ type AppConfig struct {
 	ChannelId    string `json:"channel_id" mapstructure:"channel_id"`
 	BotName      string `json:"bot_name" mapstructure:"bot_name"`
 	Token        string `json:"token" mapstructure:"token"`
+	SettingsFile string `json:"settings_file" mapstructure:"settings_file"`
+	AdminIds     string `json:"admin_ids" mapstructure:"admin_ids"`
+
+	// radio station auth: "static" uses TOKEN, "exchange" trades API_KEY for short-lived tokens at STN_AUTH_PATH
+	StnAuthMode string `json:"stn_auth_mode" mapstructure:"stn_auth_mode"`
+	StnAuthPath string `json:"stn_auth_path" mapstructure:"stn_auth_path"`
+
+	// radio station keepalive, e.g. "15s"
+	StnPingInterval time.Duration `json:"stn_ping_interval" mapstructure:"stn_ping_interval"`
+	StnPongTimeout  time.Duration `json:"stn_pong_timeout" mapstructure:"stn_pong_timeout"`
+
+	// ncc8 episode library: MEDIA_DIR is scanned for .ogg files, the index is cached in LIBRARY_INDEX
+	MediaDir     string `json:"media_dir" mapstructure:"media_dir"`
+	LibraryIndex string `json:"library_index" mapstructure:"library_index"`
+
+	// JINGLE_FILE plays between two queued items, any format the ingest pipeline takes; empty disables it
+	JingleFile string `json:"jingle_file" mapstructure:"jingle_file"`
+
+	// soundboard clips for *sb, converted to Ogg Opus and indexed in SOUNDBOARD_DIR/clips.json
+	SoundboardDir string `json:"soundboard_dir" mapstructure:"soundboard_dir"`
+
+	// text to speech for *say and Bot.Announce: TTS_ENGINE is espeak, piper or fake (a tone per word, for
+	// offline runs), empty disables it. TTS_PATH is the engine binary, TTS_VOICE an espeak variant or a piper
+	// model in TTS_VOICE_DIR. Renders are cached in TTS_CACHE_DIR.
+	TtsEngine   string `json:"tts_engine" mapstructure:"tts_engine"`
+	TtsPath     string `json:"tts_path" mapstructure:"tts_path"`
+	TtsVoice    string `json:"tts_voice" mapstructure:"tts_voice"`
+	TtsLang     string `json:"tts_lang" mapstructure:"tts_lang"`
+	TtsVoiceDir string `json:"tts_voice_dir" mapstructure:"tts_voice_dir"`
+	TtsCacheDir string `json:"tts_cache_dir" mapstructure:"tts_cache_dir"`
+	// TTS_PROMPTS speaks the check-in prompts with the engine instead of playing the audio/*.ogg files
+	TtsPrompts bool `json:"tts_prompts" mapstructure:"tts_prompts"`
+
+	// recording of broadcasts and calls, for clans with the recording setting on: RECORDING_DIR empty
+	// disables it, RECORDING_RETENTION 0 keeps recordings forever. Callers and listeners are told first
+	// with RECORDING_NOTICE_FILE, or the notice spoken by TTS_ENGINE.
+	RecordingDir        string        `json:"recording_dir" mapstructure:"recording_dir"`
+	RecordingRetention  time.Duration `json:"recording_retention" mapstructure:"recording_retention"`
+	RecordingNoticeFile string        `json:"recording_notice_file" mapstructure:"recording_notice_file"`
+
+	// ADMIN_API_TOKEN enables the /admin/ endpoints, as a bearer token
+	AdminApiToken string `json:"admin_api_token" mapstructure:"admin_api_token"`
+
+	// movies for *movie play: IVF files (with an optional .ogg of the same name), WebM/MKV/MP4 through ffmpeg
+	MovieDir string `json:"movie_dir" mapstructure:"movie_dir"`
+
+	// transcoding of non-ogg audio, the tools are optional (wav only needs one of them)
+	TranscodeCacheDir string `json:"transcode_cache_dir" mapstructure:"transcode_cache_dir"`
+	FfmpegPath        string `json:"ffmpeg_path" mapstructure:"ffmpeg_path"`
+	OpusencPath       string `json:"opusenc_path" mapstructure:"opusenc_path"`
 }
 
-func LoadConfig(cPath ...string) *AppConfig {
-	v := viper.New()
+// IsAdmin reports whether userId is listed in ADMIN_IDS (comma separated)
+func (c *AppConfig) IsAdmin(userId string) bool {
+	if userId == "" {
+		return false
+	}
 
+	for _, id := range strings.Split(c.AdminIds, ",") {
+		if strings.TrimSpace(id) == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadConfig(cPath ...string) *AppConfig {
 	customConfigPath := "."
 	if len(cPath) > 0 {
 		customConfigPath = cPath[0]
 	}
 
-	v.SetConfigFile(".env")
-	v.AddConfigPath(customConfigPath)
+	cfg, err := ReadConfig(customConfigPath)
+	if err != nil {
+		log.Fatal("Error reading config file", err)
+	}
+
+	return cfg
+}
+
+// ReadConfig reads <configPath>/.env (overridable by environment variables) into Cfg
+func ReadConfig(configPath string) (*AppConfig, error) {
+	v := viper.New()
+
+	v.SetConfigFile(filepath.Join(configPath, ".env"))
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "__"))
 	v.AutomaticEnv()
 
 	if err := v.ReadInConfig(); err != nil {
-		log.Fatal("Error reading config file", err)
+		return nil, err
 	}
 
-	err := v.Unmarshal(&Cfg)
-	if err != nil {
-		log.Fatal("Failed to unmarshal config", err)
+	v.SetDefault("settings_file", "settings.json")
+	v.SetDefault("stn_auth_mode", STN_AUTH_STATIC)
+	v.SetDefault("stn_auth_path", "auth/token")
+	v.SetDefault("stn_ping_interval", "15s")
+	v.SetDefault("stn_pong_timeout", "10s")
+	v.SetDefault("media_dir", "audio/ncc8")
+	v.SetDefault("library_index", "library.json")
+	v.SetDefault("movie_dir", "video/rapchieuphim")
+	v.SetDefault("soundboard_dir", "audio/soundboard")
+	v.SetDefault("tts_lang", "en")
+	v.SetDefault("tts_voice_dir", "voices")
+	v.SetDefault("tts_cache_dir", "cache/tts")
+	v.SetDefault("recording_retention", "720h")
+	v.SetDefault("transcode_cache_dir", "cache/transcoded")
+	v.SetDefault("ffmpeg_path", "ffmpeg")
+	v.SetDefault("opusenc_path", "opusenc")
+
+	if err := v.Unmarshal(&Cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+
+	return Cfg, nil
+}
+
+// Validate returns every problem found in the config, nil when it is usable
+func (c *AppConfig) Validate() []error {
+	var errs []error
+
+	required := map[string]string{
+		"MZN_DOMAIN": c.MznDomain,
+		"STN_DOMAIN": c.StnDomain,
+		"API_KEY":    c.ApiKey,
+		"BOT_ID":     c.BotId,
+		"CLAN_ID":    c.ClanId,
+		"CHANNEL_ID": c.ChannelId,
+		"LOG_FILE":   c.LogFile,
+	}
+	for _, key := range []string{"MZN_DOMAIN", "STN_DOMAIN", "API_KEY", "BOT_ID", "CLAN_ID", "CHANNEL_ID", "LOG_FILE"} {
+		if strings.TrimSpace(required[key]) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", key))
+		}
+	}
+
+	for _, domain := range []string{c.MznDomain, c.StnDomain} {
+		if strings.Contains(domain, "://") {
+			errs = append(errs, fmt.Errorf("domain %q must not contain a scheme, use USE_SSL instead", domain))
+		}
+	}
+
+	switch c.StnAuthMode {
+	case STN_AUTH_STATIC:
+		if c.Token == "" {
+			errs = append(errs, errors.New("TOKEN is empty, the radio station will reject the bot"))
+		}
+	case STN_AUTH_EXCHANGE:
+		if c.StnAuthPath == "" {
+			errs = append(errs, errors.New("STN_AUTH_PATH is required with STN_AUTH_MODE=exchange"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STN_AUTH_MODE %q must be %s or %s", c.StnAuthMode, STN_AUTH_STATIC, STN_AUTH_EXCHANGE))
+	}
+
+	if c.RecordingDir != "" && c.RecordingNoticeFile == "" && c.TtsEngine == "" {
+		errs = append(errs, errors.New("RECORDING_DIR needs a consent notice, set RECORDING_NOTICE_FILE or TTS_ENGINE"))
+	}
+	if c.TtsPrompts && c.TtsEngine == "" {
+		errs = append(errs, errors.New("TTS_PROMPTS needs TTS_ENGINE"))
 	}
 
-	return Cfg
+	return errs
 }
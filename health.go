@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	radiostation "mezon-go-bot/internal/radio-station"
+	"net/http"
+	"sync"
+)
+
+var stationHealth = &healthTracker{stations: make(map[string]radiostation.ConnectionState)}
+
+// healthTracker keeps the last known state of every radio station connection
+type healthTracker struct {
+	mu       sync.RWMutex
+	stations map[string]radiostation.ConnectionState
+}
+
+func (h *healthTracker) Set(domain string, state radiostation.ConnectionState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stations[domain] = state
+}
+
+// Snapshot returns the station states and whether any of them is down
+func (h *healthTracker) Snapshot() (map[string]string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	degraded := false
+	stations := make(map[string]string, len(h.stations))
+	for domain, state := range h.stations {
+		stations[domain] = state.String()
+		if state == radiostation.StateReconnecting || state == radiostation.StateDisconnected {
+			degraded = true
+		}
+	}
+	return stations, degraded
+}
+
+// healthCheckHandler handles the health check request
+// The bot itself stays healthy while a radio station is down, so the status is degraded rather than an error.
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	stations, degraded := stationHealth.Snapshot()
+
+	status := "ok"
+	if degraded {
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        status,
+		"radio_station": stations,
+	})
+}
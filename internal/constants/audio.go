@@ -6,6 +6,19 @@ const (
 	CHECKIN_CHECKIN_SUCCESS_AUDIO_PATH = "audio/checkin-success.ogg"
 	CHECKIN_CHECKIN_FAIL_AUDIO_PATH    = "audio/checkin-failed.ogg"
 )
+
+// check-in prompts spoken with TTS_PROMPTS instead of the files above
+const (
+	CHECKIN_ACCEPT_CALL_TEXT     = "Hello! Please look at the camera to check in."
+	CHECKIN_EXIT_CALL_TEXT       = "Goodbye, have a nice day."
+	CHECKIN_CHECKIN_SUCCESS_TEXT = "Check-in successful."
+	CHECKIN_CHECKIN_FAIL_TEXT    = "Check-in failed, please try again."
+
+	// RECORDING_NOTICE_TEXT is spoken before a recording when no RECORDING_NOTICE_FILE is set
+	RECORDING_NOTICE_TEXT = "This session is being recorded."
+)
 const (
 	CHECKIN_PROBABILITY_SUCCESS = 0.6
 )
+
+const CHECKIN_MODULE = "checkin"
@@ -0,0 +1,7 @@
+package constants
+
+const (
+	MOVIE_COMMAND  = "movie"
+	MOVIE_ARG_PLAY = "play"
+	MOVIE_ARG_LIST = "list"
+)
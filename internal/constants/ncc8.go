@@ -1,7 +1,38 @@
 package constants
 
+import "time"
+
 const (
-	NCC8_COMMAND  = "ncc8"
-	NCC8_ARG_PLAY = "play"
-	NCC8_ARG_STOP = "stop"
+	NCC8_COMMAND      = "ncc8"
+	NCC8_ARG_PLAY     = "play"
+	NCC8_ARG_STOP     = "stop"
+	NCC8_ARG_QUEUE    = "queue"
+	NCC8_ARG_SKIP     = "skip"
+	NCC8_ARG_REMOVE   = "remove"
+	NCC8_ARG_CLEAR    = "clear"
+	NCC8_ARG_LOOP     = "loop"
+	NCC8_ARG_PAUSE    = "pause"
+	NCC8_ARG_RESUME   = "resume"
+	NCC8_ARG_SEEK     = "seek"
+	NCC8_ARG_NOW      = "now"
+	NCC8_ARG_VOLUME   = "volume"
+	NCC8_ARG_ANNOUNCE = "announce"
+	NCC8_ARG_SEARCH   = "search"
+	NCC8_ARG_LIST     = "list"
+	NCC8_ARG_LATEST   = "latest"
+	NCC8_ARG_STATS    = "stats"
+
+	// NCC8_FLAG_CHANNEL targets a voice channel, it may be repeated to broadcast to several
+	NCC8_FLAG_CHANNEL = "--channel"
+)
+
+const (
+	NCC8_DISPLAY_NAME   = "NCC8"
+	NCC8_LIST_PAGE_SIZE = 10
+
+	// NCC8_PROGRESS_INTERVAL is how often the now playing message is edited, edits are rate limited
+	NCC8_PROGRESS_INTERVAL = 15 * time.Second
+
+	// NCC8_READY_TIMEOUT bounds the wait for the station to hear a new session before the recording notice
+	NCC8_READY_TIMEOUT = 15 * time.Second
 )
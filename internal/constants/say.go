@@ -0,0 +1,9 @@
+package constants
+
+const (
+	SAY_COMMAND = "say"
+
+	// SAY_FLAG_VOICE and SAY_FLAG_LANG pick the voice and language of one message, see TTS_VOICE and TTS_LANG
+	SAY_FLAG_VOICE = "--voice"
+	SAY_FLAG_LANG  = "--lang"
+)
@@ -0,0 +1,27 @@
+package constants
+
+import "time"
+
+const (
+	SETTINGS_COMMAND  = "settings"
+	SETTINGS_ARG_GET  = "get"
+	SETTINGS_ARG_SET  = "set"
+	SETTINGS_ARG_LIST = "list"
+
+	// SETTINGS_FLAG_CHANNEL scopes a set to the current channel instead of the clan
+	SETTINGS_FLAG_CHANNEL = "--channel"
+)
+
+const (
+	DEFAULT_COMMAND_PREFIX = "*"
+	MAX_COMMAND_LENGTH     = 256
+)
+
+// STREAM_MODE_CHANNEL is the mezon stream mode of a clan text channel
+const STREAM_MODE_CHANNEL = 2
+
+// MESSAGE_ECHO_TIMEOUT bounds the wait for a sent message to come back with its id
+const MESSAGE_ECHO_TIMEOUT = 5 * time.Second
+
+// SHUTDOWN_TIMEOUT bounds the teardown of the playing sessions when the bot is stopped
+const SHUTDOWN_TIMEOUT = 10 * time.Second
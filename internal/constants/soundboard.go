@@ -0,0 +1,8 @@
+package constants
+
+const (
+	SB_COMMAND    = "sb"
+	SB_ARG_ADD    = "add"
+	SB_ARG_LIST   = "list"
+	SB_ARG_REMOVE = "remove"
+)
@@ -4,9 +4,14 @@ import (
 	"strings"
 )
 
-func ExtractMessage(message string) (string, []string) {
+func ExtractMessage(prefix, message string) (string, []string) {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, prefix) {
+		return "", []string{}
+	}
+
 	message = strings.ReplaceAll(message, "\n", " ")
-	message = strings.TrimSpace(message[len("*"):])
+	message = strings.TrimSpace(message[len(prefix):])
 
 	args := strings.Fields(message)
 	if len(args) > 0 {
@@ -0,0 +1,42 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidTimestamp = errors.New("invalid timestamp, use seconds, m:ss or h:mm:ss")
+
+// ParseTimestamp reads "90", "1:30", "1:02:03" or a Go duration such as "1m30s"
+func ParseTimestamp(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, ErrInvalidTimestamp
+	}
+
+	var total time.Duration
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, ErrInvalidTimestamp
+		}
+		total = total*60 + time.Duration(n)*time.Second
+	}
+	return total, nil
+}
+
+// FormatTimestamp prints a duration as m:ss, or h:mm:ss past an hour
+func FormatTimestamp(d time.Duration) string {
+	seconds := int(d / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,116 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"mezon-go-bot/internal/media"
+)
+
+// opusBitrate suits speech and music alike for a single radio stream
+const opusBitrate = "96k"
+
+var ErrNoEncoder = errors.New("no opus encoder available, install ffmpeg or opus-tools (opusenc)")
+
+// ffmpegFileArgs transcodes any input ffmpeg reads into 48 kHz stereo Opus with one 20 ms frame per page
+func ffmpegFileArgs(in, out string) []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", in,
+		"-vn", "-map_metadata", "0",
+		"-ac", "2", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE),
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-frame_duration", "20", "-page_duration", "20000",
+		"-f", "ogg", out,
+	}
+}
+
+// ffmpegPCMArgs encodes 48 kHz stereo s16le read from stdin, a page per frame like ffmpegFileArgs
+func ffmpegPCMArgs(out, title string) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-f", "s16le", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE), "-ac", "2", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-frame_duration", "20", "-page_duration", "20000",
+	}
+	if title != "" {
+		args = append(args, "-metadata", "title="+title)
+	}
+	return append(args, "-f", "ogg", out)
+}
+
+// opusencPCMArgs encodes 48 kHz stereo s16le read from stdin, --max-delay 20 flushes a page per frame
+func opusencPCMArgs(out, title string) []string {
+	args := []string{
+		"--quiet", "--raw", "--raw-rate", strconv.Itoa(media.OPUS_SAMPLE_RATE), "--raw-chan", "2", "--raw-bits", "16",
+		"--bitrate", strings.TrimSuffix(opusBitrate, "k"), "--framesize", "20", "--max-delay", "20",
+	}
+	if title != "" {
+		args = append(args, "--title", title)
+	}
+	return append(args, "-", out)
+}
+
+// runTool runs an encoder, stdin may be nil. The tool output is returned in the error.
+func runTool(ctx context.Context, path string, args []string, stdin io.Reader) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// EncodeWav encodes a WAV file to Ogg Opus at out, with any of the encoders. Unlike Ingest, the result is
+// not cached.
+func (p *Pipeline) EncodeWav(ctx context.Context, in, out, title string) error {
+	return p.encodePCM(ctx, out, title, func(w io.Writer) error {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return decodeWav(file, w)
+	})
+}
+
+// encodePCM runs decode, which writes 48 kHz stereo s16le, into the first available encoder
+func (p *Pipeline) encodePCM(ctx context.Context, out, title string, decode func(w io.Writer) error) error {
+	var path string
+	var args []string
+	switch {
+	case p.ffmpeg != "":
+		path, args = p.ffmpeg, ffmpegPCMArgs(out, title)
+	case p.opusenc != "":
+		path, args = p.opusenc, opusencPCMArgs(out, title)
+	default:
+		return ErrNoEncoder
+	}
+
+	pr, pw := io.Pipe()
+	decodeErr := make(chan error, 1)
+	go func() {
+		err := decode(pw)
+		pw.CloseWithError(err)
+		decodeErr <- err
+	}()
+
+	err := runTool(ctx, path, args, pr)
+	// unblock the decoder when the encoder died early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if dErr := <-decodeErr; dErr != nil && !errors.Is(dErr, io.ErrClosedPipe) {
+		return dErr
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// icyReader strips the ICY metadata interleaved every metaint bytes of audio and reports StreamTitle
+type icyReader struct {
+	r       *bufio.Reader
+	metaint int
+	left    int
+	onTitle func(title string)
+}
+
+func newICYReader(r io.Reader, metaint int, onTitle func(title string)) *icyReader {
+	return &icyReader{r: bufio.NewReader(r), metaint: metaint, left: metaint, onTitle: onTitle}
+}
+
+func (i *icyReader) Read(p []byte) (int, error) {
+	if i.left == 0 {
+		if err := i.readMetadata(); err != nil {
+			return 0, err
+		}
+		i.left = i.metaint
+	}
+
+	if len(p) > i.left {
+		p = p[:i.left]
+	}
+	n, err := i.r.Read(p)
+	i.left -= n
+	return n, err
+}
+
+// readMetadata reads one block: a length byte in 16 byte units, then StreamTitle='...';StreamUrl='...';
+func (i *icyReader) readMetadata() error {
+	size, err := i.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	block := make([]byte, int(size)*16)
+	if _, err := io.ReadFull(i.r, block); err != nil {
+		return err
+	}
+	if title, ok := parseStreamTitle(string(bytes.TrimRight(block, "\x00"))); ok && i.onTitle != nil {
+		i.onTitle(title)
+	}
+	return nil
+}
+
+// parseStreamTitle reads StreamTitle from a metadata block, the title itself may contain quotes
+func parseStreamTitle(meta string) (string, bool) {
+	const key = "StreamTitle='"
+	start := strings.Index(meta, key)
+	if start < 0 {
+		return "", false
+	}
+	meta = meta[start+len(key):]
+
+	end := strings.Index(meta, "';")
+	if end < 0 {
+		end = strings.LastIndex(meta, "'")
+	}
+	if end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(meta[:end]), true
+}
+
+// icyConn makes the "ICY 200 OK" status line of SHOUTcast v1 servers readable by net/http
+type icyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func dialICY(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: liveConnectTimeout, KeepAlive: 30 * time.Second}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &icyConn{Conn: conn}, nil
+}
+
+func (c *icyConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		head := make([]byte, 4)
+		n, err := io.ReadFull(c.Conn, head)
+		if err != nil {
+			return copy(p, head[:n]), err
+		}
+
+		if string(head) == "ICY " {
+			c.r = io.MultiReader(strings.NewReader("HTTP/1.0 "), c.Conn)
+		} else {
+			c.r = io.MultiReader(bytes.NewReader(head), c.Conn)
+		}
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,289 @@
+// Package ingest turns audio files of common formats into Ogg Opus that can be streamed as is:
+// 48 kHz, mono or stereo. Results are cached by content hash, live streams are converted on the fly (Live).
+// With ffmpeg, files are measured for EBU R128 loudness and re-encoded with a gain when played (OpenProcessed),
+// and streams are decoded to PCM and the mix encoded again for the mixer (DecodePCM, NewEncoder).
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	FormatOgg  = "ogg"
+	FormatWav  = "wav"
+	FormatMp3  = "mp3"
+	FormatFlac = "flac"
+	FormatM4a  = "m4a"
+
+	// MaxDownloadSize bounds chat uploads
+	MaxDownloadSize = 200 << 20
+	downloadTimeout = 2 * time.Minute
+)
+
+// Extensions lists the file extensions the pipeline accepts
+var Extensions = []string{".ogg", ".opus", ".wav", ".mp3", ".flac", ".m4a"}
+
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+type Pipeline struct {
+	cacheDir string
+	ffmpeg   string
+	opusenc  string
+	client   *http.Client
+	live     *http.Client
+
+	mu        sync.Mutex
+	inflight  map[string]*sync.Mutex      // map[hash]lock, one transcode per content at a time
+	measured  map[string]measuredLoudness // map[path], see KnownLoudness
+	measuring map[string]bool             // map[path] of the analyses queued or running
+	analyses  chan struct{}               // bounds the analyses running at once
+}
+
+// New looks up the encoders; missing tools only disable the formats that need them
+func New(cacheDir, ffmpegPath, opusencPath string) *Pipeline {
+	p := &Pipeline{
+		cacheDir:  cacheDir,
+		client:    &http.Client{Timeout: downloadTimeout},
+		live:      liveHTTPClient(),
+		inflight:  make(map[string]*sync.Mutex),
+		measured:  make(map[string]measuredLoudness),
+		measuring: make(map[string]bool),
+		analyses:  make(chan struct{}, maxAnalyses),
+	}
+	if path, err := exec.LookPath(ffmpegPath); err == nil {
+		p.ffmpeg = path
+	}
+	if path, err := exec.LookPath(opusencPath); err == nil {
+		p.opusenc = path
+	}
+	return p
+}
+
+// Tools describes the available encoders, for logs and check-config
+func (p *Pipeline) Tools() string {
+	var tools []string
+	if p.ffmpeg != "" {
+		tools = append(tools, "ffmpeg ("+p.ffmpeg+")")
+	}
+	if p.opusenc != "" {
+		tools = append(tools, "opusenc ("+p.opusenc+")")
+	}
+	if len(tools) == 0 {
+		return "none: only streamable ogg files are accepted"
+	}
+	return strings.Join(tools, ", ")
+}
+
+// Supported reports whether path has an extension the pipeline accepts
+func Supported(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectFormat sniffs the first bytes of a file
+func DetectFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return FormatOgg
+	case len(header) >= 12 && bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return FormatWav
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return FormatFlac
+	case len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp")):
+		return FormatM4a
+	case bytes.HasPrefix(header, []byte("ID3")),
+		len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return FormatMp3
+	}
+	return ""
+}
+
+// Ingest returns a streamable Ogg Opus file for path: path itself when it already is one,
+// otherwise a transcoded copy in the cache
+func (p *Pipeline) Ingest(ctx context.Context, path string) (string, error) {
+	return p.ingest(ctx, path, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+}
+
+// ingest is Ingest with the title given to tag-less inputs
+func (p *Pipeline) ingest(ctx context.Context, path, title string) (string, error) {
+	hash, format, err := identify(path)
+	if err != nil {
+		return "", err
+	}
+
+	if format == FormatOgg {
+		if info, err := media.ProbeOgg(path); err == nil && len(info.Problems()) == 0 {
+			p.measureLoudness(path)
+			return path, nil
+		}
+	}
+
+	out := filepath.Join(p.cacheDir, hash+".ogg")
+
+	lock := p.lock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(out); err == nil {
+		p.measureLoudness(out)
+		return out, nil
+	}
+	if err := os.MkdirAll(p.cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	tmp := out + ".tmp"
+	if err := p.transcode(ctx, path, format, title, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if info, err := media.ProbeOgg(tmp); err != nil || len(info.Problems()) > 0 {
+		os.Remove(tmp)
+		if err == nil {
+			err = errors.New(strings.Join(info.Problems(), ", "))
+		}
+		return "", fmt.Errorf("transcoded %s is not streamable: %w", path, err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+
+	log.Printf("ingest %s (%s) -> %s in %s \n", path, format, out, time.Since(start).Round(time.Millisecond))
+	p.measureLoudness(out)
+	return out, nil
+}
+
+func (p *Pipeline) transcode(ctx context.Context, path, format, title, out string) error {
+	// wav is decoded and resampled in Go, only the opus encoding needs a tool
+	if format == FormatWav {
+		return p.EncodeWav(ctx, path, out, title)
+	}
+
+	if p.ffmpeg == "" {
+		return fmt.Errorf("%s needs ffmpeg: %w", format, ErrNoEncoder)
+	}
+	return runTool(ctx, p.ffmpeg, ffmpegFileArgs(path, out), nil)
+}
+
+func (p *Pipeline) lock(hash string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lock, ok := p.inflight[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.inflight[hash] = lock
+	}
+	return lock
+}
+
+// identify hashes the content and sniffs its format
+func identify(path string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	n, _ := io.ReadFull(file, header)
+	format := DetectFormat(header[:n])
+	if format == "" {
+		return "", "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, filepath.Base(path))
+	}
+
+	hash, err := hashFile(path)
+	return hash, format, err
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// IngestURL downloads a file (e.g. a chat attachment) and ingests it. The download itself is not kept,
+// the transcoded result is cached under the content hash like any other input.
+func (p *Pipeline) IngestURL(ctx context.Context, url, name string) (string, error) {
+	if err := os.MkdirAll(p.cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s: status %d", name, res.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(p.cacheDir, "download-*"+filepath.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, io.LimitReader(res.Body, MaxDownloadSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > MaxDownloadSize {
+		return "", fmt.Errorf("%s is larger than %d MB", name, MaxDownloadSize>>20)
+	}
+
+	out, err := p.ingest(ctx, tmp.Name(), strings.TrimSuffix(name, filepath.Ext(name)))
+	if err != nil {
+		return "", err
+	}
+	if out != tmp.Name() {
+		return out, nil
+	}
+
+	// an upload that was already streamable: keep a copy, the temp file goes away
+	hash, _, err := identify(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	kept := filepath.Join(p.cacheDir, hash+".ogg")
+	if err := os.Rename(tmp.Name(), kept); err != nil {
+		return "", err
+	}
+	return kept, nil
+}
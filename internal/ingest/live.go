@@ -0,0 +1,484 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	// liveBuffer is buffered before playback starts and again after the buffer ran empty
+	liveBuffer = 2 * time.Second
+	// liveMaxBuffer bounds the read ahead, older packets are dropped, e.g. while paused
+	liveMaxBuffer = 10 * time.Second
+
+	liveConnectTimeout = 15 * time.Second
+	// liveStallTimeout drops a connection that stopped sending without closing
+	liveStallTimeout = 15 * time.Second
+
+	// a source that fails liveMaxRetries connections in a row is given up, the wait doubles each time
+	liveRetryMin   = time.Second
+	liveRetryMax   = 30 * time.Second
+	liveMaxRetries = 8
+)
+
+// StreamInfo describes an URL before it is played
+type StreamInfo struct {
+	// Live is set for radio streams: ICY headers, or a body without length
+	Live bool
+	// Name is the station name (icy-name) or the file name of the URL
+	Name        string
+	ContentType string
+}
+
+// ProbeURL connects to url to tell a live stream from a file, files are played through IngestURL
+func (p *Pipeline) ProbeURL(ctx context.Context, rawURL string) (StreamInfo, error) {
+	res, err := p.openStream(ctx, rawURL)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	res.Body.Close()
+
+	info := StreamInfo{
+		Name:        res.Header.Get("icy-name"),
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	info.Live = res.Header.Get("icy-metaint") != "" || info.Name != "" || res.Header.Get("icy-br") != "" ||
+		res.ContentLength < 0
+	if info.Name == "" {
+		if u, err := url.Parse(rawURL); err == nil {
+			info.Name = path.Base(u.Path)
+		}
+		if info.Name == "" || info.Name == "/" || info.Name == "." {
+			info.Name = rawURL
+		}
+	}
+	return info, nil
+}
+
+// openStream requests url with ICY metadata, the response body is the caller's
+func (p *Pipeline) openStream(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Icy-MetaData", "1")
+
+	res, err := p.live.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: status %d", rawURL, res.StatusCode)
+	}
+	return res, nil
+}
+
+// Live reads an internet radio stream as Opus packets. With ffmpeg every stream is converted on the fly
+// and normalized to LoudnessTarget, without it only Ogg Opus plays, split as is. Packets are buffered
+// ahead, a source that drops is reconnected with backoff and ICY titles are reported when the audio
+// they belong to is read.
+type Live struct {
+	p       *Pipeline
+	url     string
+	onTitle func(title string)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // run ended
+	notify chan struct{} // a packet was buffered or run ended
+
+	mu       sync.Mutex
+	buffer   []livePacket
+	buffered time.Duration
+	filling  bool  // waiting for liveBuffer before playing
+	err      error // why run ended
+	title    string
+	position time.Duration
+
+	gain       float64      // volume applied by the conversion, see SetGain
+	session    *liveSession // the connection being read
+	restarting bool         // session was closed for a new gain, not dropped
+}
+
+// livePacket carries the ICY title that changed just before it was received
+type livePacket struct {
+	media.OpusPacket
+	title string
+}
+
+var _ media.GainSource = (*Live)(nil)
+
+// OpenLive connects to url and starts buffering, the stream ends with ctx or Close. onTitle (optional)
+// is called on the reading goroutine.
+func (p *Pipeline) OpenLive(ctx context.Context, rawURL string, onTitle func(title string)) (*Live, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Live{
+		p:       p,
+		url:     rawURL,
+		onTitle: onTitle,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		notify:  make(chan struct{}, 1),
+		filling: true,
+		gain:    1,
+	}
+
+	// the first connection is made here, so a wrong URL fails the command instead of retrying
+	session, err := l.connect()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go l.run(session)
+	return l, nil
+}
+
+// ReadPacket returns the next buffered packet, it waits while the buffer fills
+func (l *Live) ReadPacket() (media.OpusPacket, error) {
+	for {
+		l.mu.Lock()
+		if l.filling && (l.buffered >= liveBuffer || l.err != nil) {
+			l.filling = false
+		}
+		if !l.filling && len(l.buffer) > 0 {
+			packet := l.buffer[0]
+			l.buffer = l.buffer[1:]
+			l.buffered -= packet.Duration
+			l.position += packet.Duration
+			l.mu.Unlock()
+
+			if packet.title != "" && l.onTitle != nil {
+				l.onTitle(packet.title)
+			}
+			return packet.OpusPacket, nil
+		}
+		if l.err != nil {
+			err := l.err
+			l.mu.Unlock()
+			return media.OpusPacket{}, err
+		}
+		if !l.filling {
+			log.Printf("live stream %s: buffer empty, buffering \n", l.url)
+			l.filling = true
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-l.ctx.Done():
+			return media.OpusPacket{}, l.ctx.Err()
+		case <-l.notify:
+		}
+	}
+}
+
+// Position is the time played since the stream was opened
+func (l *Live) Position() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.position
+}
+
+// SetGain changes the volume. The conversion restarts with it on a new connection, the buffered audio
+// plays at the old volume meanwhile. Without ffmpeg the stream plays as it comes.
+func (l *Live) SetGain(gain float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if gain == l.gain {
+		return
+	}
+	l.gain = gain
+	l.restartLocked()
+}
+
+// restartLocked closes a session converted with another gain than the current one
+func (l *Live) restartLocked() {
+	if l.session != nil && l.session.converted && l.session.gain != l.gain {
+		l.restarting = true
+		l.session.cancel()
+	}
+}
+
+// setSession tracks the session being read, nil once it ended. It reports (and clears) whether
+// the session was closed for a new gain.
+func (l *Live) setSession(session *liveSession) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.session = session
+	if session != nil {
+		// the gain may have changed while connecting
+		l.restartLocked()
+		return false
+	}
+	restarted := l.restarting
+	l.restarting = false
+	return restarted
+}
+
+// Close stops reading and waits for the connection to be released
+func (l *Live) Close() error {
+	l.cancel()
+	<-l.done
+	return nil
+}
+
+// run reads sessions until ctx is done, reconnecting the ones that drop
+func (l *Live) run(session *liveSession) {
+	defer close(l.done)
+
+	retry, failures := liveRetryMin, 0
+	for {
+		var err error
+		if session == nil {
+			session, err = l.connect()
+		}
+		if session != nil {
+			var received bool
+			l.setSession(session)
+			received, err = l.read(session)
+			session.close()
+			session = nil
+			if received {
+				retry, failures = liveRetryMin, 0
+			}
+		}
+		if l.ctx.Err() != nil {
+			l.finish(l.ctx.Err())
+			return
+		}
+		if l.setSession(nil) {
+			// closed for a new gain, not a failure
+			continue
+		}
+
+		failures++
+		if failures >= liveMaxRetries {
+			l.finish(fmt.Errorf("live stream %s: %w", l.url, err))
+			return
+		}
+		log.Printf("live stream %s dropped, reconnecting in %s: %v \n", l.url, retry, err)
+
+		select {
+		case <-l.ctx.Done():
+			l.finish(l.ctx.Err())
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, liveRetryMax)
+	}
+}
+
+// read buffers the packets of one connection until it ends, received reports whether any came
+func (l *Live) read(session *liveSession) (bool, error) {
+	received := false
+	for {
+		packet, err := session.reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			// a radio does not end, the server closed the connection
+			return received, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return received, err
+		}
+		l.push(packet, session.takeTitle())
+		received = true
+	}
+}
+
+func (l *Live) push(packet media.OpusPacket, title string) {
+	l.mu.Lock()
+	if title == l.title {
+		title = ""
+	} else if title != "" {
+		l.title = title
+	}
+
+	l.buffer = append(l.buffer, livePacket{OpusPacket: packet, title: title})
+	l.buffered += packet.Duration
+	for l.buffered > liveMaxBuffer && len(l.buffer) > 1 {
+		dropped := l.buffer[0]
+		l.buffer = l.buffer[1:]
+		l.buffered -= dropped.Duration
+		// a title change must not be lost with its packet
+		if dropped.title != "" && l.buffer[0].title == "" {
+			l.buffer[0].title = dropped.title
+		}
+	}
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *Live) finish(err error) {
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *Live) wake() {
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+// liveSession is one connection to the source, decoded to Opus packets
+type liveSession struct {
+	reader *media.OpusReader
+	close  func()
+	cancel context.CancelFunc
+	// converted sessions go through ffmpeg with gain
+	converted bool
+	gain      float64
+
+	mu    sync.Mutex
+	title string // changed ICY title not yet attached to a packet
+}
+
+func (s *liveSession) setTitle(title string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.title = title
+}
+
+func (s *liveSession) takeTitle() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title := s.title
+	s.title = ""
+	return title
+}
+
+// connect opens the source and waits for its Opus headers
+func (l *Live) connect() (*liveSession, error) {
+	ctx, cancel := context.WithCancel(l.ctx)
+	res, err := l.p.openStream(ctx, l.url)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	l.mu.Lock()
+	session := &liveSession{cancel: cancel, gain: l.gain}
+	l.mu.Unlock()
+
+	stall := time.AfterFunc(liveStallTimeout, cancel)
+	var body io.Reader = &stallReader{r: res.Body, timer: stall}
+	if metaint, err := strconv.Atoi(res.Header.Get("icy-metaint")); err == nil && metaint > 0 {
+		body = newICYReader(body, metaint, session.setTitle)
+	}
+
+	var encoder *exec.Cmd
+	release := func() {
+		cancel()
+		stall.Stop()
+		res.Body.Close()
+		if encoder != nil {
+			encoder.Wait()
+		}
+	}
+
+	buffered := bufio.NewReader(body)
+	peek, _ := buffered.Peek(64)
+	var audio io.Reader = buffered
+	if l.p.ffmpeg != "" {
+		encoder = exec.CommandContext(ctx, l.p.ffmpeg, ffmpegLiveArgs(session.gain)...)
+		encoder.Stdin = buffered
+		stdout, err := encoder.StdoutPipe()
+		if err != nil {
+			encoder = nil
+			release()
+			return nil, err
+		}
+		if err := encoder.Start(); err != nil {
+			encoder = nil
+			release()
+			return nil, err
+		}
+		audio = stdout
+		session.converted = true
+	} else if !isOggOpus(peek) {
+		release()
+		return nil, fmt.Errorf("%s stream needs ffmpeg: %w", streamFormat(res.Header.Get("Content-Type"), peek), ErrNoEncoder)
+	}
+
+	reader, err := media.NewOpusReader(audio)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	session.reader = reader
+	session.close = release
+	return session, nil
+}
+
+func isOggOpus(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("OggS")) && bytes.Contains(header, []byte("OpusHead"))
+}
+
+// streamFormat names a stream for errors, from its content type or first bytes
+func streamFormat(contentType string, header []byte) string {
+	if format := DetectFormat(header); format != "" {
+		return format
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return "unknown"
+}
+
+// ffmpegLiveArgs converts a stream read from stdin to Ogg Opus on stdout, normalized on the fly (loudnorm
+// follows the loudness as it goes) and with gain. Pages are flushed every packet, the default one second
+// pages would hold that much audio back.
+func ffmpegLiveArgs(gain float64) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-vn", "-af", fmt.Sprintf("loudnorm=I=%g:TP=-1,%s", LoudnessTarget, gainFilter(gain)),
+		"-ac", "2", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE),
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-frame_duration", "20", "-page_duration", "20000",
+		"-f", "ogg", "pipe:1",
+	}
+}
+
+// stallReader postpones timer on every read, it fires when the source stops sending
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	s.timer.Reset(liveStallTimeout)
+	return s.r.Read(p)
+}
+
+// liveHTTPClient has no overall timeout, a stream lasts as long as it is played
+func liveHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialICY,
+			ResponseHeaderTimeout: liveConnectTimeout,
+			TLSHandshakeTimeout:   liveConnectTimeout,
+		},
+	}
+}
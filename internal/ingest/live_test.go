@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mezon-go-bot/internal/ingest/mockradio"
+	"mezon-go-bot/internal/media"
+)
+
+// testStream is served by the mock radios, about 4 s of Ogg Opus
+const testStream = "../../audio/hello.ogg"
+
+// newTestLive opens a mock radio serving testStream without ffmpeg, so packets come as they are served
+func newTestLive(t *testing.T, opts mockradio.Options, onTitle func(title string)) (*Live, *mockradio.Server) {
+	t.Helper()
+	radio, err := mockradio.New("", testStream, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(radio.Close)
+
+	live, err := New(t.TempDir(), "", "").OpenLive(context.Background(), radio.URL(), onTitle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { live.Close() })
+	return live, radio
+}
+
+func TestLiveBuffersBeforePlaying(t *testing.T) {
+	live, _ := newTestLive(t, mockradio.Options{}, nil)
+
+	// the radio sends in real time, so the first packet waits for liveBuffer of audio
+	start := time.Now()
+	packet, err := live.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < liveBuffer-500*time.Millisecond {
+		t.Errorf("first packet after %s, want about %s", waited, liveBuffer)
+	}
+
+	// the buffer then plays without waiting
+	played := packet.Duration
+	start = time.Now()
+	for played < liveBuffer-200*time.Millisecond {
+		packet, err := live.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		played += packet.Duration
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("buffered audio took %s to read", waited)
+	}
+
+	// once it ran empty, playback waits for liveBuffer again
+	for {
+		start = time.Now()
+		if _, err := live.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited > 200*time.Millisecond {
+			if waited < liveBuffer-500*time.Millisecond {
+				t.Errorf("buffering again took %s, want about %s", waited, liveBuffer)
+			}
+			break
+		}
+	}
+	if pos := live.Position(); pos < liveBuffer {
+		t.Errorf("position %s after the buffer ran empty", pos)
+	}
+}
+
+func TestLiveReconnectsDroppedSource(t *testing.T) {
+	live, radio := newTestLive(t, mockradio.Options{DropAfter: 1500 * time.Millisecond}, nil)
+
+	// past the first connection, the stream plays on after each drop and liveRetryMin
+	deadline := time.Now().Add(20 * time.Second)
+	for live.Position() < 4*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatalf("played %s before the deadline", live.Position())
+		}
+		packet, err := live.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Samples != 960 || len(packet.Data) == 0 {
+			t.Fatalf("packet of %d samples, %d bytes", packet.Samples, len(packet.Data))
+		}
+	}
+	if n := radio.Listeners(); n < 2 {
+		t.Errorf("%d connections, want a reconnect", n)
+	}
+
+	start := time.Now()
+	live.Close()
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Close took %s", waited)
+	}
+}
+
+func TestLiveReportsICYTitles(t *testing.T) {
+	source, err := media.ProbeOgg(testStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	var positions []time.Duration
+	var live *Live
+	live, _ = newTestLive(t, mockradio.Options{Name: "test", MetaInt: 4096}, func(title string) {
+		titles = append(titles, title)
+		positions = append(positions, live.Position())
+	})
+
+	// the radio titles each loop of the file, the title of the second loop comes when it plays
+	deadline := time.Now().Add(15 * time.Second)
+	for len(titles) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("titles %q before the deadline", titles)
+		}
+		if _, err := live.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if titles[0] != "test #1" || titles[1] != "test #2" {
+		t.Errorf("titles %q", titles)
+	}
+	if positions[0] > time.Second {
+		t.Errorf("first title at %s", positions[0])
+	}
+	// metadata comes every MetaInt bytes and is read ahead of the packets around it
+	if diff := (positions[1] - source.Duration).Abs(); diff > time.Second {
+		t.Errorf("second title at %s, the loop starts at %s", positions[1], source.Duration)
+	}
+}
+
+func TestParseStreamTitle(t *testing.T) {
+	tests := []struct {
+		meta  string
+		title string
+		ok    bool
+	}{
+		{meta: "StreamTitle='Artist - Song';StreamUrl='';", title: "Artist - Song", ok: true},
+		{meta: "StreamTitle='Rock 'n' Roll';", title: "Rock 'n' Roll", ok: true},
+		{meta: "StreamTitle='no end", ok: false},
+		{meta: "StreamUrl='http://radio';", ok: false},
+	}
+
+	for _, tt := range tests {
+		title, ok := parseStreamTitle(tt.meta)
+		if title != tt.title || ok != tt.ok {
+			t.Errorf("parseStreamTitle(%q) = %q, %v", tt.meta, title, ok)
+		}
+	}
+}
+
+func TestLiveNeedsEncoderForOtherFormats(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "radio.mp3")
+	if err := os.WriteFile(file, append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), make([]byte, 4096)...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	radio, err := mockradio.New("", file, mockradio.Options{ByteRate: 16000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer radio.Close()
+
+	_, err = New(t.TempDir(), "", "").OpenLive(context.Background(), radio.URL(), nil)
+	if !errors.Is(err, ErrNoEncoder) {
+		t.Errorf("got %v, want ErrNoEncoder", err)
+	}
+}
@@ -0,0 +1,314 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	// LoudnessTarget is the EBU R128 programme loudness (LUFS) files are normalized to
+	LoudnessTarget = -23.0
+	// maxNormalizeGain (dB) bounds the boost of very quiet files, their noise floor would come up with it
+	maxNormalizeGain = 20.0
+	// limiterCeiling keeps boosted audio 1 dB under full scale, the true peak limit of EBU R128
+	limiterCeiling = "0.891"
+	// maxAnalyses is how many files are measured in the background at once
+	maxAnalyses = 2
+)
+
+// Loudness is the EBU R128 measurement of a file
+type Loudness struct {
+	// Integrated is the programme loudness in LUFS
+	Integrated float64 `json:"integrated"`
+}
+
+// Gain is the linear factor that brings the file to LoudnessTarget
+func (l Loudness) Gain() float64 {
+	return DecibelsToGain(min(LoudnessTarget-l.Integrated, maxNormalizeGain))
+}
+
+// DecibelsToGain converts a level change in dB to a linear factor
+func DecibelsToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// CanProcess reports whether gains can be applied, which needs ffmpeg to decode and re-encode
+func (p *Pipeline) CanProcess() bool {
+	return p.ffmpeg != ""
+}
+
+// measuredLoudness is the measurement of a path, valid while the file keeps its size and time
+type measuredLoudness struct {
+	Loudness
+	size    int64
+	modTime time.Time
+}
+
+// Loudness measures an Ogg Opus file. An R128_TRACK_GAIN tag is trusted as is, other files are measured
+// by ffmpeg once and the result is cached by content hash.
+func (p *Pipeline) Loudness(ctx context.Context, path string) (Loudness, error) {
+	loudness, err := p.measure(ctx, path)
+	if err != nil {
+		return Loudness{}, err
+	}
+	if stat, err := os.Stat(path); err == nil {
+		p.mu.Lock()
+		p.measured[path] = measuredLoudness{Loudness: loudness, size: stat.Size(), modTime: stat.ModTime()}
+		p.mu.Unlock()
+	}
+	return loudness, nil
+}
+
+// KnownLoudness returns the measurement of path without waiting for one, for the enqueue path. A file
+// not measured yet is queued for analysis (see measureLoudness) and reported unknown meanwhile.
+func (p *Pipeline) KnownLoudness(path string) (Loudness, bool) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Loudness{}, false
+	}
+
+	p.mu.Lock()
+	known, ok := p.measured[path]
+	p.mu.Unlock()
+	if ok && known.size == stat.Size() && known.modTime.Equal(stat.ModTime()) {
+		return known.Loudness, true
+	}
+
+	p.measureLoudness(path)
+	return Loudness{}, false
+}
+
+// measure is Loudness without keeping the result for KnownLoudness
+func (p *Pipeline) measure(ctx context.Context, path string) (Loudness, error) {
+	if tags, err := media.ReadOpusTags(path); err == nil {
+		// Q7.8 dB that bring the track to -23 LUFS, on top of the output gain of the header
+		if gain, err := strconv.Atoi(tags["R128_TRACK_GAIN"]); err == nil {
+			return Loudness{Integrated: -23 - float64(gain)/256}, nil
+		}
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return Loudness{}, err
+	}
+	cached := filepath.Join(p.cacheDir, hash+".loudness.json")
+
+	lock := p.lock(hash + ".loudness")
+	lock.Lock()
+	defer lock.Unlock()
+
+	var loudness Loudness
+	if data, err := os.ReadFile(cached); err == nil && json.Unmarshal(data, &loudness) == nil {
+		return loudness, nil
+	}
+
+	if p.ffmpeg == "" {
+		return Loudness{}, fmt.Errorf("measuring loudness needs ffmpeg: %w", ErrNoEncoder)
+	}
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, p.ffmpeg, ffmpegLoudnessArgs(path)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Loudness{}, fmt.Errorf("%s: %w: %s", p.ffmpeg, err, lastLine(stderr.String()))
+	}
+	if loudness, err = parseLoudnorm(stderr.String()); err != nil {
+		return Loudness{}, fmt.Errorf("loudness of %s: %w", path, err)
+	}
+
+	if err := os.MkdirAll(p.cacheDir, 0o755); err != nil {
+		return Loudness{}, err
+	}
+	data, _ := json.Marshal(loudness)
+	if err := os.WriteFile(cached, data, 0o644); err != nil {
+		return Loudness{}, err
+	}
+
+	log.Printf("loudness %s: %.1f LUFS in %s \n", path, loudness.Integrated, time.Since(start).Round(time.Millisecond))
+	return loudness, nil
+}
+
+// measureLoudness measures a freshly ingested file in the background, at most maxAnalyses at a time, so
+// neither the ingest nor playing it waits for the analysis
+func (p *Pipeline) measureLoudness(path string) {
+	if p.ffmpeg == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.measuring[path] {
+		return
+	}
+	p.measuring[path] = true
+
+	go func() {
+		p.analyses <- struct{}{}
+		if _, err := p.Loudness(context.Background(), path); err != nil {
+			log.Printf("loudness %s: %v \n", path, err)
+		}
+		<-p.analyses
+
+		p.mu.Lock()
+		delete(p.measuring, path)
+		p.mu.Unlock()
+	}()
+}
+
+// ffmpegLoudnessArgs runs the loudnorm analysis, it prints its measurement as JSON at info level
+func ffmpegLoudnessArgs(in string) []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-nostats", "-loglevel", "info",
+		"-i", in,
+		"-vn", "-af", fmt.Sprintf("loudnorm=I=%g:TP=-1:print_format=json", LoudnessTarget),
+		"-f", "null", "-",
+	}
+}
+
+// parseLoudnorm reads the JSON block loudnorm prints last, values are strings there
+func parseLoudnorm(output string) (Loudness, error) {
+	start, end := strings.LastIndex(output, "{"), strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return Loudness{}, errors.New("no loudnorm measurement in the ffmpeg output")
+	}
+
+	var measured struct {
+		InputI string `json:"input_i"`
+	}
+	if err := json.Unmarshal([]byte(output[start:end+1]), &measured); err != nil {
+		return Loudness{}, err
+	}
+	integrated, err := strconv.ParseFloat(measured.InputI, 64)
+	if err != nil || math.IsInf(integrated, 0) {
+		// silence measures -inf, it is left as is
+		return Loudness{Integrated: LoudnessTarget}, nil
+	}
+	return Loudness{Integrated: integrated}, nil
+}
+
+// gainFilter applies a linear gain and limits what a boost pushes over the ceiling
+func gainFilter(gain float64) string {
+	return fmt.Sprintf("volume=%.4f,alimiter=limit=%s:level=false", gain, limiterCeiling)
+}
+
+// OpenProcessed decodes an Ogg Opus file from offset, applies gain and re-encodes it on the fly.
+// Positions of the returned source count from the start of the file.
+func (p *Pipeline) OpenProcessed(path string, offset time.Duration, gain float64) (media.Source, error) {
+	if p.ffmpeg == "" {
+		return nil, fmt.Errorf("changing the gain needs ffmpeg: %w", ErrNoEncoder)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, p.ffmpeg, ffmpegGainArgs(path, offset, gain, "pipe:1")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	reader, err := media.NewOpusReader(stdout)
+	if err != nil {
+		cancel()
+		cmd.Wait()
+		return nil, fmt.Errorf("%s: %w: %s", p.ffmpeg, err, lastLine(stderr.String()))
+	}
+	return &processed{OpusReader: reader, offset: offset, cmd: cmd, cancel: cancel}, nil
+}
+
+// ffmpegGainArgs re-encodes an Ogg Opus file from offset with gainFilter, flushing a page per packet
+func ffmpegGainArgs(in string, offset time.Duration, gain float64, out string) []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64), "-i", in,
+		"-vn", "-af", gainFilter(gain),
+		"-ac", "2", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE),
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-frame_duration", "20", "-page_duration", "20000",
+		"-f", "ogg", out,
+	}
+}
+
+// processed is a file re-encoded by ffmpeg from offset
+type processed struct {
+	*media.OpusReader
+	offset time.Duration
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+}
+
+func (s *processed) Position() time.Duration {
+	return s.offset + s.OpusReader.Position()
+}
+
+func (s *processed) Close() error {
+	s.cancel()
+	s.cmd.Wait()
+	return nil
+}
+
+// Normalized returns a copy of an Ogg Opus file at LoudnessTarget, e.g. for prompts played outside the
+// player. The file itself is returned when it is close enough already or ffmpeg is missing.
+func (p *Pipeline) Normalized(ctx context.Context, path string) (string, error) {
+	if p.ffmpeg == "" {
+		return path, nil
+	}
+	loudness, err := p.Loudness(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if math.Abs(LoudnessTarget-loudness.Integrated) < 1 {
+		return path, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(p.cacheDir, hash+".r128.ogg")
+
+	lock := p.lock(hash + ".r128")
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+	if err := os.MkdirAll(p.cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	tmp := out + ".tmp"
+	if err := runTool(ctx, p.ffmpeg, ffmpegGainArgs(path, 0, loudness.Gain(), tmp), nil); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
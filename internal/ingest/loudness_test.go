@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg is a stand-in for the loudnorm analysis: it takes half a second and measures -30 LUFS
+const fakeFFmpeg = `#!/bin/sh
+sleep 0.5
+echo '{ "input_i" : "-30.00" }' >&2
+`
+
+func TestIngestMeasuresLoudnessInBackground(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the ffmpeg stand-in is a shell script")
+	}
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p := New(t.TempDir(), ffmpeg, "")
+
+	start := time.Now()
+	path, err := p.Ingest(context.Background(), testStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 300*time.Millisecond {
+		t.Errorf("ingest waited %s for the analysis", waited)
+	}
+	if _, ok := p.KnownLoudness(path); ok {
+		t.Fatal("loudness known before the analysis finished")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loudness, ok := p.KnownLoudness(path)
+		if ok {
+			if loudness.Integrated != -30 {
+				t.Errorf("measured %.1f LUFS, want -30", loudness.Integrated)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("loudness not measured before the deadline")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the measurement is cached by content, another pipeline reads it without ffmpeg
+	loudness, err := New(p.cacheDir, "", "").Loudness(context.Background(), path)
+	if err != nil || loudness.Integrated != -30 {
+		t.Errorf("cached loudness %.1f LUFS, %v", loudness.Integrated, err)
+	}
+}
@@ -0,0 +1,191 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+)
+
+// DecodePCM decodes an Opus source to 48 kHz stereo s16le for the mixer. The source is read as fast as
+// ffmpeg takes it and is closed with the returned reader.
+func (p *Pipeline) DecodePCM(src media.Source) (io.ReadCloser, error) {
+	if p.ffmpeg == "" {
+		src.Close()
+		return nil, fmt.Errorf("mixing needs ffmpeg: %w", ErrNoEncoder)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, p.ffmpeg, ffmpegDecodeArgs()...)
+	d := &decoded{src: src, cmd: cmd, cancel: cancel, fed: make(chan struct{})}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		src.Close()
+		return nil, err
+	}
+	if d.stdout, err = cmd.StdoutPipe(); err != nil {
+		cancel()
+		src.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		src.Close()
+		return nil, err
+	}
+
+	go d.feed(stdin)
+	return d, nil
+}
+
+// ffmpegDecodeArgs decodes Ogg Opus read from stdin to raw PCM on stdout
+func ffmpegDecodeArgs() []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-f", "ogg", "-i", "pipe:0",
+		"-vn", "-ac", "2", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE),
+		"-f", "s16le", "pipe:1",
+	}
+}
+
+// decoded is the PCM of a source decoded by ffmpeg
+type decoded struct {
+	src    media.Source
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdout io.ReadCloser
+
+	fed     chan struct{}
+	feedErr error
+	once    sync.Once
+}
+
+// feed writes the packets of the source to ffmpeg until it ends
+func (d *decoded) feed(stdin io.WriteCloser) {
+	defer close(d.fed)
+	defer stdin.Close()
+
+	w, err := media.NewOggWriter(stdin)
+	if err != nil {
+		d.feedErr = err
+		return
+	}
+	for {
+		packet, err := d.src.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			d.feedErr = err
+			return
+		}
+		if err := w.WritePacket(packet); err != nil {
+			// ffmpeg exited, Read reports why
+			return
+		}
+	}
+}
+
+// Read returns the decoded PCM, once ffmpeg is done the error of the source if it failed
+func (d *decoded) Read(p []byte) (int, error) {
+	n, err := d.stdout.Read(p)
+	if errors.Is(err, io.EOF) {
+		<-d.fed
+		if d.feedErr != nil {
+			return n, d.feedErr
+		}
+	}
+	return n, err
+}
+
+func (d *decoded) Close() error {
+	d.once.Do(func() {
+		d.cancel()
+		// a live source may be waiting for data, closing it ends the feed
+		d.src.Close()
+		<-d.fed
+		d.cmd.Wait()
+	})
+	return nil
+}
+
+// NewEncoder starts ffmpeg to encode the mix: 48 kHz stereo s16le in, Ogg Opus flushed every packet out
+func (p *Pipeline) NewEncoder() (mixer.Encoder, error) {
+	if p.ffmpeg == "" {
+		return nil, fmt.Errorf("mixing needs ffmpeg: %w", ErrNoEncoder)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, p.ffmpeg, ffmpegEncodeArgs()...)
+	e := &encoder{cmd: cmd, cancel: cancel}
+
+	var err error
+	if e.stdin, err = cmd.StdinPipe(); err != nil {
+		cancel()
+		return nil, err
+	}
+	if e.stdout, err = cmd.StdoutPipe(); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return e, nil
+}
+
+// ffmpegEncodeArgs encodes raw PCM read from stdin to Ogg Opus on stdout, a page per packet
+func ffmpegEncodeArgs() []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-f", "s16le", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE), "-ac", "2", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-frame_duration", "20", "-page_duration", "20000",
+		"-f", "ogg", "pipe:1",
+	}
+}
+
+// encoder is a running ffmpeg encoding the mix
+type encoder struct {
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	once   sync.Once
+
+	// reader is opened on the first ReadPacket, ffmpeg writes the headers once it has audio
+	reader *media.OpusReader
+}
+
+func (e *encoder) Write(pcm []byte) (int, error) {
+	return e.stdin.Write(pcm)
+}
+
+func (e *encoder) ReadPacket() (media.OpusPacket, error) {
+	if e.reader == nil {
+		reader, err := media.NewOpusReader(e.stdout)
+		if err != nil {
+			return media.OpusPacket{}, fmt.Errorf("%s: %w", e.cmd.Path, err)
+		}
+		e.reader = reader
+	}
+	return e.reader.ReadPacket()
+}
+
+func (e *encoder) Close() error {
+	e.once.Do(func() {
+		e.stdin.Close()
+		e.cancel()
+		e.cmd.Wait()
+	})
+	return nil
+}
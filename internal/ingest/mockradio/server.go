@@ -0,0 +1,213 @@
+// Package mockradio is an offline stand-in for an internet radio: it serves an audio file in a loop at
+// its real time rate, Icecast style, with ICY titles, and can drop listeners to exercise reconnects.
+package mockradio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+// sendInterval is how often a chunk of the file is written, a real server sends about as often
+const sendInterval = 100 * time.Millisecond
+
+type Options struct {
+	// Name is sent as icy-name, the file name by default
+	Name string
+	// MetaInt interleaves ICY metadata every MetaInt bytes for clients that ask, 0 disables it
+	MetaInt int
+	// DropAfter closes every connection after this long, 0 keeps them open
+	DropAfter time.Duration
+	// ByteRate is the send rate, taken from the duration of an Ogg file when 0
+	ByteRate int
+}
+
+type Server struct {
+	file        string
+	contentType string
+	opts        Options
+	server      *httptest.Server
+
+	mu        sync.Mutex
+	listeners int
+}
+
+// New serves file on addr ("" picks a free local port) at /stream
+func New(addr, file string, opts Options) (*Server, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{file: file, opts: opts, contentType: "audio/mpeg"}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".ogg", ".opus":
+		s.contentType = "audio/ogg"
+	}
+	if s.opts.Name == "" {
+		s.opts.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	if s.opts.ByteRate == 0 {
+		info, err := media.ProbeOgg(file)
+		if err != nil || info.Duration <= 0 {
+			return nil, errors.New("the byte rate of a file that is not ogg opus must be given")
+		}
+		s.opts.ByteRate = int(float64(stat.Size()) / info.Duration.Seconds())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", s.handleStream)
+
+	s.server = httptest.NewUnstartedServer(mux)
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.server.Listener.Close()
+		s.server.Listener = l
+	}
+	s.server.Start()
+
+	return s, nil
+}
+
+// URL is the stream to play
+func (s *Server) URL() string {
+	return s.server.URL + "/stream"
+}
+
+// Listeners counts the connections served so far, reconnects included
+func (s *Server) Listeners() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners
+}
+
+func (s *Server) Close() {
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.listeners++
+	s.mu.Unlock()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", s.contentType)
+	w.Header().Set("icy-name", s.opts.Name)
+	w.Header().Set("icy-br", strconv.Itoa(s.opts.ByteRate*8/1000))
+
+	var out io.Writer = w
+	var meta *icyWriter
+	if s.opts.MetaInt > 0 && r.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(s.opts.MetaInt))
+		meta = &icyWriter{w: w, metaint: s.opts.MetaInt, left: s.opts.MetaInt}
+		out = meta
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var drop <-chan time.Time
+	if s.opts.DropAfter > 0 {
+		drop = time.After(s.opts.DropAfter)
+	}
+
+	chunk := make([]byte, int(float64(s.opts.ByteRate)*sendInterval.Seconds()))
+	ticker := time.NewTicker(sendInterval)
+	defer ticker.Stop()
+	for loop := 1; ; loop++ {
+		if meta != nil {
+			meta.title = fmt.Sprintf("%s #%d", s.opts.Name, loop)
+		}
+
+		file, err := os.Open(s.file)
+		if err != nil {
+			return
+		}
+		for {
+			n, err := io.ReadFull(file, chunk)
+			if n > 0 {
+				if _, err := out.Write(chunk[:n]); err != nil {
+					file.Close()
+					return
+				}
+				flusher.Flush()
+			}
+			if err != nil {
+				break
+			}
+
+			select {
+			case <-r.Context().Done():
+				file.Close()
+				return
+			case <-drop:
+				file.Close()
+				return
+			case <-ticker.C:
+			}
+		}
+		file.Close()
+	}
+}
+
+// icyWriter interleaves a metadata block every metaint bytes, empty unless the title changed
+type icyWriter struct {
+	w       io.Writer
+	metaint int
+	left    int
+	title   string
+	sent    string
+}
+
+func (i *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(i.left, len(p))
+		if _, err := i.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		i.left -= n
+
+		if i.left == 0 {
+			if _, err := i.w.Write(i.block()); err != nil {
+				return written, err
+			}
+			i.left = i.metaint
+		}
+	}
+	return written, nil
+}
+
+func (i *icyWriter) block() []byte {
+	if i.title == i.sent {
+		return []byte{0}
+	}
+	i.sent = i.title
+
+	meta := fmt.Sprintf("StreamTitle='%s';", i.title)
+	size := (len(meta) + 15) / 16
+	block := make([]byte, 1+size*16)
+	block[0] = byte(size)
+	copy(block[1:], meta)
+	return block
+}
@@ -0,0 +1,161 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+// videoBitrate and videoKeyframeInterval apply when a movie has to be re-encoded. A keyframe every
+// two seconds bounds how long a receiver that asked for one (PLI/FIR) waits.
+const (
+	videoBitrate          = "1500k"
+	videoKeyframeInterval = 2 * time.Second
+	videoFrameRate        = 30
+)
+
+// VideoExtensions lists the movie file extensions IngestVideo accepts
+var VideoExtensions = []string{".ivf", ".webm", ".mkv", ".mp4"}
+
+// SupportedVideo reports whether path has a movie extension
+func SupportedVideo(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range VideoExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// IngestVideo returns an IVF (VP8/VP9) file for path and its Ogg Opus sound track, "" when it has none.
+// An IVF plays as is with the .ogg of the same name, other containers are split with ffmpeg into the cache.
+func (p *Pipeline) IngestVideo(ctx context.Context, path string) (string, string, error) {
+	if strings.EqualFold(filepath.Ext(path), ".ivf") {
+		for _, ext := range []string{".ogg", ".opus"} {
+			sound := strings.TrimSuffix(path, filepath.Ext(path)) + ext
+			if _, err := os.Stat(sound); err == nil {
+				audio, err := p.Ingest(ctx, sound)
+				return path, audio, err
+			}
+		}
+		return path, "", nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	video := filepath.Join(p.cacheDir, hash+".ivf")
+	audio := filepath.Join(p.cacheDir, hash+".ogg")
+
+	lock := p.lock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the video is written last, so it marks a complete split; a movie without sound has no .ogg
+	if _, err := os.Stat(video); err == nil {
+		if _, err := os.Stat(audio); err != nil {
+			audio = ""
+		}
+		return video, audio, nil
+	}
+
+	if p.ffmpeg == "" {
+		return "", "", fmt.Errorf("%s needs ffmpeg: %w", filepath.Ext(path), ErrNoEncoder)
+	}
+	if err := os.MkdirAll(p.cacheDir, 0o755); err != nil {
+		return "", "", err
+	}
+
+	start := time.Now()
+	if err := p.splitAudio(ctx, path, audio); err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(audio); err != nil {
+		audio = ""
+	}
+	if err := p.splitVideo(ctx, path, video); err != nil {
+		return "", "", err
+	}
+
+	log.Printf("ingest movie %s -> %s, %q in %s \n", path, video, audio, time.Since(start).Round(time.Millisecond))
+	return video, audio, nil
+}
+
+// splitAudio extracts the first sound track, a movie without one leaves no file behind
+func (p *Pipeline) splitAudio(ctx context.Context, path, out string) error {
+	tmp := out + ".tmp"
+	err := runTool(ctx, p.ffmpeg, ffmpegSoundArgs(path, tmp), nil)
+	if err != nil {
+		os.Remove(tmp)
+		if strings.Contains(err.Error(), "matches no streams") {
+			return nil
+		}
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// splitVideo copies VP8/VP9 out of WebM and re-encodes anything else to VP8
+func (p *Pipeline) splitVideo(ctx context.Context, path, out string) error {
+	tmp := out + ".tmp"
+	defer os.Remove(tmp)
+
+	copied := false
+	if strings.EqualFold(filepath.Ext(path), ".webm") {
+		if err := runTool(ctx, p.ffmpeg, ffmpegVideoArgs(path, tmp, true), nil); err == nil {
+			// WebM may also carry AV1, which the station does not take
+			if r, err := media.OpenIVF(tmp); err == nil {
+				r.Close()
+				copied = true
+			}
+		}
+	}
+	if !copied {
+		if err := runTool(ctx, p.ffmpeg, ffmpegVideoArgs(path, tmp, false), nil); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, out)
+}
+
+// ffmpegSoundArgs extracts the first sound track as 48 kHz stereo Opus
+func ffmpegSoundArgs(in, out string) []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", in,
+		"-map", "0:a:0", "-map_metadata", "0",
+		"-ac", "2", "-ar", strconv.Itoa(media.OPUS_SAMPLE_RATE),
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-f", "ogg", out,
+	}
+}
+
+// ffmpegVideoArgs writes the first video track to IVF. Alt-ref frames are disabled because they are
+// not shown and would share the timestamp of the next frame.
+func ffmpegVideoArgs(in, out string, copyStream bool) []string {
+	args := []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", in,
+		"-map", "0:v:0",
+	}
+	if copyStream {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args,
+			"-r", strconv.Itoa(videoFrameRate),
+			"-c:v", "libvpx", "-b:v", videoBitrate,
+			"-g", strconv.Itoa(int(videoKeyframeInterval.Seconds())*videoFrameRate),
+			"-deadline", "realtime", "-cpu-used", "8", "-auto-alt-ref", "0",
+		)
+	}
+	return append(args, "-f", "ivf", out)
+}
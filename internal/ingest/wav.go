@@ -0,0 +1,210 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+
+	// pcmChannels is what the Opus encoder is fed: 48 kHz interleaved stereo int16
+	pcmChannels = 2
+)
+
+var ErrInvalidWav = errors.New("invalid wav file")
+
+type wavFormat struct {
+	format     uint16
+	channels   int
+	sampleRate int
+	bits       int
+}
+
+// decodeWav converts a RIFF/WAVE file (8/16/24/32-bit PCM or 32/64-bit float, any rate and channel count)
+// into 48 kHz stereo s16le PCM written to w
+func decodeWav(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	var riff [12]byte
+	if _, err := io.ReadFull(br, riff[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWav, err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return fmt.Errorf("%w: missing RIFF/WAVE header", ErrInvalidWav)
+	}
+
+	var format *wavFormat
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return fmt.Errorf("%w: no data chunk", ErrInvalidWav)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			f, err := readWavFormat(br, size)
+			if err != nil {
+				return err
+			}
+			format = f
+
+		case "data":
+			if format == nil {
+				return fmt.Errorf("%w: data before fmt chunk", ErrInvalidWav)
+			}
+			// streamed wav files may carry a 0 or 0xFFFFFFFF size, read to EOF then
+			data := io.Reader(br)
+			if size > 0 && size < math.MaxUint32 {
+				data = io.LimitReader(br, size)
+			}
+			return convertPCM(data, format, w)
+
+		default:
+			// chunks are word aligned
+			if _, err := br.Discard(int(size + size%2)); err != nil {
+				return fmt.Errorf("%w: chunk %q: %v", ErrInvalidWav, id, err)
+			}
+		}
+	}
+}
+
+func readWavFormat(r *bufio.Reader, size int64) (*wavFormat, error) {
+	if size < 16 {
+		return nil, fmt.Errorf("%w: fmt chunk of %d bytes", ErrInvalidWav, size)
+	}
+	buf := make([]byte, size+size%2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: fmt chunk: %v", ErrInvalidWav, err)
+	}
+
+	f := &wavFormat{
+		format:     binary.LittleEndian.Uint16(buf[0:2]),
+		channels:   int(binary.LittleEndian.Uint16(buf[2:4])),
+		sampleRate: int(binary.LittleEndian.Uint32(buf[4:8])),
+		bits:       int(binary.LittleEndian.Uint16(buf[14:16])),
+	}
+	if f.format == wavFormatExtensible && size >= 26 {
+		// the sub format GUID starts with the actual format code
+		f.format = binary.LittleEndian.Uint16(buf[24:26])
+	}
+
+	switch {
+	case f.channels < 1:
+		return nil, fmt.Errorf("%w: %d channels", ErrInvalidWav, f.channels)
+	case f.sampleRate < 1:
+		return nil, fmt.Errorf("%w: sample rate %d", ErrInvalidWav, f.sampleRate)
+	case f.format == wavFormatPCM && (f.bits == 8 || f.bits == 16 || f.bits == 24 || f.bits == 32):
+	case f.format == wavFormatFloat && (f.bits == 32 || f.bits == 64):
+	default:
+		return nil, fmt.Errorf("%w: unsupported format %d with %d bits", ErrInvalidWav, f.format, f.bits)
+	}
+	return f, nil
+}
+
+// convertPCM decodes frames, keeps the first two channels (mono is duplicated) and resamples to 48 kHz
+func convertPCM(r io.Reader, f *wavFormat, w io.Writer) error {
+	bytesPerSample := f.bits / 8
+	frameSize := bytesPerSample * f.channels
+
+	bw := bufio.NewWriter(w)
+	rs := newResampler(f.sampleRate, media.OPUS_SAMPLE_RATE, bw)
+
+	frame := make([]byte, frameSize)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+
+		left := decodeSample(frame[0:bytesPerSample], f)
+		right := left
+		if f.channels > 1 {
+			right = decodeSample(frame[bytesPerSample:2*bytesPerSample], f)
+		}
+		if err := rs.push(left, right); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// decodeSample returns one sample in [-1, 1]
+func decodeSample(b []byte, f *wavFormat) float64 {
+	switch {
+	case f.format == wavFormatFloat && f.bits == 32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case f.format == wavFormatFloat:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case f.bits == 8:
+		// 8-bit wav is unsigned
+		return (float64(b[0]) - 128) / 128
+	case f.bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case f.bits == 24:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float64(v) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+// resampler converts a stereo stream between rates by linear interpolation and writes s16le frames.
+// It is meant for speech and jingles, music quality sources should go through ffmpeg.
+type resampler struct {
+	step float64 // input frames per output frame
+	t    float64 // position of the next output frame after prev, in input frames
+	prev [pcmChannels]float64
+	init bool
+	w    io.Writer
+	out  [pcmChannels * 2]byte
+}
+
+func newResampler(inRate, outRate int, w io.Writer) *resampler {
+	return &resampler{step: float64(inRate) / float64(outRate), w: w}
+}
+
+func (r *resampler) push(left, right float64) error {
+	cur := [pcmChannels]float64{left, right}
+	if !r.init {
+		r.prev, r.init = cur, true
+		return nil
+	}
+
+	for ; r.t < 1; r.t += r.step {
+		for ch := range cur {
+			v := r.prev[ch] + (cur[ch]-r.prev[ch])*r.t
+			binary.LittleEndian.PutUint16(r.out[ch*2:], uint16(toInt16(v)))
+		}
+		if _, err := r.w.Write(r.out[:]); err != nil {
+			return err
+		}
+	}
+	r.t--
+	r.prev = cur
+	return nil
+}
+
+func toInt16(v float64) int16 {
+	v = math.Round(v * (1 << 15))
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
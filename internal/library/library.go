@@ -0,0 +1,324 @@
+// Package library indexes the episodes of a media directory by their Ogg Opus tags.
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+// RescanInterval is how old the index may get before a lookup rescans the directory, in the background:
+// a rescan may transcode new files, lookups meanwhile answer from the index as it is
+const RescanInterval = time.Minute
+
+var ErrNotFound = errors.New("episode not found")
+
+type Episode struct {
+	Path string `json:"path"`
+	// Stream is the Ogg Opus file to play: Path itself, or its transcoded copy
+	Stream   string        `json:"stream"`
+	Title    string        `json:"title"`
+	Number   int           `json:"number"` // 0 when the episode has no number
+	Date     string        `json:"date"`
+	Duration time.Duration `json:"duration"`
+
+	// Size and ModTime tell whether the cached entry is still valid
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Name is the file name without extension
+func (e Episode) Name() string {
+	base := filepath.Base(e.Path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Preparer returns a streamable Ogg Opus file for a media file, see ingest.Pipeline
+type Preparer func(path string) (string, error)
+
+type Library struct {
+	dir       string
+	indexPath string
+	prepare   Preparer
+	supported func(path string) bool
+
+	mu        sync.RWMutex
+	episodes  []Episode // sorted by Number, then Date, then Path
+	scannedAt time.Time
+
+	scanMu     sync.Mutex  // one scan at a time
+	rescanning atomic.Bool // a background rescan is queued or running
+}
+
+// Open loads the cached index of dir from indexPath and rescans the directory before returning. With
+// a preparer the files supported reports are indexed too, otherwise only .ogg files.
+func Open(dir, indexPath string, prepare Preparer, supported func(path string) bool) (*Library, error) {
+	l := &Library{dir: dir, indexPath: indexPath, prepare: prepare, supported: supported}
+	if prepare == nil || supported == nil {
+		l.prepare = func(path string) (string, error) { return path, nil }
+		l.supported = func(path string) bool { return strings.EqualFold(filepath.Ext(path), ".ogg") }
+	}
+
+	data, err := os.ReadFile(indexPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &l.episodes); err != nil {
+			log.Printf("library index %s unreadable, rebuilding: %v \n", indexPath, err)
+			l.episodes = nil
+		}
+	}
+
+	if err := l.Refresh(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Refresh rescans the directory, only new or modified files are probed again
+func (l *Library) Refresh() error {
+	l.scanMu.Lock()
+	defer l.scanMu.Unlock()
+
+	l.mu.RLock()
+	cached := make(map[string]Episode, len(l.episodes))
+	for _, e := range l.episodes {
+		cached[e.Path] = e
+	}
+	l.mu.RUnlock()
+
+	var episodes []Episode
+	err := filepath.WalkDir(l.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !l.supported(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if e, ok := cached[path]; ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) && exists(e.Stream) {
+			episodes = append(episodes, e)
+			return nil
+		}
+
+		stream, err := l.prepare(path)
+		if err != nil {
+			log.Printf("library skip %s: %v \n", path, err)
+			return nil
+		}
+
+		e, err := index(path, stream, info)
+		if err != nil {
+			// one broken file must not hide the rest of the library
+			log.Printf("library skip %s: %v \n", path, err)
+			return nil
+		}
+		episodes = append(episodes, e)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(episodes, func(i, j int) bool {
+		a, b := episodes[i], episodes[j]
+		if a.Number != b.Number {
+			return a.Number < b.Number
+		}
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return a.Path < b.Path
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.episodes = episodes
+	l.scannedAt = time.Now()
+	return l.save()
+}
+
+// numberPattern finds a standalone number or one after "ep", so "ncc8" alone is not episode 8
+var numberPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9]|ep|episode)(\d+)`)
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// index reads one file: TITLE, EPISODE (or TRACKNUMBER) and DATE tags, with file name fallbacks.
+// The tags come from the stream, transcoding carries them over from the source.
+func index(path, stream string, info fs.FileInfo) (Episode, error) {
+	probe, err := media.ProbeOgg(stream)
+	if err != nil {
+		return Episode{}, err
+	}
+
+	tags, err := media.ReadOpusTags(stream)
+	if err != nil && !errors.Is(err, media.ErrNoOpusTags) {
+		return Episode{}, err
+	}
+
+	e := Episode{
+		Path:     path,
+		Stream:   stream,
+		Title:    tags["TITLE"],
+		Date:     tags["DATE"],
+		Duration: probe.Duration,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if e.Title == "" {
+		e.Title = e.Name()
+	}
+	if e.Date == "" {
+		e.Date = info.ModTime().Format("2006-01-02")
+	}
+
+	number := tags["EPISODE"]
+	if number == "" {
+		number = tags["TRACKNUMBER"]
+	}
+	if number == "" {
+		// e.g. ncc8-42.ogg
+		matches := numberPattern.FindAllStringSubmatch(e.Name(), -1)
+		if len(matches) > 0 {
+			number = matches[len(matches)-1][1]
+		}
+	}
+	// TRACKNUMBER may be "42/120"
+	number, _, _ = strings.Cut(number, "/")
+	e.Number, _ = strconv.Atoi(strings.TrimSpace(number))
+
+	return e, nil
+}
+
+// save writes the index to a temp file and renames it, must be called with mu held
+func (l *Library) save() error {
+	data, err := json.MarshalIndent(l.episodes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(l.indexPath); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	tmp := l.indexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.indexPath)
+}
+
+// snapshot returns the indexed episodes, a stale index is rescanned in the background
+func (l *Library) snapshot() []Episode {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if time.Since(l.scannedAt) > RescanInterval && l.rescanning.CompareAndSwap(false, true) {
+		go func() {
+			defer l.rescanning.Store(false)
+			if err := l.Refresh(); err != nil {
+				log.Printf("library rescan %s: %v \n", l.dir, err)
+			}
+		}()
+	}
+	return l.episodes
+}
+
+// Episode returns the episode with the given number
+func (l *Library) Episode(number int) (Episode, error) {
+	for _, e := range l.snapshot() {
+		if e.Number == number {
+			return e, nil
+		}
+	}
+	return Episode{}, fmt.Errorf("%w: #%d", ErrNotFound, number)
+}
+
+// Latest returns the most recent episode by date, then number
+func (l *Library) Latest() (Episode, error) {
+	episodes := l.snapshot()
+	if len(episodes) == 0 {
+		return Episode{}, ErrNotFound
+	}
+
+	latest := episodes[0]
+	for _, e := range episodes[1:] {
+		if e.Date > latest.Date || (e.Date == latest.Date && e.Number > latest.Number) {
+			latest = e
+		}
+	}
+	return latest, nil
+}
+
+// Lookup finds an episode by file name (without extension) or exact title
+func (l *Library) Lookup(name string) (Episode, error) {
+	for _, e := range l.snapshot() {
+		if strings.EqualFold(e.Name(), name) || strings.EqualFold(e.Title, name) {
+			return e, nil
+		}
+	}
+	return Episode{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// Search returns the episodes whose title or file name contains every word of query
+func (l *Library) Search(query string) []Episode {
+	words := strings.Fields(strings.ToLower(query))
+
+	var found []Episode
+	for _, e := range l.snapshot() {
+		haystack := strings.ToLower(e.Title + " " + e.Name())
+		match := true
+		for _, w := range words {
+			if !strings.Contains(haystack, w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// Page returns the 1-based page of episodes and the number of pages
+func (l *Library) Page(page, size int) ([]Episode, int) {
+	episodes := l.snapshot()
+	pages := (len(episodes) + size - 1) / size
+	if page < 1 || page > pages {
+		return nil, pages
+	}
+
+	end := page * size
+	if end > len(episodes) {
+		end = len(episodes)
+	}
+	return episodes[(page-1)*size : end], pages
+}
@@ -0,0 +1,192 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+const (
+	CodecVP8 = "VP8"
+	CodecVP9 = "VP9"
+)
+
+var ErrUnsupportedVideo = errors.New("unsupported video codec")
+
+// VideoFrame is one compressed frame, Timestamp is its offset from the start of the file
+type VideoFrame struct {
+	Data      []byte
+	Keyframe  bool
+	Timestamp time.Duration
+	Duration  time.Duration
+}
+
+// IVFReader reads VP8 or VP9 frames from an IVF file. It reads one frame ahead, the duration of
+// a frame is the distance to the next timestamp.
+type IVFReader struct {
+	Codec  string
+	Width  int
+	Height int
+
+	file   *os.File
+	reader *ivfreader.IVFReader
+	rate   uint64 // timestamp units per scale seconds
+	scale  uint64
+	next   *VideoFrame
+	last   time.Duration // duration of the last frame read, reused for the final one
+}
+
+// OpenIVF opens an IVF file and reads its first frame
+func OpenIVF(path string) (*IVFReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("not an ivf file: %w", err)
+	}
+
+	r := &IVFReader{
+		file:   file,
+		reader: reader,
+		Width:  int(header.Width),
+		Height: int(header.Height),
+	}
+	switch header.FourCC {
+	case "VP80":
+		r.Codec = CodecVP8
+	case "VP90":
+		r.Codec = CodecVP9
+	default:
+		file.Close()
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedVideo, header.FourCC)
+	}
+
+	// the header stores the time base as a rate (denominator) and a scale (numerator)
+	if header.TimebaseDenominator == 0 || header.TimebaseNumerator == 0 {
+		file.Close()
+		return nil, fmt.Errorf("not an ivf file: time base %d/%d", header.TimebaseNumerator, header.TimebaseDenominator)
+	}
+	r.rate, r.scale = uint64(header.TimebaseDenominator), uint64(header.TimebaseNumerator)
+
+	if r.next, err = r.read(); err != nil && !errors.Is(err, io.EOF) {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadFrame returns the next frame, io.EOF at the end of the file
+func (r *IVFReader) ReadFrame() (VideoFrame, error) {
+	if r.next == nil {
+		return VideoFrame{}, io.EOF
+	}
+
+	frame := *r.next
+	// a truncated file ends with the frames that were complete
+	r.next, _ = r.read()
+
+	frame.Duration = r.last
+	if r.next != nil && r.next.Timestamp > frame.Timestamp {
+		frame.Duration = r.next.Timestamp - frame.Timestamp
+		r.last = frame.Duration
+	}
+	if frame.Duration == 0 {
+		frame.Duration = r.timestamp(1)
+	}
+	return frame, nil
+}
+
+// SkipToKeyframe discards frames up to the first keyframe at or after offset, so the next
+// ReadFrame returns a frame a decoder can start from
+func (r *IVFReader) SkipToKeyframe(offset time.Duration) {
+	for r.next != nil && (!r.next.Keyframe || r.next.Timestamp < offset) {
+		r.ReadFrame()
+	}
+}
+
+// Next returns the timestamp of the next frame, false at the end of the file
+func (r *IVFReader) Next() (time.Duration, bool) {
+	if r.next == nil {
+		return 0, false
+	}
+	return r.next.Timestamp, true
+}
+
+func (r *IVFReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *IVFReader) read() (*VideoFrame, error) {
+	data, header, err := r.reader.ParseNextFrame()
+	if err != nil {
+		return nil, err
+	}
+	return &VideoFrame{
+		Data:      data,
+		Keyframe:  IsKeyframe(r.Codec, data),
+		Timestamp: r.timestamp(header.Timestamp),
+	}, nil
+}
+
+func (r *IVFReader) timestamp(units uint64) time.Duration {
+	return time.Duration(units * r.scale * uint64(time.Second) / r.rate)
+}
+
+// IsKeyframe reads the frame type from the start of a VP8 (RFC 6386 section 9.1) or VP9 frame
+func IsKeyframe(codec string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+
+	switch codec {
+	case CodecVP8:
+		return frame[0]&0x01 == 0
+
+	case CodecVP9:
+		// frame_marker(2) profile_low(1) profile_high(1) [reserved_zero(1) when profile 3]
+		// show_existing_frame(1) frame_type(1), read from the most significant bit
+		b := frame[0]
+		if b>>6 != 0b10 {
+			return false
+		}
+		show := 3
+		if (b>>5)&1 == 1 && (b>>4)&1 == 1 {
+			show--
+		}
+		if (b>>show)&1 == 1 {
+			// show_existing_frame repeats a decoded frame
+			return false
+		}
+		return (b>>(show-1))&1 == 0
+	}
+	return false
+}
+
+// ProbeIVF reads an IVF file end to end and returns its duration
+func ProbeIVF(path string) (time.Duration, error) {
+	r, err := OpenIVF(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	var end time.Duration
+	for {
+		frame, err := r.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		end = frame.Timestamp + frame.Duration
+	}
+}
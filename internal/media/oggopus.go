@@ -0,0 +1,395 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	oggPageHeaderSize = 27
+
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+
+	// oggNoGranule marks a page on which no packet ends
+	oggNoGranule = ^uint64(0)
+
+	// maxOpusPacketSamples is the longest packet RFC 6716 allows, 120 ms
+	maxOpusPacketSamples = 5760
+)
+
+var (
+	ErrNotOggOpus          = errors.New("not an ogg opus stream")
+	ErrOggChecksum         = errors.New("ogg page checksum mismatch")
+	ErrInvalidOpusPacket   = errors.New("invalid opus packet")
+	opusHeadSignature      = []byte("OpusHead")
+	opusTagsSignature      = []byte("OpusTags")
+	oggCaptureSignature    = []byte("OggS")
+	oggChecksumTable       = newOggChecksumTable()
+	errOggPageSkipped      = errors.New("page of another logical stream")
+	opusFrameSamplesSilk   = [4]int{480, 960, 1920, 2880}
+	opusFrameSamplesHybrid = [2]int{480, 960}
+	opusFrameSamplesCelt   = [4]int{120, 240, 480, 960}
+)
+
+type OpusHead struct {
+	Channels   uint8
+	PreSkip    uint16
+	SampleRate uint32 // of the original input, informational only
+}
+
+// OpusPacket is one Opus packet with its duration taken from the TOC byte
+type OpusPacket struct {
+	Data     []byte
+	Samples  int // at 48 kHz
+	Duration time.Duration
+}
+
+// OpusReader splits an Ogg Opus stream into packets using the page lacing tables. The OpusHead and
+// OpusTags headers are consumed, so ReadPacket only returns audio; pages of other logical streams
+// are skipped and chained streams continue with their own headers.
+type OpusReader struct {
+	r    *bufio.Reader
+	Head OpusHead
+	tags []byte
+
+	serial    uint32
+	following bool     // false until the first OpusHead names the serial to follow
+	headers   int      // header packets of the current chain still to skip
+	packets   [][]byte // complete packets of the last page, not returned yet
+	partial   []byte   // a packet continued on the next page
+	aligned   bool     // whether granule was aligned on the first audio page of the chain
+
+	// granule positions restart with each chained stream, played sums up the links before
+	played      uint64 // audio of the previous links, pre-skip excluded, in 48 kHz samples
+	start       uint64 // granule of the current link before its first audio packet
+	granule     uint64 // end of the last returned packet of the current link
+	pageGranule uint64 // granule of the last audio page of the current link, 0 before one is read
+}
+
+// NewOpusReader reads the OpusHead and OpusTags headers
+func NewOpusReader(r io.Reader) (*OpusReader, error) {
+	o := &OpusReader{r: bufio.NewReader(r)}
+
+	page, err := o.readPage()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotOggOpus, err)
+	}
+	if page.flags&oggFlagBOS == 0 || !bytes.HasPrefix(page.body, opusHeadSignature) {
+		return nil, fmt.Errorf("%w: first page is not an OpusHead", ErrNotOggOpus)
+	}
+	o.startChain(page.serial, page.body)
+	o.collect(page)
+
+	// the first packet is the id header, the second OpusTags which may span several pages
+	for o.headers > 0 {
+		packet, err := o.nextPacket()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotOggOpus, err)
+		}
+		o.header(packet)
+	}
+
+	return o, nil
+}
+
+// OpenOpusFile opens an Ogg Opus file, the caller closes the file
+func OpenOpusFile(path string) (*os.File, *OpusReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := NewOpusReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, reader, nil
+}
+
+// Tags returns the raw OpusTags packet, cut at maxTagsSize
+func (o *OpusReader) Tags() []byte {
+	return o.tags
+}
+
+// ReadPacket returns the next audio packet, io.EOF at the end of the stream
+func (o *OpusReader) ReadPacket() (OpusPacket, error) {
+	for {
+		data, err := o.nextPacket()
+		if err != nil {
+			return OpusPacket{}, err
+		}
+		if o.headers > 0 {
+			o.header(data)
+			continue
+		}
+		if len(data) == 0 {
+			// RFC 7845: a zero-length packet stands for a lost one, there is nothing to send
+			continue
+		}
+
+		samples, err := OpusPacketSamples(data)
+		if err != nil {
+			return OpusPacket{}, err
+		}
+		o.granule += uint64(samples)
+		return OpusPacket{Data: data, Samples: samples, Duration: GranuleToDuration(uint64(samples))}, nil
+	}
+}
+
+// Position is the audio time read so far from the start of the stream, the pre-skip of every link
+// excluded
+func (o *OpusReader) Position() time.Duration {
+	return GranuleToDuration(o.played + o.linkSamples(o.granule))
+}
+
+// linkSamples is the audio of the current link up to granule end, pre-skip excluded
+func (o *OpusReader) linkSamples(end uint64) uint64 {
+	skip := o.start + uint64(o.Head.PreSkip)
+	if end <= skip {
+		return 0
+	}
+	return end - skip
+}
+
+// linkEnd is the end of the current link as read so far: the last page granule, which unlike the packet
+// sum accounts for samples trimmed at the end
+func (o *OpusReader) linkEnd() uint64 {
+	if o.pageGranule == 0 {
+		return o.granule
+	}
+	return o.pageGranule
+}
+
+// SkipTo discards packets up to offset, a seek without an index. Past the end the next read is io.EOF.
+func (o *OpusReader) SkipTo(offset time.Duration) error {
+	for o.Position() < offset {
+		if _, err := o.ReadPacket(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OpusPacketSamples reads the duration of a packet from its TOC byte (RFC 6716 section 3.1)
+func OpusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, fmt.Errorf("%w: empty", ErrInvalidOpusPacket)
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+	var frame int
+	switch {
+	case config < 12:
+		frame = opusFrameSamplesSilk[config&3]
+	case config < 16:
+		frame = opusFrameSamplesHybrid[config&1]
+	default:
+		frame = opusFrameSamplesCelt[config&3]
+	}
+
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, fmt.Errorf("%w: missing frame count", ErrInvalidOpusPacket)
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	samples := frame * frames
+	if samples == 0 || samples > maxOpusPacketSamples {
+		return 0, fmt.Errorf("%w: %d frames of %d samples", ErrInvalidOpusPacket, frames, frame)
+	}
+	return samples, nil
+}
+
+// startChain follows the logical stream of an OpusHead, the first one or the next link of a chain
+func (o *OpusReader) startChain(serial uint32, head []byte) {
+	if o.following {
+		o.played += o.linkSamples(o.linkEnd())
+	}
+	o.serial = serial
+	o.following = true
+	o.headers = 2
+	o.partial = nil
+	o.packets = nil
+	o.aligned = false
+	o.start, o.granule, o.pageGranule = 0, 0, 0
+
+	if len(head) >= 19 {
+		o.Head = OpusHead{
+			Channels:   head[9],
+			PreSkip:    binary.LittleEndian.Uint16(head[10:12]),
+			SampleRate: binary.LittleEndian.Uint32(head[12:16]),
+		}
+	}
+}
+
+// header consumes a header packet of the current chain
+func (o *OpusReader) header(packet []byte) {
+	o.headers--
+	if o.tags == nil && bytes.HasPrefix(packet, opusTagsSignature) {
+		o.tags = packet
+	}
+}
+
+// nextPacket returns the next complete packet of the followed logical stream, header or audio
+func (o *OpusReader) nextPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		page, err := o.readPage()
+		if errors.Is(err, errOggPageSkipped) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		o.collect(page)
+	}
+
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+// collect splits a page body along its lacing values: a packet ends on the first value below 255
+func (o *OpusReader) collect(page *oggPage) {
+	if page.flags&oggFlagContinued == 0 {
+		// the rest of a packet was lost, e.g. on a damaged file
+		o.partial = nil
+	}
+
+	offset := 0
+	for _, lacing := range page.lacing {
+		size := int(lacing)
+		if offset+size > len(page.body) {
+			break
+		}
+		if len(o.partial) < maxTagsSize {
+			o.partial = append(o.partial, page.body[offset:offset+size]...)
+		}
+		offset += size
+
+		if lacing < 255 {
+			o.packets = append(o.packets, o.partial)
+			o.partial = nil
+		}
+	}
+
+	if page.granule == oggNoGranule || o.headers >= len(o.packets) {
+		return
+	}
+	o.pageGranule = page.granule
+
+	// a stream may start at a granule after 0, e.g. one cut from a live broadcast
+	if !o.aligned {
+		o.aligned = true
+		pageSamples := 0
+		for _, packet := range o.packets[o.headers:] {
+			samples, _ := OpusPacketSamples(packet)
+			pageSamples += samples
+		}
+		if page.granule > uint64(pageSamples) {
+			o.start = page.granule - uint64(pageSamples)
+			o.granule = o.start
+		}
+	}
+}
+
+type oggPage struct {
+	flags   byte
+	granule uint64
+	serial  uint32
+	lacing  []byte
+	body    []byte
+}
+
+// readPage reads and checks one page, pages of other logical streams return errOggPageSkipped
+func (o *OpusReader) readPage() (*oggPage, error) {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// a truncated last page, e.g. a recording still being written
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[0:4], oggCaptureSignature) {
+		return nil, fmt.Errorf("%w: bad capture pattern", ErrNotOggOpus)
+	}
+
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, lacing); err != nil {
+		return nil, io.EOF
+	}
+	size := 0
+	for _, l := range lacing {
+		size += int(l)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(o.r, body); err != nil {
+		return nil, io.EOF
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[22:26])
+	header[22], header[23], header[24], header[25] = 0, 0, 0, 0
+	if oggChecksum(header, lacing, body) != checksum {
+		return nil, ErrOggChecksum
+	}
+
+	page := &oggPage{
+		flags:   header[5],
+		granule: binary.LittleEndian.Uint64(header[6:14]),
+		serial:  binary.LittleEndian.Uint32(header[14:18]),
+		lacing:  lacing,
+		body:    body,
+	}
+
+	if o.headers == 0 && page.flags&oggFlagBOS != 0 && bytes.HasPrefix(body, opusHeadSignature) {
+		// a chained stream: its headers are skipped like the first ones
+		o.startChain(page.serial, body)
+	}
+	if o.following && page.serial != o.serial {
+		return nil, errOggPageSkipped
+	}
+	return page, nil
+}
+
+func oggChecksum(parts ...[]byte) uint32 {
+	var crc uint32
+	for _, part := range parts {
+		for _, b := range part {
+			crc = crc<<8 ^ oggChecksumTable[byte(crc>>24)^b]
+		}
+	}
+	return crc
+}
+
+// newOggChecksumTable builds the table of the Ogg CRC-32: polynomial 0x04c11db7, not reflected
+func newOggChecksumTable() *[256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return &table
+}
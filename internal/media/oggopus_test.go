@@ -0,0 +1,341 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// celt20ms is the TOC byte of a 20 ms fullband CELT frame, code 0: 960 samples
+const celt20ms = 0xF8
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		samples int
+		invalid bool
+	}{
+		{name: "silk 10 ms", packet: []byte{0 << 3}, samples: 480},
+		{name: "silk 60 ms", packet: []byte{3 << 3}, samples: 2880},
+		{name: "hybrid 20 ms", packet: []byte{13 << 3}, samples: 960},
+		{name: "celt 2.5 ms", packet: []byte{16 << 3}, samples: 120},
+		{name: "celt 20 ms", packet: []byte{celt20ms}, samples: 960},
+		{name: "code 1 two equal frames", packet: []byte{celt20ms | 1}, samples: 1920},
+		{name: "code 2 two frames", packet: []byte{celt20ms | 2}, samples: 1920},
+		{name: "code 3 three frames", packet: []byte{celt20ms | 3, 3}, samples: 2880},
+		{name: "code 3 count keeps the low 6 bits", packet: []byte{celt20ms | 3, 0xC0 | 6}, samples: 5760},
+		{name: "code 3 at 120 ms", packet: []byte{3<<3 | 3, 2}, samples: 5760},
+		{name: "code 3 over 120 ms", packet: []byte{3<<3 | 3, 3}, invalid: true},
+		{name: "code 3 without frames", packet: []byte{celt20ms | 3, 0}, invalid: true},
+		{name: "code 3 without count", packet: []byte{celt20ms | 3}, invalid: true},
+		{name: "empty", packet: nil, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := OpusPacketSamples(tt.packet)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidOpusPacket) {
+					t.Fatalf("got %d samples, err %v, want ErrInvalidOpusPacket", samples, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if samples != tt.samples {
+				t.Errorf("got %d samples, want %d", samples, tt.samples)
+			}
+		})
+	}
+}
+
+func TestOpusReaderPacketSpanningPages(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "ends on the next page", size: 600},
+		// a multiple of 255 ends with a 0 lacing value, here alone on the next page
+		{name: "ends with an empty segment", size: 510},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			long := audioPacket(tt.size)
+			short := audioPacket(10)
+
+			var s oggStream
+			s.headers(1, 0)
+			first := long[:510]
+			s.page(0, oggNoGranule, 1, first, 255, 255)
+			rest := append(append([]byte(nil), long[510:]...), short...)
+			s.page(oggFlagContinued, 1920, 1, rest, byte(len(long)-510), byte(len(short)))
+
+			r := s.reader(t)
+			for i, want := range [][]byte{long, short} {
+				packet, err := r.ReadPacket()
+				if err != nil {
+					t.Fatalf("packet %d: %v", i+1, err)
+				}
+				if !bytes.Equal(packet.Data, want) {
+					t.Fatalf("packet %d has %d bytes, want %d", i+1, len(packet.Data), len(want))
+				}
+				if packet.Samples != 960 || packet.Duration != 20*time.Millisecond {
+					t.Errorf("packet %d: %d samples, %s", i+1, packet.Samples, packet.Duration)
+				}
+			}
+			if _, err := r.ReadPacket(); !errors.Is(err, io.EOF) {
+				t.Errorf("after the last packet got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestOpusReaderChecksum(t *testing.T) {
+	var s oggStream
+	s.headers(1, 0)
+	s.audio(1, 0, 3)
+	data := s.Bytes()
+
+	t.Run("audio page", func(t *testing.T) {
+		damaged := bytes.Clone(data)
+		damaged[len(damaged)-1] ^= 0xFF
+
+		r, err := NewOpusReader(bytes.NewReader(damaged))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadPacket(); !errors.Is(err, ErrOggChecksum) {
+			t.Errorf("got %v, want ErrOggChecksum", err)
+		}
+	})
+
+	t.Run("head page", func(t *testing.T) {
+		damaged := bytes.Clone(data)
+		damaged[oggPageHeaderSize+1+len("OpusHead")+1] ^= 0xFF // the channel count
+
+		if _, err := NewOpusReader(bytes.NewReader(damaged)); !errors.Is(err, ErrNotOggOpus) {
+			t.Errorf("got %v, want ErrNotOggOpus", err)
+		}
+	})
+}
+
+func TestOpusReaderStartGranule(t *testing.T) {
+	// cut from a live broadcast: 10 packets of 20 ms starting 10 s in, the last page trims 480 samples
+	const preSkip = 312
+	start := uint64(10 * OPUS_SAMPLE_RATE)
+
+	var s oggStream
+	s.headers(1, preSkip)
+	s.audio(1, start, 5)
+	s.audioTrimmed(1, start+5*960, 5, 480)
+	want := GranuleToDuration(10*960 - preSkip)
+	trimmed := GranuleToDuration(10*960 - preSkip - 480)
+
+	r := s.reader(t)
+	if err := r.SkipTo(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if pos := r.Position(); pos < 100*time.Millisecond || pos >= 120*time.Millisecond {
+		t.Errorf("SkipTo(100ms) stopped at %s", pos)
+	}
+
+	r = s.reader(t)
+	readAll(t, r, 10)
+	if pos := r.Position(); pos != want {
+		t.Errorf("position at the end %s, want %s", pos, want)
+	}
+
+	info := s.probe(t)
+	if info.Packets != 10 || info.PreSkip != preSkip {
+		t.Errorf("probed %d packets, pre-skip %d", info.Packets, info.PreSkip)
+	}
+	if info.Duration != trimmed {
+		t.Errorf("probed duration %s, want %s", info.Duration, trimmed)
+	}
+}
+
+func TestOpusReaderChainedStreams(t *testing.T) {
+	// two links of 10 packets of 20 ms, each with its own serial, pre-skip and granule positions
+	const preSkip1, preSkip2 = 312, 3840
+
+	var s oggStream
+	s.headers(1, preSkip1)
+	s.audio(1, 0, 10)
+	s.headers(2, preSkip2)
+	s.audio(2, 0, 10)
+	first := GranuleToDuration(10*960 - preSkip1)
+	want := first + GranuleToDuration(10*960-preSkip2)
+
+	r := s.reader(t)
+	if r.Head.PreSkip != preSkip1 {
+		t.Errorf("pre-skip %d, want %d", r.Head.PreSkip, preSkip1)
+	}
+	readAll(t, r, 10)
+	if pos := r.Position(); pos != first {
+		t.Errorf("position at the end of the first link %s, want %s", pos, first)
+	}
+	readAll(t, r, 10)
+	if r.Head.PreSkip != preSkip2 {
+		t.Errorf("pre-skip of the second link %d, want %d", r.Head.PreSkip, preSkip2)
+	}
+	if pos := r.Position(); pos != want {
+		t.Errorf("position at the end %s, want %s", pos, want)
+	}
+
+	// the second link starts 80 ms into its packets, its pre-skip
+	r = s.reader(t)
+	if err := r.SkipTo(first + 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if pos := r.Position(); pos < first+20*time.Millisecond || pos >= first+40*time.Millisecond {
+		t.Errorf("SkipTo(%s) stopped at %s", first+20*time.Millisecond, pos)
+	}
+
+	info := s.probe(t)
+	if info.Packets != 20 {
+		t.Errorf("probed %d packets, want 20", info.Packets)
+	}
+	if info.Duration != want {
+		t.Errorf("probed duration %s, want %s", info.Duration, want)
+	}
+	if tags, err := parseOpusTags(r.Tags()); err != nil || tags["TITLE"] != "link 1" {
+		t.Errorf("tags %v (%v), want those of the first link", tags, err)
+	}
+}
+
+func TestOpusReaderSkipsOtherStreams(t *testing.T) {
+	var s oggStream
+	s.headers(1, 0)
+	s.audio(1, 0, 2)
+	s.page(0, 1920, 7, audioPacket(50), 50) // e.g. a multiplexed stream
+	s.audio(1, 1920, 2)
+
+	r := s.reader(t)
+	readAll(t, r, 4)
+	if _, err := r.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v after the last packet, want io.EOF", err)
+	}
+}
+
+func TestProbeEncodedFile(t *testing.T) {
+	// written by an encoder, so the checksum matches another implementation
+	info, err := ProbeOgg("../../audio/hello.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := info.Problems(); len(problems) > 0 {
+		t.Errorf("problems: %v", problems)
+	}
+	if info.Packets == 0 || info.Duration < time.Second {
+		t.Errorf("%d packets, %s", info.Packets, info.Duration)
+	}
+}
+
+// oggStream builds Ogg Opus test streams page by page
+type oggStream struct {
+	bytes.Buffer
+	sequence map[uint32]uint32
+}
+
+// page appends a page whose body is split along lacing, its checksum set
+func (s *oggStream) page(flags byte, granule uint64, serial uint32, body []byte, lacing ...byte) {
+	if s.sequence == nil {
+		s.sequence = make(map[uint32]uint32)
+	}
+	header := make([]byte, oggPageHeaderSize)
+	copy(header, oggCaptureSignature)
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:14], granule)
+	binary.LittleEndian.PutUint32(header[14:18], serial)
+	binary.LittleEndian.PutUint32(header[18:22], s.sequence[serial])
+	header[26] = byte(len(lacing))
+	s.sequence[serial]++
+
+	binary.LittleEndian.PutUint32(header[22:26], oggChecksum(header, lacing, body))
+	s.Write(header)
+	s.Write(lacing)
+	s.Write(body)
+}
+
+// headers starts a link: OpusHead on a BOS page, then OpusTags titled after the serial
+func (s *oggStream) headers(serial uint32, preSkip uint16) {
+	head := make([]byte, 19)
+	copy(head, opusHeadSignature)
+	head[8], head[9] = 1, 2
+	binary.LittleEndian.PutUint16(head[10:12], preSkip)
+	binary.LittleEndian.PutUint32(head[12:16], OPUS_SAMPLE_RATE)
+	s.page(oggFlagBOS, 0, serial, head, byte(len(head)))
+
+	comment := []byte("TITLE=link " + string(rune('0'+serial)))
+	tags := append([]byte(nil), opusTagsSignature...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	tags = binary.LittleEndian.AppendUint32(tags, 1)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(comment)))
+	tags = append(tags, comment...)
+	s.page(0, 0, serial, tags, byte(len(tags)))
+}
+
+// audio appends a page of n packets of 20 ms following granule
+func (s *oggStream) audio(serial uint32, granule uint64, n int) {
+	s.audioTrimmed(serial, granule, n, 0)
+}
+
+// audioTrimmed appends n packets of 20 ms whose last trim samples are cut by the page granule
+func (s *oggStream) audioTrimmed(serial uint32, granule uint64, n int, trim uint64) {
+	var body, lacing []byte
+	for i := 0; i < n; i++ {
+		packet := audioPacket(40)
+		body = append(body, packet...)
+		lacing = append(lacing, byte(len(packet)))
+	}
+	s.page(0, granule+uint64(n*960)-trim, serial, body, lacing...)
+}
+
+func (s *oggStream) reader(t *testing.T) *OpusReader {
+	t.Helper()
+	r, err := NewOpusReader(bytes.NewReader(s.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (s *oggStream) probe(t *testing.T) *AudioInfo {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.ogg")
+	if err := os.WriteFile(path, s.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ProbeOgg(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// audioPacket is a 20 ms CELT packet of size bytes
+func audioPacket(size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = celt20ms
+	for i := 1; i < size; i++ {
+		packet[i] = byte(i)
+	}
+	return packet
+}
+
+func readAll(t *testing.T, r *OpusReader, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatalf("packet %d: %v", i+1, err)
+		}
+	}
+}
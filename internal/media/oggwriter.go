@@ -0,0 +1,77 @@
+package media
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+)
+
+// oggVendor is the vendor string of the OpusTags header
+const oggVendor = "mezon-go-bot"
+
+// OggWriter writes Opus packets as an Ogg Opus stream, one page per packet, so a decoder at the other
+// end of a pipe gets each packet as soon as it is written
+type OggWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule uint64
+}
+
+// NewOggWriter writes the headers of a 48 kHz stereo stream. The pre-skip is 0: the packets usually
+// come from the middle of a stream whose encoder delay was skipped already.
+func NewOggWriter(w io.Writer) (*OggWriter, error) {
+	o := &OggWriter{w: w, serial: rand.Uint32()}
+
+	head := make([]byte, 19)
+	copy(head, opusHeadSignature)
+	head[8] = 1 // version
+	head[9] = 2 // channels
+	binary.LittleEndian.PutUint32(head[12:], OPUS_SAMPLE_RATE)
+	if err := o.writePage(head, oggFlagBOS, 0); err != nil {
+		return nil, err
+	}
+
+	tags := make([]byte, 0, len(opusTagsSignature)+8+len(oggVendor))
+	tags = append(tags, opusTagsSignature...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(oggVendor)))
+	tags = append(tags, oggVendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // no comments
+	if err := o.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// WritePacket writes one packet on a page of its own
+func (o *OggWriter) WritePacket(packet OpusPacket) error {
+	o.granule += uint64(packet.Samples)
+	return o.writePage(packet.Data, 0, o.granule)
+}
+
+func (o *OggWriter) writePage(body []byte, flags byte, granule uint64) error {
+	// a segment of less than 255 bytes ends the packet, Opus packets always fit on one page
+	lacing := make([]byte, 0, len(body)/255+1)
+	for n := len(body); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+
+	header := make([]byte, oggPageHeaderSize)
+	copy(header, oggCaptureSignature)
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:14], granule)
+	binary.LittleEndian.PutUint32(header[14:18], o.serial)
+	binary.LittleEndian.PutUint32(header[18:22], o.seq)
+	header[26] = byte(len(lacing))
+	binary.LittleEndian.PutUint32(header[22:26], oggChecksum(header, lacing, body))
+	o.seq++
+
+	page := make([]byte, 0, len(header)+len(lacing)+len(body))
+	page = append(append(append(page, header...), lacing...), body...)
+	_, err := o.w.Write(page)
+	return err
+}
@@ -0,0 +1,54 @@
+package media
+
+import "time"
+
+// maxPacerLag is how far behind schedule the sender may fall before the schedule moves instead
+const maxPacerLag = 200 * time.Millisecond
+
+// Pacer schedules packets against the monotonic clock: packet n is due when the durations of the
+// packets before it have elapsed since the first one. Oversleeping or a slow write shortens the next
+// wait instead of accumulating, so the stream keeps its real-time rate over any length.
+type Pacer struct {
+	start time.Time
+	sent  time.Duration
+}
+
+func NewPacer() *Pacer {
+	return &Pacer{}
+}
+
+// Wait returns how long to wait before sending the next packet, 0 when it is due
+func (p *Pacer) Wait() time.Duration {
+	return p.Until(p.sent)
+}
+
+// Until returns how long to wait for the media time offset, for streams that track their own
+// positions on a shared clock (audio and video of one file)
+func (p *Pacer) Until(offset time.Duration) time.Duration {
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start = now.Add(-offset)
+	}
+
+	wait := p.start.Add(offset).Sub(now)
+	if wait < -maxPacerLag {
+		// after a stall (GC, a blocked write) catch up is not worth a burst, restart the schedule
+		p.start = now.Add(-offset)
+		return 0
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Sent accounts for a packet of duration d
+func (p *Pacer) Sent(d time.Duration) {
+	p.sent += d
+}
+
+// Reset restarts the schedule, e.g. after a pause or a seek: the next offset is due right away
+func (p *Pacer) Reset() {
+	p.start = time.Time{}
+	p.sent = 0
+}
@@ -0,0 +1,154 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrSeekOutOfRange = errors.New("seek position out of range")
+
+// Playback is the control handle of one streamed file. The streaming loop polls it between pages,
+// so every call returns immediately and takes effect on the next page.
+type Playback struct {
+	mu       sync.Mutex
+	paused   bool
+	seek     *time.Duration
+	position time.Duration
+	duration time.Duration
+	wake     chan struct{}
+
+	// gain is a linear factor applied to the audio (loudness normalization and volume), 1 leaves it as is
+	gain        float64
+	gainChanged bool
+}
+
+func NewPlayback() *Playback {
+	return &Playback{wake: make(chan struct{}, 1), gain: 1}
+}
+
+func (p *Playback) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pause holds the stream on the current page, false when it was already paused
+func (p *Playback) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	return true
+}
+
+// Resume continues a paused stream, false when it was not paused
+func (p *Playback) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	p.signal()
+	return true
+}
+
+func (p *Playback) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Seek moves the stream to the given offset from the start of the audio
+func (p *Playback) Seek(to time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if to < 0 || (p.duration > 0 && to > p.duration) {
+		return fmt.Errorf("%w: %s of %s", ErrSeekOutOfRange, to, p.duration)
+	}
+	p.seek = &to
+	// a seek is visible right away, even before the stream reaches the position
+	p.position = to
+	p.signal()
+	return nil
+}
+
+// Position returns how far the stream is and the total duration, zero when unknown
+func (p *Playback) Position() (time.Duration, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position, p.duration
+}
+
+// SetDuration is called by the streaming loop once the file is probed
+func (p *Playback) SetDuration(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.duration = d
+}
+
+// SetPosition is called by the streaming loop after each page
+func (p *Playback) SetPosition(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// a pending seek owns the position until the loop applies it
+	if p.seek == nil {
+		p.position = d
+	}
+}
+
+// TakeSeek returns and clears the pending seek target
+func (p *Playback) TakeSeek() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.seek == nil {
+		return 0, false
+	}
+	to := *p.seek
+	p.seek = nil
+	return to, true
+}
+
+// SetGain changes the gain of the stream, it is re-encoded from the current position.
+// A paused stream takes it on resume.
+func (p *Playback) SetGain(gain float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if gain == p.gain {
+		return
+	}
+	p.gain = gain
+	p.gainChanged = true
+}
+
+func (p *Playback) Gain() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gain
+}
+
+// TakeGain returns the gain and whether it changed since the last call
+func (p *Playback) TakeGain() (float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := p.gainChanged
+	p.gainChanged = false
+	return p.gain, changed
+}
+
+// Wake is signalled on resume and seek, the loop waits on it while paused
+func (p *Playback) Wake() <-chan struct{} {
+	return p.wake
+}
@@ -0,0 +1,79 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// OPUS_SAMPLE_RATE is the granule rate of every Ogg Opus stream
+const OPUS_SAMPLE_RATE = 48000
+
+type AudioInfo struct {
+	Path              string
+	Channels          uint8
+	SampleRate        uint32
+	PreSkip           uint16
+	Packets           int
+	Duration          time.Duration
+	MinPacketDuration time.Duration
+	MaxPacketDuration time.Duration
+}
+
+// ProbeOgg reads an Ogg Opus file end to end, packet by packet, and reports its layout.
+func ProbeOgg(path string) (*AudioInfo, error) {
+	file, reader, err := OpenOpusFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := &AudioInfo{
+		Path:       path,
+		Channels:   reader.Head.Channels,
+		SampleRate: reader.Head.SampleRate,
+		PreSkip:    reader.Head.PreSkip,
+	}
+
+	for {
+		packet, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return info, fmt.Errorf("packet %d: %w", info.Packets+1, err)
+		}
+
+		info.Packets++
+		if info.MinPacketDuration == 0 || packet.Duration < info.MinPacketDuration {
+			info.MinPacketDuration = packet.Duration
+		}
+		if packet.Duration > info.MaxPacketDuration {
+			info.MaxPacketDuration = packet.Duration
+		}
+	}
+
+	info.Duration = GranuleToDuration(reader.played + reader.linkSamples(reader.linkEnd()))
+
+	return info, nil
+}
+
+// Problems lists why a probed file would not stream correctly, empty when it is fine
+func (i *AudioInfo) Problems() []string {
+	var problems []string
+
+	if i.Packets == 0 {
+		problems = append(problems, "no audio packets")
+	}
+	if i.Channels == 0 || i.Channels > 2 {
+		problems = append(problems, fmt.Sprintf("unsupported channel count %d", i.Channels))
+	}
+
+	return problems
+}
+
+// GranuleToDuration converts an Opus granule position (48 kHz samples) to a duration
+func GranuleToDuration(granule uint64) time.Duration {
+	return time.Duration(granule) * time.Second / OPUS_SAMPLE_RATE
+}
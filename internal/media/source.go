@@ -0,0 +1,19 @@
+package media
+
+import "time"
+
+// Source is a stream of Opus packets: an Ogg Opus file, or a live stream that has no end or duration
+type Source interface {
+	ReadPacket() (OpusPacket, error)
+	// Position is the end of the last returned packet
+	Position() time.Duration
+	Close() error
+}
+
+// GainSource is a Source that applies the gain itself, e.g. a live stream converted on the fly.
+// Other sources are re-opened at their position to take a new gain.
+type GainSource interface {
+	Source
+	// SetGain changes the linear gain, 1 leaves the audio as is
+	SetGain(gain float64)
+}
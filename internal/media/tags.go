@@ -0,0 +1,76 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNoOpusTags = errors.New("no OpusTags header")
+
+// maxTagsSize bounds the comment header we buffer, cover art beyond it is not worth reading
+const maxTagsSize = 1 << 20
+
+// ReadOpusTags returns the Vorbis comments of an Ogg Opus file with upper-case keys,
+// e.g. TITLE, DATE, TRACKNUMBER. Repeated keys keep the first value.
+func ReadOpusTags(path string) (map[string]string, error) {
+	file, reader, err := OpenOpusFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseOpusTags(reader.Tags())
+}
+
+func parseOpusTags(data []byte) (map[string]string, error) {
+	if !bytes.HasPrefix(data, []byte("OpusTags")) {
+		return nil, ErrNoOpusTags
+	}
+	r := bytes.NewReader(data[8:])
+
+	readString := func() (string, error) {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return "", err
+		}
+		if int64(n) > int64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return string(buf), err
+	}
+
+	// vendor string
+	if _, err := readString(); err != nil {
+		return nil, fmt.Errorf("OpusTags vendor: %w", err)
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("OpusTags count: %w", err)
+	}
+
+	tags := make(map[string]string, count)
+	for i := uint32(0); i < count; i++ {
+		comment, err := readString()
+		if err != nil {
+			// a truncated header (cover art past maxTagsSize) still yields the tags before it
+			break
+		}
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToUpper(key)
+		if _, exists := tags[key]; !exists {
+			tags[key] = value
+		}
+	}
+
+	return tags, nil
+}
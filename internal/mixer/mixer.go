@@ -0,0 +1,435 @@
+// Package mixer combines PCM layers into one stream of Opus packets: the programme, announcements that
+// duck it and effects played over both. Layers are 48 kHz interleaved stereo s16le, decoding them and
+// encoding the mix is left to the caller (ffmpeg, see ingest.Pipeline).
+package mixer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	Channels = 2
+	// FrameDuration is the step of the mix
+	FrameDuration = 20 * time.Millisecond
+	// FrameSamples is the number of samples per channel in a frame
+	FrameSamples = media.OPUS_SAMPLE_RATE / int(time.Second/FrameDuration)
+	frameBytes   = FrameSamples * Channels * 2
+
+	// DuckGain is the level of the music under an announcement, -12 dB
+	DuckGain = 0.25
+	// duckAttack and duckRelease are how long the music takes to go down and back up
+	duckAttack  = 100 * time.Millisecond
+	duckRelease = 600 * time.Millisecond
+
+	// layerBuffer is how many frames of a layer are decoded ahead of the mix
+	layerBuffer = 10
+	// tailFrames of silence push the end of the mix out of the encoder before the mixer idles
+	tailFrames = 5
+)
+
+var ErrClosed = errors.New("mixer closed")
+
+// Role tells how a layer takes part in the mix
+type Role int
+
+const (
+	// Music is the programme, it is ducked under announcements
+	Music Role = iota
+	// Voice is an announcement, music plays at DuckGain under it
+	Voice
+	// Effect plays over everything as it is, e.g. a jingle or a sound clip
+	Effect
+)
+
+func (r Role) String() string {
+	switch r {
+	case Music:
+		return "music"
+	case Voice:
+		return "voice"
+	default:
+		return "effect"
+	}
+}
+
+// Encoder turns the mix into Opus: PCM written to it comes out as packets on ReadPacket
+type Encoder interface {
+	io.Writer
+	ReadPacket() (media.OpusPacket, error)
+	Close() error
+}
+
+// Mixer mixes its layers in real time and hands the encoded packets to out. It only runs while a layer
+// is playing, so an idle mixer sends nothing.
+type Mixer struct {
+	enc Encoder
+	out func(packet media.OpusPacket) error
+
+	mu     sync.Mutex
+	layers []*Layer
+	err    error
+
+	// duck is the current music level, only the mix loop touches it
+	duck float64
+
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New starts a mixer that encodes with enc and sends each packet to out. Close releases the encoder.
+func New(enc Encoder, out func(packet media.OpusPacket) error) *Mixer {
+	m := &Mixer{
+		enc:  enc,
+		out:  out,
+		duck: 1,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	m.wg.Add(2)
+	go m.run()
+	go m.send()
+	return m
+}
+
+// Add mixes pcm in from the next frame on, gain is a linear factor. offset is where pcm starts in its
+// source, it is the base of Layer.Position. The layer closes pcm when it ends.
+func (m *Mixer) Add(pcm io.ReadCloser, role Role, gain float64, offset time.Duration) (*Layer, error) {
+	l := &Layer{
+		m:        m,
+		role:     role,
+		pcm:      pcm,
+		frames:   make(chan []int16, layerBuffer),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		gain:     gain,
+		position: offset,
+	}
+
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		pcm.Close()
+		return nil, err
+	}
+	m.layers = append(m.layers, l)
+	m.mu.Unlock()
+
+	go l.read()
+	m.signal()
+	return l, nil
+}
+
+// Close ends every layer with ErrClosed and stops the encoder
+func (m *Mixer) Close() error {
+	m.closeOnce.Do(func() {
+		m.fail(ErrClosed)
+		close(m.done)
+		m.enc.Close()
+		m.wg.Wait()
+	})
+	return nil
+}
+
+// fail ends every layer with err, later layers are refused with it
+func (m *Mixer) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	layers := slices.Clone(m.layers)
+	m.mu.Unlock()
+
+	for _, l := range layers {
+		l.finish(err)
+	}
+}
+
+func (m *Mixer) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Mixer) remove(l *Layer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.layers = slices.DeleteFunc(m.layers, func(other *Layer) bool { return other == l })
+}
+
+// playing returns the layers that are not paused
+func (m *Mixer) playing() []*Layer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.DeleteFunc(slices.Clone(m.layers), (*Layer).Paused)
+}
+
+// run mixes a frame every FrameDuration while layers play, on the same monotonic schedule as files
+func (m *Mixer) run() {
+	defer m.wg.Done()
+
+	pacer := media.NewPacer()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	mix := make([]float64, FrameSamples*Channels)
+	pcm := make([]byte, frameBytes)
+	silent := tailFrames
+	for {
+		layers := m.playing()
+		if len(layers) == 0 && silent >= tailFrames {
+			select {
+			case <-m.done:
+				return
+			case <-m.wake:
+			}
+			pacer.Reset()
+			continue
+		}
+
+		timer.Reset(pacer.Wait())
+		select {
+		case <-m.done:
+			return
+		case <-timer.C:
+		}
+
+		if m.mixFrame(layers, mix) {
+			silent = 0
+		} else {
+			silent++
+		}
+		for i, v := range mix {
+			binary.LittleEndian.PutUint16(pcm[i*2:], uint16(clampInt16(v)))
+		}
+		if _, err := m.enc.Write(pcm); err != nil {
+			select {
+			case <-m.done:
+			default:
+				log.Printf("mixer: encode: %v \n", err)
+				m.fail(err)
+			}
+			return
+		}
+		pacer.Sent(FrameDuration)
+	}
+}
+
+// mixFrame sums the next frame of each layer into mix and reports whether any layer had one. A layer
+// with nothing decoded yet, or a live source running late, is silent for the frame.
+func (m *Mixer) mixFrame(layers []*Layer, mix []float64) bool {
+	clear(mix)
+
+	frames := make([][]int16, len(layers))
+	voice, mixed := false, false
+	for i, l := range layers {
+		select {
+		case frame, ok := <-l.frames:
+			if !ok {
+				l.finish(nil)
+				continue
+			}
+			frames[i] = frame
+			voice = voice || l.role == Voice
+			mixed = true
+		default:
+		}
+	}
+
+	// the music level ramps towards its target over the frame, a step would click
+	from, to := m.duck, 1.0
+	if voice {
+		to = math.Max(DuckGain, from-(1-DuckGain)*float64(FrameDuration)/float64(duckAttack))
+	} else {
+		to = math.Min(1, from+(1-DuckGain)*float64(FrameDuration)/float64(duckRelease))
+	}
+	m.duck = to
+
+	for i, frame := range frames {
+		if frame == nil {
+			continue
+		}
+		l := layers[i]
+		gain := l.Gain()
+		for s, v := range frame {
+			g := gain
+			if l.role == Music {
+				g *= from + (to-from)*float64(s/Channels)/float64(FrameSamples)
+			}
+			mix[s] += float64(v) * g
+		}
+		l.advance()
+	}
+	return mixed
+}
+
+// send hands the encoded packets to out until the encoder is closed
+func (m *Mixer) send() {
+	defer m.wg.Done()
+
+	for {
+		packet, err := m.enc.ReadPacket()
+		if err != nil {
+			select {
+			case <-m.done:
+			default:
+				log.Printf("mixer: read encoded packet: %v \n", err)
+				m.fail(err)
+			}
+			return
+		}
+		if err := m.out(packet); err != nil {
+			log.Printf("mixer: send packet: %v \n", err)
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func clampInt16(v float64) int16 {
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	default:
+		return int16(v)
+	}
+}
+
+// Layer is one PCM source of a Mixer
+type Layer struct {
+	m      *Mixer
+	role   Role
+	pcm    io.ReadCloser
+	frames chan []int16
+
+	mu       sync.Mutex
+	gain     float64
+	paused   bool
+	position time.Duration
+	err      error
+
+	stop       chan struct{}
+	done       chan struct{}
+	finishOnce sync.Once
+}
+
+// read decodes pcm into frames ahead of the mix, a short last frame is padded with silence
+func (l *Layer) read() {
+	defer close(l.frames)
+
+	buf := make([]byte, frameBytes)
+	for {
+		n, err := io.ReadFull(l.pcm, buf)
+		if n > 0 {
+			frame := make([]int16, FrameSamples*Channels)
+			for i := range n / 2 {
+				frame[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+			}
+			select {
+			case l.frames <- frame:
+			case <-l.stop:
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return
+		}
+		if err != nil {
+			l.finish(err)
+			return
+		}
+	}
+}
+
+// finish ends the layer with err, nil when it played to its end
+func (l *Layer) finish(err error) {
+	l.finishOnce.Do(func() {
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+
+		close(l.stop)
+		l.pcm.Close()
+		l.m.remove(l)
+		close(l.done)
+	})
+}
+
+// Stop ends the layer right away
+func (l *Layer) Stop() {
+	l.finish(ErrClosed)
+}
+
+// Done is closed when the layer ended, played out or stopped
+func (l *Layer) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err is why the layer ended: nil when it played to its end, ErrClosed when it was stopped
+func (l *Layer) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *Layer) Role() Role {
+	return l.role
+}
+
+// SetGain changes the linear gain from the next frame on
+func (l *Layer) SetGain(gain float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gain = gain
+}
+
+func (l *Layer) Gain() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.gain
+}
+
+// SetPaused holds the layer where it is or lets it continue
+func (l *Layer) SetPaused(paused bool) {
+	l.mu.Lock()
+	l.paused = paused
+	l.mu.Unlock()
+
+	if !paused {
+		l.m.signal()
+	}
+}
+
+func (l *Layer) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// Position is the offset of the end of the last mixed frame in the source of the layer
+func (l *Layer) Position() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.position
+}
+
+func (l *Layer) advance() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.position += FrameDuration
+}
@@ -0,0 +1,269 @@
+package mixer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+// constFrame is a frame where every sample is v
+func constFrame(v int16) []int16 {
+	frame := make([]int16, FrameSamples*Channels)
+	for i := range frame {
+		frame[i] = v
+	}
+	return frame
+}
+
+// newTestLayer is a layer of m with its frames decoded already, it ends after them
+func newTestLayer(m *Mixer, role Role, gain float64, frames ...[]int16) *Layer {
+	l := &Layer{
+		m:      m,
+		role:   role,
+		pcm:    io.NopCloser(nil),
+		frames: make(chan []int16, len(frames)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		gain:   gain,
+	}
+	for _, f := range frames {
+		l.frames <- f
+	}
+	close(l.frames)
+	m.layers = append(m.layers, l)
+	return l
+}
+
+func TestMixFrame(t *testing.T) {
+	// the music level after the first frame of an announcement, and after the first without one
+	attacked := 1 - (1-DuckGain)*float64(FrameDuration)/float64(duckAttack)
+	released := DuckGain + (1-DuckGain)*float64(FrameDuration)/float64(duckRelease)
+
+	type layer struct {
+		role  Role
+		gain  float64
+		value int16
+	}
+	tests := []struct {
+		name   string
+		duck   float64
+		layers []layer
+		// first and last are the first and last sample of the mix, duck the music level after the frame
+		first, last float64
+		duck2       float64
+	}{
+		{
+			name:   "music alone",
+			duck:   1,
+			layers: []layer{{Music, 0.5, 1000}},
+			first:  500, last: 500, duck2: 1,
+		},
+		{
+			name:   "voice ducks music over the frame",
+			duck:   1,
+			layers: []layer{{Music, 1, 1000}, {Voice, 1, 100}},
+			first:  1100, last: 100 + 1000*(1-(1-attacked)*float64(FrameSamples-1)/float64(FrameSamples)), duck2: attacked,
+		},
+		{
+			name:   "ducked music stays at DuckGain",
+			duck:   DuckGain,
+			layers: []layer{{Music, 1, 1000}, {Voice, 2, 100}},
+			first:  450, last: 450, duck2: DuckGain,
+		},
+		{
+			name:   "music comes back without voice",
+			duck:   DuckGain,
+			layers: []layer{{Music, 1, 1000}},
+			first:  250, last: 250 + 1000*(released-DuckGain)*float64(FrameSamples-1)/float64(FrameSamples), duck2: released,
+		},
+		{
+			name:   "effects are not ducked",
+			duck:   DuckGain,
+			layers: []layer{{Effect, 1, 1000}, {Voice, 1, 100}},
+			first:  1100, last: 1100, duck2: DuckGain,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mixer{duck: tt.duck}
+			for _, l := range tt.layers {
+				newTestLayer(m, l.role, l.gain, constFrame(l.value))
+			}
+
+			mix := make([]float64, FrameSamples*Channels)
+			if !m.mixFrame(m.playing(), mix) {
+				t.Fatal("no layer mixed")
+			}
+			if math.Abs(mix[0]-tt.first) > 0.01 || math.Abs(mix[len(mix)-1]-tt.last) > 0.01 {
+				t.Errorf("mix from %.2f to %.2f, want %.2f to %.2f", mix[0], mix[len(mix)-1], tt.first, tt.last)
+			}
+			// both channels of a sample get the same gain
+			if mix[len(mix)-1] != mix[len(mix)-2] {
+				t.Errorf("channels differ: %.2f, %.2f", mix[len(mix)-2], mix[len(mix)-1])
+			}
+			if math.Abs(m.duck-tt.duck2) > 1e-9 {
+				t.Errorf("music level %.3f after the frame, want %.3f", m.duck, tt.duck2)
+			}
+		})
+	}
+}
+
+func TestMixFrameEndsLayers(t *testing.T) {
+	m := &Mixer{duck: 1}
+	music := newTestLayer(m, Music, 1, constFrame(1000), constFrame(1000))
+	effect := newTestLayer(m, Effect, 1, constFrame(100))
+	effect.SetPaused(true)
+
+	mix := make([]float64, FrameSamples*Channels)
+	for range 2 {
+		m.mixFrame(m.playing(), mix)
+	}
+	if music.Position() != 2*FrameDuration {
+		t.Errorf("music at %s after 2 frames", music.Position())
+	}
+
+	// the music ran out, the paused effect neither plays nor ends
+	if m.mixFrame(m.playing(), mix) {
+		t.Error("mixed a frame after the music ended")
+	}
+	select {
+	case <-music.Done():
+		if music.Err() != nil {
+			t.Errorf("music ended with %v", music.Err())
+		}
+	default:
+		t.Fatal("music not done")
+	}
+	if effect.Position() != 0 {
+		t.Errorf("paused effect at %s", effect.Position())
+	}
+	if layers := m.playing(); len(layers) != 0 {
+		t.Errorf("%d layers playing", len(layers))
+	}
+
+	effect.Stop()
+	if effect.Err() != ErrClosed || len(m.layers) != 0 {
+		t.Errorf("stopped effect ended with %v, %d layers left", effect.Err(), len(m.layers))
+	}
+}
+
+func TestClampInt16(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want int16
+	}{
+		{v: 0, want: 0},
+		{v: 1234.9, want: 1234},
+		{v: 40000, want: math.MaxInt16},
+		{v: -40000, want: math.MinInt16},
+	}
+	for _, tt := range tests {
+		if got := clampInt16(tt.v); got != tt.want {
+			t.Errorf("clampInt16(%v) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+// pcmEncoder passes each PCM frame through as a packet
+type pcmEncoder struct {
+	frames chan []byte
+	once   sync.Once
+}
+
+func (e *pcmEncoder) Write(p []byte) (int, error) {
+	e.frames <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func (e *pcmEncoder) ReadPacket() (media.OpusPacket, error) {
+	frame, ok := <-e.frames
+	if !ok {
+		return media.OpusPacket{}, io.EOF
+	}
+	return media.OpusPacket{Data: frame, Samples: FrameSamples, Duration: FrameDuration}, nil
+}
+
+func (e *pcmEncoder) Close() error {
+	e.once.Do(func() { close(e.frames) })
+	return nil
+}
+
+func TestMixerPlaysLayer(t *testing.T) {
+	enc := &pcmEncoder{frames: make(chan []byte, 64)}
+	var mu sync.Mutex
+	var packets []media.OpusPacket
+	m := New(enc, func(packet media.OpusPacket) error {
+		mu.Lock()
+		defer mu.Unlock()
+		packets = append(packets, packet)
+		return nil
+	})
+	defer m.Close()
+
+	// two and a half frames of a constant level, the last one padded with silence
+	pcm := make([]byte, frameBytes*5/2)
+	for i := 0; i < len(pcm); i += 2 {
+		binary.LittleEndian.PutUint16(pcm[i:], 2000)
+	}
+	layer, err := m.Add(io.NopCloser(bytes.NewReader(pcm)), Effect, 0.5, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-layer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("layer did not end")
+	}
+	if layer.Err() != nil || layer.Position() != time.Second+3*FrameDuration {
+		t.Errorf("layer ended at %s with %v", layer.Position(), layer.Err())
+	}
+
+	// a frame mixed before the layer decoded its first one is silent, the layer starts after it
+	sample := func(packet media.OpusPacket, i int) int16 {
+		return int16(binary.LittleEndian.Uint16(packet.Data[i*2:]))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var played []media.OpusPacket
+	for len(played) < 3+tailFrames {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets of the layer and its tail sent", len(played))
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		played = packets
+		for len(played) > 0 && sample(played[0], 0) == 0 {
+			played = played[1:]
+		}
+		mu.Unlock()
+	}
+
+	if s := sample(played[0], 0); s != 1000 {
+		t.Errorf("first sample %d, want 1000 at gain 0.5", s)
+	}
+	if s := sample(played[2], FrameSamples*Channels/2-1); s != 1000 {
+		t.Errorf("last sample of the short frame %d", s)
+	}
+	if s := sample(played[2], FrameSamples*Channels/2); s != 0 {
+		t.Errorf("padding %d, want silence", s)
+	}
+	// the silent tail flushes the encoder
+	for _, packet := range played[3:] {
+		if s := sample(packet, 0); s != 0 {
+			t.Errorf("tail %d, want silence", s)
+		}
+	}
+
+	m.Close()
+	if _, err := m.Add(io.NopCloser(bytes.NewReader(pcm)), Music, 1, 0); err != ErrClosed {
+		t.Errorf("add after close: %v", err)
+	}
+}
@@ -0,0 +1,684 @@
+// Package player keeps a playback queue per voice channel and plays it over one streaming connection.
+// A player may cover several channels, they then hear the same queue from one shared stream.
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+	"mezon-go-bot/internal/rtc"
+)
+
+// JingleOverlap is how long before the end of the jingle the next item starts, when both are mixed
+const JingleOverlap = 1500 * time.Millisecond
+
+var (
+	ErrNoSuchEntry = errors.New("no such queue entry")
+	ErrNotPlaying  = errors.New("nothing is playing")
+	ErrChannelBusy = errors.New("another broadcast is playing in this channel")
+	ErrNotSeekable = errors.New("a live stream can not seek")
+)
+
+type Item struct {
+	Title string
+	// Path is the Ogg Opus file to play, for a movie its sound track ("" when silent)
+	Path string
+	// Video is the IVF file of a movie, empty for audio items
+	Video string
+	// Open connects a live stream (Path is then its URL), onTitle reports the titles it announces
+	Open     func(ctx context.Context, onTitle func(title string)) (media.Source, error)
+	Duration time.Duration
+	// Gain normalizes the loudness of the item, a linear factor; 0 leaves it as is
+	Gain float64
+	// RequestedBy is the id of the user who queued the item, RequestedByName their display name
+	RequestedBy     string
+	RequestedByName string
+}
+
+// Opener connects the channels to the radio station, it is called once per playback session
+type Opener func() (rtc.IStreamingRTCConnection, error)
+
+type Outcome int
+
+const (
+	Finished Outcome = iota
+	Skipped
+	Stopped
+	Failed
+)
+
+// Ending describes how an item ended
+type Ending struct {
+	Outcome Outcome
+	// By is who skipped or stopped the item
+	By string
+	// Err is why the item failed
+	Err      error
+	Position time.Duration
+}
+
+// Status is the progress of the playing item
+type Status struct {
+	Position time.Duration
+	Duration time.Duration
+	Paused   bool
+}
+
+type Hooks struct {
+	// OnStart is called when an item starts playing
+	OnStart func(item Item)
+	// OnProgress is called every ProgressInterval while an item plays, paused or not
+	OnProgress       func(item Item, status Status)
+	ProgressInterval time.Duration
+	// OnTitle is called when a live item announces a new title
+	OnTitle func(item Item, title string)
+	// OnEnd is called when an item finished, was skipped or stopped, or failed. An item that could
+	// not start because the connection failed ends too.
+	OnEnd func(item Item, end Ending)
+}
+
+var (
+	playersMu sync.Mutex
+	players   = make(map[string]*Player) // map[channelId]*Player, a group player is stored under each of its channels
+	idle      sync.WaitGroup
+
+	jingleMu sync.Mutex
+	jingle   *Item
+)
+
+// Player plays its queue continuously and closes the connection once the queue runs out
+type Player struct {
+	channelIds []string
+	channelId  string // the channel ids joined, for logs
+	open       Opener
+	hooks      Hooks
+
+	mu      sync.Mutex
+	conn    rtc.IStreamingRTCConnection // of the session in progress, nil when idle
+	queue   []Item
+	current *Item
+	control *media.Playback
+	loop    bool
+	running bool
+	skip    context.CancelFunc
+	stopped bool
+	volume  float64 // linear factor on top of the gain of each item
+
+	// how the current item is being ended and by whom, see Skip and Stop
+	ending   Outcome
+	endingBy string
+}
+
+// Get returns the player of the channels, creating it on first use. An idle player takes the new
+// opener and hooks, so each session reports where it was started. A channel that is playing for
+// another set of channels is ErrChannelBusy, idle players of those channels are replaced.
+func Get(channelIds []string, open Opener, hooks Hooks) (*Player, error) {
+	if len(channelIds) == 0 {
+		return nil, errors.New("no channel to play in")
+	}
+
+	playersMu.Lock()
+	defer playersMu.Unlock()
+
+	if p, ok := players[channelIds[0]]; ok && slices.Equal(p.channelIds, channelIds) {
+		p.mu.Lock()
+		if !p.running {
+			p.open, p.hooks = open, hooks
+		}
+		p.mu.Unlock()
+		return p, nil
+	}
+
+	for _, id := range channelIds {
+		if p, ok := players[id]; ok && p.Running() {
+			return nil, fmt.Errorf("%w: %s", ErrChannelBusy, id)
+		}
+	}
+
+	p := &Player{
+		channelIds: slices.Clone(channelIds),
+		channelId:  strings.Join(channelIds, ","),
+		open:       open,
+		hooks:      hooks,
+		volume:     1,
+	}
+	for _, id := range channelIds {
+		if old, ok := players[id]; ok {
+			// the replaced player may still cover other channels
+			for _, oldId := range old.channelIds {
+				if players[oldId] == old {
+					delete(players, oldId)
+				}
+			}
+		}
+		players[id] = p
+	}
+	return p, nil
+}
+
+// Lookup returns the player covering the channel when one exists
+func Lookup(channelId string) (*Player, bool) {
+	playersMu.Lock()
+	defer playersMu.Unlock()
+
+	p, ok := players[channelId]
+	return p, ok
+}
+
+// Wait blocks until every player has finished its queue
+func Wait() {
+	idle.Wait()
+}
+
+// StopAll stops every player, by is reported in OnEnd, and waits until their connections are torn down
+func StopAll(by string) {
+	playersMu.Lock()
+	var all []*Player
+	for _, p := range players {
+		if !slices.Contains(all, p) {
+			all = append(all, p)
+		}
+	}
+	playersMu.Unlock()
+
+	for _, p := range all {
+		p.Stop(by)
+	}
+	idle.Wait()
+}
+
+// SetJingle plays item between two items of every queue, nil disables it. Its Duration must be set
+// for the next item to start under its tail.
+func SetJingle(item *Item) {
+	jingleMu.Lock()
+	defer jingleMu.Unlock()
+	jingle = item
+}
+
+func currentJingle() *Item {
+	jingleMu.Lock()
+	defer jingleMu.Unlock()
+	return jingle
+}
+
+// Enqueue appends an item and starts playback when idle. It returns the 1-based queue position,
+// 0 when the item plays right away.
+func (p *Player) Enqueue(item Item) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// a play right after stop belongs to a new session, not to the one being torn down: the stopped
+	// session leaves the queue alone and finish starts the next one with it
+	p.queue = append(p.queue, item)
+	if p.running {
+		return len(p.queue)
+	}
+
+	p.stopped = false
+	p.startLocked()
+	return 0
+}
+
+// startLocked pops the first item and starts a playback session, must be called with mu held
+func (p *Player) startLocked() {
+	item, control, ctx := p.popLocked()
+	p.running = true
+	idle.Add(1)
+	go p.run(ctx, item, control)
+}
+
+// Running reports whether a playback session is in progress
+func (p *Player) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// ChannelIds returns the channels the player broadcasts to
+func (p *Player) ChannelIds() []string {
+	return slices.Clone(p.channelIds)
+}
+
+// Queue returns the playing item (nil when idle) and the pending items
+func (p *Player) Queue() (*Item, []Item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var current *Item
+	if p.current != nil {
+		item := *p.current
+		current = &item
+	}
+	return current, append([]Item(nil), p.queue...)
+}
+
+// Skip ends the current item, playback continues with the next one. by is reported in OnEnd.
+func (p *Player) Skip(by string) (Item, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil || p.skip == nil {
+		return Item{}, ErrNotPlaying
+	}
+	p.ending, p.endingBy = Skipped, by
+	p.skip()
+	return *p.current, nil
+}
+
+// Pause holds the current item, false when it was already paused
+func (p *Player) Pause() (bool, error) {
+	control, err := p.playback()
+	if err != nil {
+		return false, err
+	}
+	return control.Pause(), nil
+}
+
+// Resume continues the current item, false when it was not paused
+func (p *Player) Resume() (bool, error) {
+	control, err := p.playback()
+	if err != nil {
+		return false, err
+	}
+	return control.Resume(), nil
+}
+
+// Seek moves the current item to the given offset
+func (p *Player) Seek(to time.Duration) error {
+	p.mu.Lock()
+	current, control := p.current, p.control
+	p.mu.Unlock()
+
+	if current == nil {
+		return ErrNotPlaying
+	}
+	if current.Open != nil {
+		return ErrNotSeekable
+	}
+	return control.Seek(to)
+}
+
+// Position returns the current item with its position and duration
+func (p *Player) Position() (Item, time.Duration, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		return Item{}, 0, 0, ErrNotPlaying
+	}
+	pos, dur := p.control.Position()
+	return *p.current, pos, dur, nil
+}
+
+func (p *Player) playback() (*media.Playback, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		return nil, ErrNotPlaying
+	}
+	return p.control, nil
+}
+
+// Remove drops the n-th (1-based) pending item
+func (p *Player) Remove(n int) (Item, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n < 1 || n > len(p.queue) {
+		return Item{}, fmt.Errorf("%w: %d", ErrNoSuchEntry, n)
+	}
+	item := p.queue[n-1]
+	p.queue = append(p.queue[:n-1], p.queue[n:]...)
+	return item, nil
+}
+
+// Clear drops every pending item and returns how many there were, the current item keeps playing
+func (p *Player) Clear() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.queue)
+	p.queue = nil
+	return n
+}
+
+// ToggleLoop switches queue repeat and returns the new state
+func (p *Player) ToggleLoop() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loop = !p.loop
+	return p.loop
+}
+
+// SetVolume sets the volume of the channels, a linear factor, the playing item takes it right away
+func (p *Player) SetVolume(volume float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.volume = volume
+	if p.current != nil && p.control != nil {
+		p.control.SetGain(p.gainLocked(*p.current))
+	}
+}
+
+func (p *Player) Volume() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.volume
+}
+
+// gainLocked is the gain an item plays with: its normalization and the volume
+func (p *Player) gainLocked(item Item) float64 {
+	gain := item.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	return gain * p.volume
+}
+
+// Announce mixes an announcement over the playing item, whose music is ducked under it. It returns once
+// the announcement played, rtc.ErrNoMixer when nothing can be mixed.
+func (p *Player) Announce(ctx context.Context, item Item) error {
+	return p.overlay(ctx, item, mixer.Voice)
+}
+
+// PlayEffect mixes a short sound over the playing item as it is, see Announce
+func (p *Player) PlayEffect(ctx context.Context, item Item) error {
+	return p.overlay(ctx, item, mixer.Effect)
+}
+
+func (p *Player) overlay(ctx context.Context, item Item, role mixer.Role) error {
+	p.mu.Lock()
+	conn, gain := p.conn, p.gainLocked(item)
+	p.mu.Unlock()
+
+	if conn == nil {
+		return ErrNotPlaying
+	}
+	return conn.PlayOverlay(ctx, item.Path, role, gain)
+}
+
+// Stop clears the queue and ends playback. by is reported in OnEnd.
+func (p *Player) Stop(by string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.running {
+		return ErrNotPlaying
+	}
+	p.queue = nil
+	p.stopped = true
+	p.ending, p.endingBy = Stopped, by
+	if p.skip != nil {
+		p.skip()
+	}
+	return nil
+}
+
+// next pops the next item and arms its skip context, ok is false when playback must end
+func (p *Player) next(finished *Item) (Item, *media.Playback, context.Context, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if finished != nil && p.loop && !p.stopped {
+		p.queue = append(p.queue, *finished)
+	}
+	if p.skip != nil {
+		p.skip()
+		p.skip = nil
+	}
+
+	if p.stopped || len(p.queue) == 0 {
+		p.current = nil
+		p.control = nil
+		return Item{}, nil, nil, false
+	}
+
+	item, control, ctx := p.popLocked()
+	return item, control, ctx, true
+}
+
+// popLocked makes the first queued item current and arms its controls and skip context
+func (p *Player) popLocked() (Item, *media.Playback, context.Context) {
+	item := p.queue[0]
+	p.queue = p.queue[1:]
+	p.current = &item
+	p.control = media.NewPlayback()
+	p.control.SetGain(p.gainLocked(item))
+	p.ending, p.endingBy = Finished, ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.skip = cancel
+	return item, p.control, ctx
+}
+
+func (p *Player) run(ctx context.Context, item Item, control *media.Playback) {
+	defer idle.Done()
+
+	conn, err := p.open()
+	if err != nil {
+		p.end(item, Ending{Outcome: Failed, Err: err})
+		p.abort()
+		return
+	}
+	p.setConn(conn)
+
+	for ok := true; ok; {
+		if p.hooks.OnStart != nil {
+			p.hooks.OnStart(item)
+		}
+		stopProgress := p.progress(ctx, control)
+
+		var err error
+		switch {
+		case item.Video != "":
+			err = conn.PlayVideoTrack(ctx, item.Video, item.Path, control)
+		case item.Open != nil:
+			err = p.playLive(ctx, conn, item, control)
+		default:
+			err = conn.PlayAudioTrack(ctx, item.Path, control)
+		}
+		stopProgress()
+
+		end := p.ended(control, err)
+		p.end(item, end)
+		if errors.Is(err, rtc.ErrStreamClosed) {
+			// the station dropped us: finish dials a new session for what is left in the queue
+			p.release()
+			break
+		}
+
+		// a failed item is not looped, otherwise a broken file would spin forever
+		var finished *Item
+		if end.Outcome != Failed {
+			finished = &item
+		}
+		item, control, ctx, ok = p.next(finished)
+		if ok {
+			p.playJingle(ctx, conn)
+		}
+	}
+
+	p.setConn(nil)
+	conn.Close(p.channelId)
+	p.finish()
+}
+
+func (p *Player) setConn(conn rtc.IStreamingRTCConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+}
+
+// playJingle plays the jingle between two items, ctx is the one of the next item. Mixed, the next item
+// starts JingleOverlap before the jingle ends; otherwise the jingle plays on its own first.
+func (p *Player) playJingle(ctx context.Context, conn rtc.IStreamingRTCConnection) {
+	jingle := currentJingle()
+	if jingle == nil {
+		return
+	}
+	p.mu.Lock()
+	gain := p.gainLocked(*jingle)
+	p.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.PlayOverlay(ctx, jingle.Path, mixer.Effect, gain)
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, rtc.ErrNoMixer) {
+			control := media.NewPlayback()
+			control.SetGain(gain)
+			err = conn.PlayAudioTrack(ctx, jingle.Path, control)
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("player %s: jingle: %v \n", p.channelId, err)
+		}
+	case <-time.After(max(0, jingle.Duration-JingleOverlap)):
+	case <-ctx.Done():
+	}
+}
+
+// ended tells how the current item ended from the error of its play call
+func (p *Player) ended(control *media.Playback, err error) Ending {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos, _ := control.Position()
+	end := Ending{Outcome: p.ending, By: p.endingBy, Position: pos}
+	switch {
+	case err == nil:
+		end.Outcome, end.By = Finished, ""
+	case errors.Is(err, context.Canceled) && end.Outcome != Finished:
+	default:
+		// canceled without Skip or Stop: the session was torn down under the item
+		end.Outcome, end.By, end.Err = Failed, "", err
+	}
+	return end
+}
+
+// progress calls OnProgress until the returned stop is called
+func (p *Player) progress(ctx context.Context, control *media.Playback) func() {
+	if p.hooks.OnProgress == nil || p.hooks.ProgressInterval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(p.hooks.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			p.mu.Lock()
+			if p.current == nil || p.control != control {
+				p.mu.Unlock()
+				return
+			}
+			item := *p.current
+			p.mu.Unlock()
+
+			pos, dur := control.Position()
+			p.hooks.OnProgress(item, Status{Position: pos, Duration: dur, Paused: control.Paused()})
+		}
+	}()
+
+	// an edit in flight must not land after the final one
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// playLive connects a live item and plays it until it is skipped, the current title follows the stream
+func (p *Player) playLive(ctx context.Context, conn rtc.IStreamingRTCConnection, item Item, control *media.Playback) error {
+	src, err := item.Open(ctx, func(title string) {
+		p.mu.Lock()
+		if p.current != nil && p.control == control {
+			p.current.Title = fmt.Sprintf("%s: %s", item.Title, title)
+		}
+		p.mu.Unlock()
+
+		if p.hooks.OnTitle != nil {
+			p.hooks.OnTitle(item, title)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return conn.PlaySource(ctx, src, control)
+}
+
+// finish marks the player idle once the connection is released, or starts a new session for items
+// enqueued while the last one was closing, after a Stop too
+func (p *Player) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finishLocked()
+}
+
+func (p *Player) finishLocked() {
+	if len(p.queue) > 0 {
+		p.stopped = false
+		p.startLocked()
+		return
+	}
+	p.running = false
+}
+
+// abort ends a session that could not start, its queue is dropped. Items enqueued after a Stop belong
+// to the next session, which is started for them.
+func (p *Player) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.stopped {
+		p.queue = nil
+	}
+	p.releaseLocked()
+	p.finishLocked()
+}
+
+// release drops the current item of a session that ended early
+func (p *Player) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseLocked()
+}
+
+func (p *Player) releaseLocked() {
+	p.current = nil
+	p.control = nil
+	if p.skip != nil {
+		p.skip()
+		p.skip = nil
+	}
+}
+
+func (p *Player) end(item Item, end Ending) {
+	if end.Outcome == Failed {
+		log.Printf("player %s: %s: %v \n", p.channelId, item.Title, end.Err)
+	}
+	if p.hooks.OnEnd != nil {
+		p.hooks.OnEnd(item, end)
+	}
+}
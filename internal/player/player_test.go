@@ -0,0 +1,268 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+	"mezon-go-bot/internal/rtc"
+)
+
+// fakeConn plays an item until the test finishes it or it is canceled
+type fakeConn struct {
+	started  chan string   // the path of each item that starts
+	finished chan struct{} // ends the playing item
+	closed   chan struct{}
+}
+
+func (c *fakeConn) WaitReady(ctx context.Context) error  { return nil }
+func (c *fakeConn) SendAudioTrack(filePath string) error { return nil }
+func (c *fakeConn) Record(rec rtc.Recorder)              {}
+func (c *fakeConn) Close(channelId string)               { close(c.closed) }
+
+func (c *fakeConn) PlayAudioTrack(ctx context.Context, filePath string, pb *media.Playback) error {
+	c.started <- filePath
+	select {
+	case <-c.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *fakeConn) PlayVideoTrack(ctx context.Context, videoPath, audioPath string, pb *media.Playback) error {
+	return c.PlayAudioTrack(ctx, videoPath, pb)
+}
+
+func (c *fakeConn) PlaySource(ctx context.Context, src media.Source, pb *media.Playback) error {
+	return c.PlayAudioTrack(ctx, "live", pb)
+}
+
+func (c *fakeConn) PlayOverlay(ctx context.Context, filePath string, role mixer.Role, gain float64) error {
+	return rtc.ErrNoMixer
+}
+
+// testPlayer plays on fake connections and records how items ended
+type testPlayer struct {
+	*Player
+	t     *testing.T
+	conns chan *fakeConn
+
+	mu   sync.Mutex
+	ends []string // title: outcome by
+}
+
+func newTestPlayer(t *testing.T) *testPlayer {
+	t.Helper()
+	tp := &testPlayer{t: t, conns: make(chan *fakeConn, 4)}
+	open := func() (rtc.IStreamingRTCConnection, error) {
+		conn := &fakeConn{started: make(chan string, 1), finished: make(chan struct{}), closed: make(chan struct{})}
+		tp.conns <- conn
+		return conn, nil
+	}
+	hooks := Hooks{OnEnd: func(item Item, end Ending) {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+		tp.ends = append(tp.ends, item.Title+": "+[...]string{"finished", "skipped", "stopped", "failed"}[end.Outcome]+" "+end.By)
+	}}
+
+	p, err := Get([]string{t.Name()}, open, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Player = p
+	t.Cleanup(func() { p.Stop("cleanup") })
+	return tp
+}
+
+func (tp *testPlayer) conn() *fakeConn {
+	tp.t.Helper()
+	select {
+	case conn := <-tp.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		tp.t.Fatal("no session opened")
+		return nil
+	}
+}
+
+// playing waits for the next item to start on conn
+func (tp *testPlayer) playing(conn *fakeConn, want string) {
+	tp.t.Helper()
+	select {
+	case path := <-conn.started:
+		if path != want {
+			tp.t.Fatalf("playing %s, want %s", path, want)
+		}
+	case <-time.After(5 * time.Second):
+		tp.t.Fatalf("%s did not start", want)
+	}
+}
+
+func (tp *testPlayer) pending() []string {
+	_, queue := tp.Queue()
+	var titles []string
+	for _, item := range queue {
+		titles = append(titles, item.Title)
+	}
+	return titles
+}
+
+func (tp *testPlayer) waitIdle(conn *fakeConn) {
+	tp.t.Helper()
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		tp.t.Fatal("session not closed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); tp.Running(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			tp.t.Fatal("player still running")
+		}
+	}
+}
+
+func testItem(title string) Item {
+	return Item{Title: title, Path: title}
+}
+
+func TestPlayerQueueOps(t *testing.T) {
+	tp := newTestPlayer(t)
+
+	positions := []int{tp.Enqueue(testItem("a")), tp.Enqueue(testItem("b")), tp.Enqueue(testItem("c")), tp.Enqueue(testItem("d"))}
+	if want := []int{0, 1, 2, 3}; !slices.Equal(positions, want) {
+		t.Errorf("positions %v, want %v", positions, want)
+	}
+	conn := tp.conn()
+	tp.playing(conn, "a")
+
+	tests := []struct {
+		name    string
+		op      func() error
+		err     error
+		pending []string
+	}{
+		{name: "remove past the end", op: func() error { _, err := tp.Remove(4); return err }, err: ErrNoSuchEntry, pending: []string{"b", "c", "d"}},
+		{name: "remove zero", op: func() error { _, err := tp.Remove(0); return err }, err: ErrNoSuchEntry, pending: []string{"b", "c", "d"}},
+		{name: "remove the middle", op: func() error { _, err := tp.Remove(2); return err }, pending: []string{"b", "d"}},
+		{name: "skip", op: func() error { _, err := tp.Skip("dj"); tp.playing(conn, "b"); return err }, pending: []string{"d"}},
+		{name: "finish", op: func() error { conn.finished <- struct{}{}; tp.playing(conn, "d"); return nil }, pending: nil},
+		{name: "enqueue while playing", op: func() error { tp.Enqueue(testItem("e")); tp.Enqueue(testItem("f")); return nil }, pending: []string{"e", "f"}},
+		{name: "clear keeps the current item", op: func() error { tp.Clear(); return nil }, pending: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if got := tp.pending(); !slices.Equal(got, tt.pending) {
+				t.Errorf("pending %q, want %q", got, tt.pending)
+			}
+		})
+	}
+
+	if current, _ := tp.Queue(); current == nil || current.Title != "d" {
+		t.Errorf("current %v, want d", current)
+	}
+	conn.finished <- struct{}{}
+	tp.waitIdle(conn)
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	want := []string{"a: skipped dj", "b: finished ", "d: finished "}
+	if !slices.Equal(tp.ends, want) {
+		t.Errorf("ends %q, want %q", tp.ends, want)
+	}
+	if _, err := tp.Skip("dj"); !errors.Is(err, ErrNotPlaying) {
+		t.Errorf("skip when idle: %v", err)
+	}
+}
+
+func TestPlayerLoop(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.Enqueue(testItem("a"))
+	tp.Enqueue(testItem("b"))
+	if !tp.ToggleLoop() {
+		t.Fatal("loop not on")
+	}
+	conn := tp.conn()
+
+	// finished and skipped items go back to the end of the queue
+	tp.playing(conn, "a")
+	conn.finished <- struct{}{}
+	tp.playing(conn, "b")
+	tp.Skip("dj")
+	tp.playing(conn, "a")
+	if got := tp.pending(); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("pending %q", got)
+	}
+
+	if tp.ToggleLoop() {
+		t.Fatal("loop not off")
+	}
+	conn.finished <- struct{}{}
+	tp.playing(conn, "b")
+	conn.finished <- struct{}{}
+	tp.waitIdle(conn)
+}
+
+func TestPlayerStop(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.Enqueue(testItem("a"))
+	tp.Enqueue(testItem("b"))
+	conn := tp.conn()
+	tp.playing(conn, "a")
+
+	if err := tp.Stop("admin"); err != nil {
+		t.Fatal(err)
+	}
+	// a play right after the stop starts a new session with only the new item
+	if pos := tp.Enqueue(testItem("c")); pos != 1 {
+		t.Errorf("enqueued at %d while stopping", pos)
+	}
+	<-conn.closed
+
+	next := tp.conn()
+	tp.playing(next, "c")
+	if got := tp.pending(); len(got) != 0 {
+		t.Errorf("pending %q after stop", got)
+	}
+	next.finished <- struct{}{}
+	tp.waitIdle(next)
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if want := []string{"a: stopped admin", "c: finished "}; !slices.Equal(tp.ends, want) {
+		t.Errorf("ends %q, want %q", tp.ends, want)
+	}
+	if err := tp.Stop("admin"); !errors.Is(err, ErrNotPlaying) {
+		t.Errorf("stop when idle: %v", err)
+	}
+}
+
+func TestPlayerVolume(t *testing.T) {
+	tests := []struct {
+		gain   float64
+		volume float64
+		want   float64
+	}{
+		{gain: 0, volume: 1, want: 1},
+		{gain: 0.5, volume: 1, want: 0.5},
+		{gain: 0.5, volume: 1.5, want: 0.75},
+		{gain: 2, volume: 0, want: 0},
+	}
+
+	p := &Player{}
+	for _, tt := range tests {
+		p.SetVolume(tt.volume)
+		if got := p.gainLocked(Item{Gain: tt.gain}); got != tt.want {
+			t.Errorf("gain %v at volume %v plays at %v, want %v", tt.gain, tt.volume, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package radiostation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nccasia/mezon-go-sdk/configs"
+	"github.com/nccasia/mezon-go-sdk/utils"
+)
+
+const (
+	// tokenRefreshMargin renews a token this long before it expires
+	tokenRefreshMargin = 2 * time.Minute
+	tokenRetryDelay    = 10 * time.Second
+
+	// CloseTokenExpired is the close code the station uses for an expired token
+	CloseTokenExpired = 4001
+)
+
+var ErrUnauthorized = errors.New("radio station rejected the token")
+
+type Token struct {
+	Value string
+	// ExpiresAt is zero when the token does not expire
+	ExpiresAt time.Time
+}
+
+func (t *Token) expiresWithin(d time.Duration) bool {
+	return !t.ExpiresAt.IsZero() && time.Until(t.ExpiresAt) < d
+}
+
+type TokenSource interface {
+	// Token returns a token valid for at least tokenRefreshMargin
+	Token() (*Token, error)
+	// Invalidate drops the cached token after the station rejected it
+	Invalidate()
+	// Stop ends the background renewal, on shutdown
+	Stop()
+}
+
+type staticTokenSource struct {
+	token *Token
+}
+
+// NewStaticTokenSource serves a fixed token, e.g. TOKEN from .env. A JWT expiry is read for logging only.
+func NewStaticTokenSource(token string) TokenSource {
+	return &staticTokenSource{token: &Token{Value: token, ExpiresAt: jwtExpiry(token)}}
+}
+
+func (s *staticTokenSource) Token() (*Token, error) {
+	if s.token.expiresWithin(0) {
+		log.Printf("radio station static token expired at %s, set a new TOKEN or use STN_AUTH_MODE=exchange \n", s.token.ExpiresAt)
+	}
+	return s.token, nil
+}
+
+func (s *staticTokenSource) Invalidate() {}
+
+func (s *staticTokenSource) Stop() {}
+
+type exchangeRequest struct {
+	ApiKey   string `json:"api_key"`
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type exchangeResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"` // seconds
+}
+
+// exchangeTokenSource trades the bot API key for short-lived station tokens and renews them in the background
+type exchangeTokenSource struct {
+	url    string
+	client *http.Client
+	body   exchangeRequest
+
+	mu      sync.Mutex
+	current *Token
+	timer   *time.Timer
+	stopped bool
+}
+
+// NewExchangeTokenSource authenticates against https://<stn>/<authPath> with the bot API key
+func NewExchangeTokenSource(c *configs.Config, authPath, apiKey, userId, username string) TokenSource {
+	client := &http.Client{Timeout: 15 * time.Second}
+	if c.Timeout > 0 {
+		client.Timeout = time.Duration(c.Timeout) * time.Second
+	}
+	if c.InsecureSkip {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	return &exchangeTokenSource{
+		url:    utils.GetBasePath("https", c.BasePath, c.UseSSL) + "/" + strings.TrimPrefix(authPath, "/"),
+		client: client,
+		body: exchangeRequest{
+			ApiKey:   apiKey,
+			UserId:   userId,
+			Username: username,
+		},
+	}
+}
+
+func (s *exchangeTokenSource) Token() (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && !s.current.expiresWithin(tokenRefreshMargin) {
+		return s.current, nil
+	}
+
+	return s.refreshLocked()
+}
+
+func (s *exchangeTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = nil
+}
+
+// Stop cancels the pending renewal, Token still exchanges on demand afterwards but schedules nothing
+func (s *exchangeTokenSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// refreshLocked must be called with mu held
+func (s *exchangeTokenSource) refreshLocked() (*Token, error) {
+	token, err := s.exchange()
+	if err != nil {
+		return nil, err
+	}
+	s.current = token
+	s.scheduleLocked(token)
+	return token, nil
+}
+
+// scheduleLocked renews the token ahead of expiry, so a reconnect never waits on the auth endpoint
+func (s *exchangeTokenSource) scheduleLocked(token *Token) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.stopped || token.ExpiresAt.IsZero() {
+		return
+	}
+
+	wait := time.Until(token.ExpiresAt) - tokenRefreshMargin
+	if wait < 0 {
+		wait = 0
+	}
+	s.timer = time.AfterFunc(wait, s.backgroundRefresh)
+}
+
+func (s *exchangeTokenSource) backgroundRefresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the timer fired while Stop was waiting for the lock
+	if s.stopped {
+		return
+	}
+	if _, err := s.refreshLocked(); err != nil {
+		log.Println("radio station token refresh err: ", err)
+		s.timer = time.AfterFunc(tokenRetryDelay, s.backgroundRefresh)
+	}
+}
+
+func (s *exchangeTokenSource) exchange() (*Token, error) {
+	body, err := json.Marshal(s.body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, strings.TrimSpace(string(data)))
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("radio station auth: status %d: %s", res.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var resp exchangeResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("radio station auth: %w", err)
+	}
+	if resp.Token == "" {
+		return nil, errors.New("radio station auth: empty token")
+	}
+
+	token := &Token{Value: resp.Token, ExpiresAt: jwtExpiry(resp.Token)}
+	if resp.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT, zero for anything else
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
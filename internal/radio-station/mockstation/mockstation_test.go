@@ -0,0 +1,89 @@
+package mockstation_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mezon-go-bot/internal/media"
+	radiostation "mezon-go-bot/internal/radio-station"
+	"mezon-go-bot/internal/radio-station/mockstation"
+	"mezon-go-bot/internal/rtc"
+
+	"github.com/nccasia/mezon-go-sdk/configs"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	testClanId    = "clan-1"
+	testChannelId = "channel-1"
+	testBotId     = "bot-1"
+
+	// hello.ogg is streamed at its real time rate, about 4 s
+	testAudio = "../../../audio/hello.ogg"
+)
+
+func TestStreamedAudioIsRecorded(t *testing.T) {
+	outDir := t.TempDir()
+	station, err := mockstation.New("", outDir)
+	if err != nil {
+		t.Fatalf("start mock station: %v", err)
+	}
+	defer station.Close()
+
+	source, err := media.ProbeOgg(testAudio)
+	if err != nil {
+		t.Fatalf("probe %s: %v", testAudio, err)
+	}
+
+	ws, err := radiostation.Join(&configs.Config{BasePath: station.Domain(), Timeout: 5, InsecureSkip: true},
+		testClanId, testChannelId, testBotId, "bot", station.Token())
+	if err != nil {
+		t.Fatalf("join mock station: %v", err)
+	}
+	conn, err := rtc.NewStreamingRTCConnection(webrtc.Configuration{}, ws, testClanId, testChannelId, testBotId, "bot")
+	if err != nil {
+		ws.Close()
+		t.Fatalf("new streaming connection: %v", err)
+	}
+
+	// like the recording notice, the audio must be heard from its first packet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.WaitReady(ctx); err != nil {
+		conn.Close(testChannelId)
+		t.Fatalf("wait for the station: %v", err)
+	}
+	if err := conn.SendAudioTrack(testAudio); err != nil {
+		conn.Close(testChannelId)
+		t.Fatalf("send audio: %v", err)
+	}
+	conn.Close(testChannelId)
+
+	rec, err := station.WaitForPackets(testChannelId, source.Packets, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Dropped > 0 {
+		t.Errorf("%d packets sent before the station let the bot talk", rec.Dropped)
+	}
+	if rec.UserId != testBotId {
+		t.Errorf("recorded user %q, want %q", rec.UserId, testBotId)
+	}
+	if want := filepath.Join(outDir, testChannelId+".ogg"); rec.Path != want {
+		t.Errorf("recorded to %s, want %s", rec.Path, want)
+	}
+
+	recorded, err := media.ProbeOgg(rec.Path)
+	if err != nil {
+		t.Fatalf("probe recording: %v", err)
+	}
+	if recorded.Packets != source.Packets {
+		t.Errorf("%s has %d packets, the source %d", rec.Path, recorded.Packets, source.Packets)
+	}
+	// RTP time spans from the first packet to the start of the last one, hello.ogg has 20 ms packets
+	if want := time.Duration(source.Packets-1) * 20 * time.Millisecond; rec.Duration != want {
+		t.Errorf("recorded %s of RTP time, want %s", rec.Duration, want)
+	}
+}
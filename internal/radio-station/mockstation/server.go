@@ -0,0 +1,503 @@
+// Package mockstation is an offline stand-in for the radio station: it speaks the signaling
+// protocol of package radiostation and records what publishers send to Ogg (and IVF) files.
+package mockstation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	radiostation "mezon-go-bot/internal/radio-station"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Recording describes what one publisher sent on a channel
+type Recording struct {
+	ChannelId string
+	UserId    string
+	Path      string
+	Packets   int
+	Bytes     int
+	Talking   bool
+	// Dropped counts the packets received before the station let the publisher talk, a real station
+	// does not relay them
+	Dropped int
+	// Left is set once the publisher sent leave_publisher
+	Left bool
+	// Duration is the RTP time covered by the received packets
+	Duration time.Duration
+
+	// video, VP8 is also written to VideoPath
+	VideoCodec  string
+	VideoPath   string
+	VideoFrames int
+	Keyframes   int
+}
+
+type Server struct {
+	outDir   string
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+	token    string
+
+	mu         sync.Mutex
+	publishers map[string]*publisher // map[channelId/userId]*publisher
+	left       []*publisher          // publishers that sent leave_publisher, kept for their recordings
+	changed    chan struct{}
+}
+
+type publisher struct {
+	srv  *Server
+	ws   *websocket.Conn
+	wsMu *sync.Mutex
+	peer *webrtc.PeerConnection
+	head radiostation.Header
+	rec  Recording
+	// granted is set once connect_publisher was echoed, the publisher is heard from then on
+	granted bool
+
+	firstTS, lastTS uint32
+}
+
+// New starts a TLS station on addr ("" picks a free local port). The certificate is self-signed,
+// so the bot needs INSECURE_SKIP=true. Received audio goes to outDir/<channelId>.ogg.
+func New(addr, outDir string) (*Server, error) {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		outDir:     outDir,
+		token:      "mock-station-token",
+		publishers: make(map[string]*publisher),
+		changed:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWS)
+	mux.HandleFunc("/auth/token", s.handleAuth)
+
+	s.server = httptest.NewUnstartedServer(mux)
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.server.Listener.Close()
+		s.server.Listener = l
+	}
+	s.server.StartTLS()
+
+	return s, nil
+}
+
+// Domain is the host:port to put in STN_DOMAIN
+func (s *Server) Domain() string {
+	return strings.TrimPrefix(s.server.URL, "https://")
+}
+
+// Token is the token the exchange endpoint hands out, any token is accepted on /ws
+func (s *Server) Token() string {
+	return s.token
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.publishers {
+		p.peer.Close()
+	}
+}
+
+// Recordings returns a snapshot of every publisher seen so far
+func (s *Server) Recordings() []Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Recording, 0, len(s.left)+len(s.publishers))
+	for _, p := range s.allLocked() {
+		list = append(list, p.rec)
+	}
+	return list
+}
+
+// WaitForPackets blocks until the channel recorded at least n packets
+func (s *Server) WaitForPackets(channelId string, n int, timeout time.Duration) (Recording, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		for _, p := range s.allLocked() {
+			if p.head.ChannelId == channelId && p.rec.Packets >= n {
+				rec := p.rec
+				s.mu.Unlock()
+				return rec, nil
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Recording{}, fmt.Errorf("channel %s: fewer than %d packets after %s", channelId, n, timeout)
+		}
+	}
+}
+
+// allLocked lists the publishers that left, then the connected ones, must be called with mu held
+func (s *Server) allLocked() []*publisher {
+	all := append([]*publisher(nil), s.left...)
+	for _, p := range s.publishers {
+		all = append(all, p)
+	}
+	return all
+}
+
+// notifyLocked wakes WaitForPackets, must be called with mu held
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      s.token,
+		"expires_in": 3600,
+	})
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("token") == "" && r.Header.Get("Authorization") == "" {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	wsMu := &sync.Mutex{}
+	for {
+		var msg radiostation.WsMsg
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		if err := s.onMessage(conn, wsMu, &msg); err != nil {
+			log.Printf("[mockstation] %s: %v \n", msg.Key, err)
+		}
+	}
+}
+
+func (s *Server) onMessage(conn *websocket.Conn, wsMu *sync.Mutex, msg *radiostation.WsMsg) error {
+	payload, err := radiostation.Decode(msg)
+	if err != nil {
+		return err
+	}
+
+	head := radiostation.Header{
+		ClanId:      msg.ClanId,
+		ChannelId:   msg.ChannelId,
+		UserId:      msg.UserId,
+		DisplayName: msg.DisplayName,
+	}
+	key := msg.ChannelId + "/" + msg.UserId
+
+	switch p := payload.(type) {
+	case *radiostation.SessionPublisher:
+		return s.onOffer(conn, wsMu, head, key, p)
+
+	case *radiostation.IceCandidate:
+		pub := s.publisher(key)
+		if pub == nil {
+			return errors.New("ice candidate before offer")
+		}
+		return pub.peer.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:        p.Candidate,
+			SDPMid:           p.SDPMid,
+			SDPMLineIndex:    p.SDPMLineIndex,
+			UsernameFragment: p.UsernameFragment,
+		})
+
+	case *radiostation.ConnectPublisher:
+		// the real station echoes connect_publisher to let the publisher talk
+		pub := s.publisher(key)
+		if pub == nil {
+			return errors.New("connect before offer")
+		}
+		s.mu.Lock()
+		pub.granted = true
+		s.mu.Unlock()
+		return pub.send(p)
+
+	case *radiostation.PttPublisher:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if pub := s.publishers[key]; pub != nil {
+			pub.rec.Talking = p.IsTalk
+			s.notifyLocked()
+		}
+
+	case *radiostation.LeavePublisher:
+		// the next offer of the channel starts a new publisher
+		s.mu.Lock()
+		pub := s.publishers[key]
+		if pub != nil {
+			pub.rec.Left = true
+			delete(s.publishers, key)
+			s.left = append(s.left, pub)
+			s.notifyLocked()
+		}
+		s.mu.Unlock()
+		if pub != nil {
+			return pub.peer.Close()
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) publisher(key string) *publisher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publishers[key]
+}
+
+// onOffer answers a new publisher, or renegotiates an existing one (ICE restart after a reconnect)
+func (s *Server) onOffer(conn *websocket.Conn, wsMu *sync.Mutex, head radiostation.Header, key string, offer *radiostation.SessionPublisher) error {
+	s.mu.Lock()
+	pub, exists := s.publishers[key]
+	s.mu.Unlock()
+
+	if !exists {
+		var err error
+		pub, err = s.newPublisher(conn, wsMu, head)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.publishers[key] = pub
+		s.notifyLocked()
+		s.mu.Unlock()
+	} else {
+		// the publisher came back on a new socket
+		s.mu.Lock()
+		pub.ws, pub.wsMu = conn, wsMu
+		s.mu.Unlock()
+	}
+
+	if err := pub.peer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+		return err
+	}
+	answer, err := pub.peer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pub.peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	sdAnswer := radiostation.SdAnswer(answer.SDP)
+	return pub.send(&sdAnswer)
+}
+
+func (s *Server) newPublisher(conn *websocket.Conn, wsMu *sync.Mutex, head radiostation.Header) (*publisher, error) {
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	pub := &publisher{
+		srv:  s,
+		ws:   conn,
+		wsMu: wsMu,
+		peer: peer,
+		head: head,
+		rec: Recording{
+			ChannelId: head.ChannelId,
+			UserId:    head.UserId,
+			Path:      filepath.Join(s.outDir, head.ChannelId+".ogg"),
+		},
+	}
+
+	peer.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+		init := i.ToJSON()
+		if err := pub.send(&radiostation.IceCandidate{
+			Candidate:        init.Candidate,
+			SDPMid:           init.SDPMid,
+			SDPMLineIndex:    init.SDPMLineIndex,
+			UsernameFragment: init.UsernameFragment,
+		}); err != nil {
+			log.Printf("[mockstation] send candidate: %v \n", err)
+		}
+	})
+
+	peer.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		// reading the sender reports lets the receiver reports carry LSR/DLSR, so the bot can measure RTT
+		go func() {
+			for {
+				if _, _, err := receiver.ReadRTCP(); err != nil {
+					return
+				}
+			}
+		}()
+
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			pub.recordVideo(track)
+			return
+		}
+		pub.record(track)
+	})
+
+	return pub, nil
+}
+
+func (p *publisher) send(payload radiostation.Payload) error {
+	msg, err := radiostation.Encode(p.head, payload)
+	if err != nil {
+		return err
+	}
+
+	p.srv.mu.Lock()
+	ws, wsMu := p.ws, p.wsMu
+	p.srv.mu.Unlock()
+
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	return ws.WriteJSON(msg)
+}
+
+// record writes the RTP packets of the track to the channel Ogg file until the track ends. Packets sent
+// before the publisher was let talk are only counted as Dropped.
+func (p *publisher) record(track *webrtc.TrackRemote) {
+	writer, err := oggwriter.New(p.rec.Path, 48000, 2)
+	if err != nil {
+		log.Printf("[mockstation] create %s: %v \n", p.rec.Path, err)
+		return
+	}
+	defer writer.Close()
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		p.srv.mu.Lock()
+		granted := p.granted
+		if !granted {
+			p.rec.Dropped++
+		}
+		p.srv.mu.Unlock()
+		if !granted {
+			continue
+		}
+
+		if err := writer.WriteRTP(pkt); err != nil {
+			log.Printf("[mockstation] write %s: %v \n", p.rec.Path, err)
+			return
+		}
+
+		p.srv.mu.Lock()
+		if p.rec.Packets == 0 {
+			p.firstTS = pkt.Timestamp
+		}
+		p.lastTS = pkt.Timestamp
+		p.rec.Packets++
+		p.rec.Bytes += len(pkt.Payload)
+		p.rec.Duration = time.Duration(p.lastTS-p.firstTS) * time.Second / 48000
+		p.srv.notifyLocked()
+		p.srv.mu.Unlock()
+	}
+}
+
+// recordVideo counts the frames of a video track and writes VP8 to an IVF file. Like an SFU picking
+// up a stream mid-way, it asks for a keyframe (PLI) once the first packet arrives.
+func (p *publisher) recordVideo(track *webrtc.TrackRemote) {
+	codec := track.Codec().MimeType
+	isVP8 := strings.EqualFold(codec, webrtc.MimeTypeVP8)
+
+	var writer *ivfwriter.IVFWriter
+	if isVP8 {
+		path := filepath.Join(p.srv.outDir, p.head.ChannelId+".ivf")
+		w, err := ivfwriter.New(path)
+		if err != nil {
+			log.Printf("[mockstation] create %s: %v \n", path, err)
+		} else {
+			writer = w
+			defer writer.Close()
+
+			p.srv.mu.Lock()
+			p.rec.VideoPath = path
+			p.srv.mu.Unlock()
+		}
+	}
+
+	p.srv.mu.Lock()
+	p.rec.VideoCodec = codec
+	p.srv.mu.Unlock()
+
+	asked := false
+	startOfFrame := true
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		if !asked {
+			asked = true
+			if err := p.peer.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+				log.Printf("[mockstation] send PLI: %v \n", err)
+			}
+		}
+		if writer != nil {
+			if err := writer.WriteRTP(pkt); err != nil {
+				log.Printf("[mockstation] write video: %v \n", err)
+			}
+		}
+
+		keyframe := false
+		if isVP8 && startOfFrame {
+			var vp8 codecs.VP8Packet
+			if payload, err := vp8.Unmarshal(pkt.Payload); err == nil && vp8.S == 1 && len(payload) > 0 {
+				keyframe = payload[0]&0x01 == 0
+			}
+		}
+		startOfFrame = pkt.Marker
+
+		p.srv.mu.Lock()
+		if pkt.Marker {
+			p.rec.VideoFrames++
+		}
+		if keyframe {
+			p.rec.Keyframes++
+		}
+		p.srv.notifyLocked()
+		p.srv.mu.Unlock()
+	}
+}
@@ -0,0 +1,209 @@
+package radiostation
+
+//go:generate go run ../.. protocol-doc -o ../../docs/radio-station-protocol.md
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// ProtocolVersion is bumped on every change of the message catalogue
+const ProtocolVersion = "1.2"
+
+const (
+	directionToStation   = "bot -> station"
+	directionFromStation = "station -> bot"
+	directionBoth        = "both"
+)
+
+var (
+	ErrUnknownKey     = errors.New("unknown message key")
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// Payload is the typed Value of a WsMsg
+type Payload interface {
+	Key() MessageKey
+	Validate() error
+}
+
+type messageSpec struct {
+	key         MessageKey
+	direction   string
+	description string
+	newPayload  func() Payload
+}
+
+// catalogue lists every message of the protocol, in handshake order
+var catalogue = []messageSpec{
+	{KeySessionPublisher, directionToStation, "Publisher offer, sent on join and again (ICE restart) after a reconnect.", func() Payload { return &SessionPublisher{} }},
+	{KeySdAnswer, directionFromStation, "Station answer to session_publisher.", func() Payload { return new(SdAnswer) }},
+	{KeyIceCandidate, directionBoth, "Trickle ICE candidate.", func() Payload { return &IceCandidate{} }},
+	{KeyConnectPublisher, directionBoth, "Publisher ICE connected; the station echoes it back when the publisher may talk.", func() Payload { return &ConnectPublisher{} }},
+	{KeyPttPublisher, directionToStation, "Push-to-talk state of the publisher.", func() Payload { return &PttPublisher{} }},
+	{KeyLeavePublisher, directionToStation, "Publisher leaves the channel, sent after ptt_publisher with IsTalk false and before the peer closes.", func() Payload { return &LeavePublisher{} }},
+}
+
+func (p *SessionPublisher) Key() MessageKey { return KeySessionPublisher }
+func (p *SessionPublisher) Validate() error {
+	if p.Type != "offer" {
+		return fmt.Errorf("%w: session_publisher type %q, expected offer", ErrInvalidMessage, p.Type)
+	}
+	if p.SDP == "" {
+		return fmt.Errorf("%w: session_publisher without sdp", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func (p *SdAnswer) Key() MessageKey { return KeySdAnswer }
+func (p *SdAnswer) Validate() error {
+	if *p == "" {
+		return fmt.Errorf("%w: empty sd_answer", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func (p *IceCandidate) Key() MessageKey { return KeyIceCandidate }
+func (p *IceCandidate) Validate() error {
+	if p.SDPMid == nil && p.SDPMLineIndex == nil {
+		return fmt.Errorf("%w: ice_candidate without sdpMid and sdpMLineIndex", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func (p *ConnectPublisher) Key() MessageKey { return KeyConnectPublisher }
+func (p *ConnectPublisher) Validate() error {
+	if p.ChannelId == "" {
+		return fmt.Errorf("%w: connect_publisher without ChannelId", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func (p *PttPublisher) Key() MessageKey { return KeyPttPublisher }
+func (p *PttPublisher) Validate() error {
+	if p.ChannelId == "" {
+		return fmt.Errorf("%w: ptt_publisher without ChannelId", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func (p *LeavePublisher) Key() MessageKey { return KeyLeavePublisher }
+func (p *LeavePublisher) Validate() error {
+	if p.ChannelId == "" {
+		return fmt.Errorf("%w: leave_publisher without ChannelId", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func lookupSpec(key MessageKey) (messageSpec, bool) {
+	for _, spec := range catalogue {
+		if spec.key == key {
+			return spec, true
+		}
+	}
+	return messageSpec{}, false
+}
+
+// Encode validates the payload and wraps it into a WsMsg
+func Encode(h Header, p Payload) (*WsMsg, error) {
+	if h.ChannelId == "" || h.UserId == "" {
+		return nil, fmt.Errorf("%w: %s header needs ChannelId and UserId", ErrInvalidMessage, p.Key())
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	value, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WsMsg{
+		Key:         p.Key(),
+		ClanId:      h.ClanId,
+		ChannelId:   h.ChannelId,
+		UserId:      h.UserId,
+		DisplayName: h.DisplayName,
+		Value:       value,
+	}, nil
+}
+
+// Decode returns the typed payload of msg. Keys outside the catalogue return ErrUnknownKey,
+// so callers can log and skip them instead of failing the connection.
+func Decode(msg *WsMsg) (Payload, error) {
+	spec, ok := lookupSpec(msg.Key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, msg.Key)
+	}
+
+	p := spec.newPayload()
+	if err := json.Unmarshal(msg.Value, p); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessage, msg.Key, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// WriteProtocolDoc writes the markdown description of the catalogue
+func WriteProtocolDoc(w io.Writer) error {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "# Radio station signaling protocol v%s\n\n", ProtocolVersion)
+	sb.WriteString("<!-- Code generated by `go generate ./internal/radio-station`. DO NOT EDIT. -->\n\n")
+	sb.WriteString("Every frame is a JSON text message with the envelope below; `Value` carries the payload named by `Key`.\n\n")
+	sb.WriteString("| Field | Type |\n|---|---|\n")
+	writeFields(&sb, reflect.TypeOf(WsMsg{}), false)
+
+	sb.WriteString("\n## Authentication\n\n")
+	sb.WriteString("- static: `wss://<stn>/ws?username=<name>&token=<token>` with the long-lived `TOKEN`.\n")
+	sb.WriteString("- exchange: `POST https://<stn>/<STN_AUTH_PATH>` with `{\"api_key\", \"user_id\", \"username\"}` returns ")
+	sb.WriteString("`{\"token\", \"expires_in\"}`; the socket is dialed with `Authorization: Bearer <token>` and the token is renewed before it expires.\n")
+	fmt.Fprintf(&sb, "- close code `%d` means the token expired: the bot fetches a new token and reconnects.\n", CloseTokenExpired)
+
+	for _, spec := range catalogue {
+		fmt.Fprintf(&sb, "\n## `%s`\n\n%s\n\nDirection: %s\n\n", spec.key, spec.description, spec.direction)
+
+		t := reflect.TypeOf(spec.newPayload()).Elem()
+		if t.Kind() != reflect.Struct {
+			fmt.Fprintf(&sb, "Value: JSON %s\n", t.Kind())
+			continue
+		}
+		sb.WriteString("| Field | Type | Description |\n|---|---|---|\n")
+		writeFields(&sb, t, true)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeFields(sb *strings.Builder, t reflect.Type, withDoc bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+
+		typ := f.Type.Kind().String()
+		switch {
+		case f.Type == reflect.TypeOf(json.RawMessage{}):
+			typ = "payload"
+		case f.Type.Kind() == reflect.Ptr:
+			typ = f.Type.Elem().Kind().String() + " (optional)"
+		}
+
+		if withDoc {
+			fmt.Fprintf(sb, "| `%s` | %s | %s |\n", name, typ, f.Tag.Get("doc"))
+		} else {
+			fmt.Fprintf(sb, "| `%s` | %s |\n", name, typ)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package radiostation
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+)
+
+const (
+	// maxQueuedMessages bounds the outbound signaling kept while the socket is slow or down
+	maxQueuedMessages = 256
+	// maxSendAttempts is how many broken writes a message survives before it is dropped
+	maxSendAttempts = 5
+)
+
+var (
+	ErrQueueFull         = errors.New("radio station send queue full")
+	ErrRetriesExhausted  = errors.New("radio station send retries exhausted")
+	ErrMessageSuperseded = errors.New("radio station message superseded by a newer offer")
+)
+
+// signalingStats is published with expvar (GET /admin/vars), a growing dropped_* count means signaling
+// is being lost. queue_depth holds the depth of each station connection.
+var (
+	signalingStats = expvar.NewMap("radio_station_signaling")
+	queueDepths    = new(expvar.Map)
+)
+
+func init() {
+	signalingStats.Set("queue_depth", queueDepths)
+}
+
+type Priority int
+
+const (
+	// PriorityLow is for ICE candidates: plentiful and redundant, dropped first
+	PriorityLow Priority = iota
+	// PriorityNormal is for publisher state (connect, ptt)
+	PriorityNormal
+	// PriorityHigh is for offers: without them nothing else makes sense, sent first
+	PriorityHigh
+)
+
+func priorityOf(key MessageKey) Priority {
+	switch key {
+	case KeySessionPublisher:
+		return PriorityHigh
+	case KeyIceCandidate:
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+type queuedMessage struct {
+	msg         *WsMsg
+	priority    Priority
+	seq         uint64
+	attempts    int
+	onDelivered func(err error)
+}
+
+func (m *queuedMessage) finish(err error) {
+	if m.onDelivered != nil {
+		m.onDelivered(err)
+	}
+}
+
+// sendQueue orders outbound messages by priority then arrival, and applies backpressure when full
+type sendQueue struct {
+	name  string      // of the connection in queue_depth
+	depth *expvar.Int // published in queue_depth until the queue is closed
+
+	mu     sync.Mutex
+	items  []*queuedMessage
+	seq    uint64
+	closed error // set by close, later messages fail with it
+	wake   chan struct{}
+}
+
+func newSendQueue(name string) *sendQueue {
+	q := &sendQueue{name: name, depth: new(expvar.Int), wake: make(chan struct{}, 1)}
+	queueDepths.Set(name, q.depth)
+	return q
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push enqueues msg. When the queue is full the oldest message of a lower priority is evicted,
+// otherwise msg itself is rejected with ErrQueueFull.
+func (q *sendQueue) push(msg *WsMsg, onDelivered func(err error)) error {
+	item := &queuedMessage{msg: msg, priority: priorityOf(msg.Key), onDelivered: onDelivered}
+
+	var dropped []*queuedMessage
+	var dropErr error
+
+	q.mu.Lock()
+	if q.closed != nil {
+		err := q.closed
+		q.mu.Unlock()
+		item.finish(err)
+		return err
+	}
+
+	// a new offer makes queued offers and candidates of the same session stale
+	if item.priority == PriorityHigh {
+		kept := q.items[:0]
+		for _, m := range q.items {
+			if m.msg.ChannelId == msg.ChannelId && m.msg.UserId == msg.UserId &&
+				(m.msg.Key == KeySessionPublisher || m.msg.Key == KeyIceCandidate) {
+				dropped = append(dropped, m)
+				continue
+			}
+			kept = append(kept, m)
+		}
+		q.items = kept
+		dropErr = ErrMessageSuperseded
+		signalingStats.Add("superseded", int64(len(dropped)))
+	}
+
+	evicted, ok := q.makeRoomLocked(item)
+	if !ok {
+		q.mu.Unlock()
+		q.finish(dropped, dropErr)
+		item.finish(ErrQueueFull)
+		return ErrQueueFull
+	}
+
+	q.seq++
+	item.seq = q.seq
+	q.items = append(q.items, item)
+	q.depth.Set(int64(len(q.items)))
+	q.mu.Unlock()
+
+	q.finish(dropped, dropErr)
+	if evicted != nil {
+		evicted.finish(ErrQueueFull)
+	}
+	q.signal()
+	return nil
+}
+
+// makeRoomLocked keeps the queue within maxQueuedMessages before item goes in: when full, the oldest
+// message of a lower priority is evicted and returned. It reports false when item has to be rejected.
+func (q *sendQueue) makeRoomLocked(item *queuedMessage) (*queuedMessage, bool) {
+	if len(q.items) < maxQueuedMessages {
+		return nil, true
+	}
+
+	signalingStats.Add("dropped_full", 1)
+	victim := q.lowestLocked()
+	if victim < 0 || q.items[victim].priority >= item.priority {
+		log.Printf("radio station send queue full, reject %q \n", item.msg.Key)
+		return nil, false
+	}
+
+	evicted := q.items[victim]
+	q.items = append(q.items[:victim], q.items[victim+1:]...)
+	log.Printf("radio station send queue full, evict %q \n", evicted.msg.Key)
+	return evicted, true
+}
+
+func (q *sendQueue) finish(items []*queuedMessage, err error) {
+	for _, m := range items {
+		m.finish(err)
+	}
+}
+
+// lowestLocked returns the index of the oldest message with the lowest priority
+func (q *sendQueue) lowestLocked() int {
+	idx := -1
+	for i, m := range q.items {
+		if idx < 0 || m.priority < q.items[idx].priority {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// pop returns the oldest message with the highest priority, nil when empty
+func (q *sendQueue) pop() *queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := -1
+	for i, m := range q.items {
+		if idx < 0 || m.priority > q.items[idx].priority ||
+			(m.priority == q.items[idx].priority && m.seq < q.items[idx].seq) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+
+	item := q.items[idx]
+	q.items = append(q.items[:idx], q.items[idx+1:]...)
+	q.depth.Set(int64(len(q.items)))
+	return item
+}
+
+// retry puts back a message whose write failed, keeping its place in line. It is bounded like push.
+func (q *sendQueue) retry(item *queuedMessage) {
+	item.attempts++
+	if item.attempts >= maxSendAttempts {
+		signalingStats.Add("dropped_retries", 1)
+		log.Printf("radio station drop %q after %d attempts \n", item.msg.Key, item.attempts)
+		item.finish(ErrRetriesExhausted)
+		return
+	}
+
+	q.mu.Lock()
+	if q.closed != nil {
+		err := q.closed
+		q.mu.Unlock()
+		item.finish(err)
+		return
+	}
+	evicted, ok := q.makeRoomLocked(item)
+	if ok {
+		signalingStats.Add("retried", 1)
+		q.items = append(q.items, item)
+		q.depth.Set(int64(len(q.items)))
+	}
+	q.mu.Unlock()
+
+	if evicted != nil {
+		evicted.finish(ErrQueueFull)
+	}
+	if !ok {
+		item.finish(ErrQueueFull)
+	}
+}
+
+// close fails every queued message and the ones pushed later with err, used on Close and once the
+// station is gone for good
+func (q *sendQueue) close(err error) {
+	q.mu.Lock()
+	if q.closed != nil {
+		q.mu.Unlock()
+		return
+	}
+	items := q.items
+	q.items = nil
+	q.closed = err
+	q.mu.Unlock()
+
+	// a newer connection may publish under the same name already
+	if queueDepths.Get(q.name) == q.depth {
+		queueDepths.Delete(q.name)
+	}
+	q.finish(items, err)
+}
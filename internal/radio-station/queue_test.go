@@ -0,0 +1,240 @@
+package radiostation
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// delivery records how each message of a queue finished, by name
+type delivery map[string]error
+
+func (d delivery) push(t *testing.T, q *sendQueue, name string, key MessageKey, channelId string) error {
+	t.Helper()
+	msg := &WsMsg{Key: key, ChannelId: channelId, UserId: "bot", DisplayName: name}
+	return q.push(msg, func(err error) { d[name] = err })
+}
+
+func popAll(q *sendQueue) []string {
+	var names []string
+	for m := q.pop(); m != nil; m = q.pop() {
+		names = append(names, m.msg.DisplayName)
+	}
+	return names
+}
+
+func newTestQueue(t *testing.T) *sendQueue {
+	t.Helper()
+	q := newSendQueue(t.Name())
+	t.Cleanup(func() { q.close(ErrConnectionClosed) })
+	return q
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	type message struct {
+		name      string
+		key       MessageKey
+		channelId string
+	}
+	tests := []struct {
+		name       string
+		messages   []message
+		order      []string
+		superseded []string
+	}{
+		{
+			name: "priority then arrival",
+			messages: []message{
+				{"candidate 1", KeyIceCandidate, "a"},
+				{"ptt", KeyPttPublisher, "a"},
+				{"offer", KeySessionPublisher, "a"},
+				{"candidate 2", KeyIceCandidate, "a"},
+				{"connect", KeyConnectPublisher, "b"},
+			},
+			order:      []string{"offer", "ptt", "connect", "candidate 2"},
+			superseded: []string{"candidate 1"},
+		},
+		{
+			name: "new offer supersedes the session",
+			messages: []message{
+				{"offer 1", KeySessionPublisher, "a"},
+				{"candidate 1", KeyIceCandidate, "a"},
+				{"connect", KeyConnectPublisher, "a"},
+				{"other offer", KeySessionPublisher, "b"},
+				{"other candidate", KeyIceCandidate, "b"},
+				{"offer 2", KeySessionPublisher, "a"},
+				{"candidate 2", KeyIceCandidate, "a"},
+			},
+			order:      []string{"other offer", "offer 2", "connect", "other candidate", "candidate 2"},
+			superseded: []string{"offer 1", "candidate 1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			d := delivery{}
+			for _, m := range tt.messages {
+				if err := d.push(t, q, m.name, m.key, m.channelId); err != nil {
+					t.Fatalf("push %s: %v", m.name, err)
+				}
+			}
+
+			if got := popAll(q); fmt.Sprint(got) != fmt.Sprint(tt.order) {
+				t.Errorf("sent %q, want %q", got, tt.order)
+			}
+			for _, name := range tt.superseded {
+				if err, ok := d[name]; !ok || !errors.Is(err, ErrMessageSuperseded) {
+					t.Errorf("%s finished with %v, want ErrMessageSuperseded", name, err)
+				}
+			}
+			if len(d) != len(tt.superseded) {
+				t.Errorf("finished %v, only the superseded should be", d)
+			}
+		})
+	}
+}
+
+func TestSendQueueBound(t *testing.T) {
+	q := newTestQueue(t)
+	d := delivery{}
+	for i := range maxQueuedMessages - 1 {
+		if err := d.push(t, q, fmt.Sprint("candidate ", i), KeyIceCandidate, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.push(t, q, "ptt", KeyPttPublisher, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// full: a candidate is rejected, higher priorities evict the oldest candidate
+	if err := d.push(t, q, "late candidate", KeyIceCandidate, "a"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("late candidate: %v, want ErrQueueFull", err)
+	}
+	if !errors.Is(d["late candidate"], ErrQueueFull) {
+		t.Errorf("late candidate finished with %v", d["late candidate"])
+	}
+	if err := d.push(t, q, "connect", KeyConnectPublisher, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(d["candidate 0"], ErrQueueFull) {
+		t.Errorf("oldest candidate finished with %v, want evicted", d["candidate 0"])
+	}
+	if n := len(q.items); n != maxQueuedMessages {
+		t.Fatalf("%d queued", n)
+	}
+	if q.depth.Value() != maxQueuedMessages {
+		t.Errorf("queue depth %d", q.depth.Value())
+	}
+
+	// a failed write goes back in line without growing the queue past the bound
+	ptt := q.pop()
+	if ptt.msg.DisplayName != "ptt" {
+		t.Fatalf("popped %s first", ptt.msg.DisplayName)
+	}
+	if err := d.push(t, q, "connect 2", KeyConnectPublisher, "c"); err != nil {
+		t.Fatal(err)
+	}
+	q.retry(ptt)
+	if n := len(q.items); n != maxQueuedMessages {
+		t.Errorf("%d queued after the retry", n)
+	}
+	if !errors.Is(d["candidate 1"], ErrQueueFull) {
+		t.Errorf("candidate 1 finished with %v, want evicted by the retry", d["candidate 1"])
+	}
+	if _, done := d["ptt"]; done {
+		t.Errorf("retried ptt finished with %v", d["ptt"])
+	}
+	if first := q.pop(); first.msg.DisplayName != "ptt" {
+		t.Errorf("popped %s, the retry keeps its place", first.msg.DisplayName)
+	}
+}
+
+func TestSendQueueRetryRejectedWhenFull(t *testing.T) {
+	q := newTestQueue(t)
+	d := delivery{}
+	for i := range maxQueuedMessages {
+		if err := d.push(t, q, fmt.Sprint("ptt ", i), KeyPttPublisher, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidate := &queuedMessage{msg: &WsMsg{Key: KeyIceCandidate}, priority: PriorityLow,
+		onDelivered: func(err error) { d["candidate"] = err }}
+
+	q.retry(candidate)
+	if !errors.Is(d["candidate"], ErrQueueFull) {
+		t.Errorf("retry into a full queue finished with %v", d["candidate"])
+	}
+	if n := len(q.items); n != maxQueuedMessages {
+		t.Errorf("%d queued", n)
+	}
+
+	candidate.attempts = maxSendAttempts - 1
+	q.pop()
+	q.retry(candidate)
+	if !errors.Is(d["candidate"], ErrRetriesExhausted) {
+		t.Errorf("last attempt finished with %v", d["candidate"])
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := newSendQueue(t.Name())
+	if queueDepths.Get(t.Name()) == nil {
+		t.Fatal("queue depth not published")
+	}
+	d := delivery{}
+	if err := d.push(t, q, "offer", KeySessionPublisher, "a"); err != nil {
+		t.Fatal(err)
+	}
+	retried := q.pop()
+
+	q.close(ErrDisconnected)
+	q.close(ErrConnectionClosed)
+	q.retry(retried)
+	if err := d.push(t, q, "ptt", KeyPttPublisher, "a"); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("push after close: %v", err)
+	}
+
+	for _, name := range []string{"offer", "ptt"} {
+		if !errors.Is(d[name], ErrDisconnected) {
+			t.Errorf("%s finished with %v, want ErrDisconnected", name, d[name])
+		}
+	}
+	if q.pop() != nil {
+		t.Error("closed queue not empty")
+	}
+	if queueDepths.Get(t.Name()) != nil {
+		t.Error("queue depth still published")
+	}
+}
+
+func TestSendQueueDepthPerConnection(t *testing.T) {
+	first := newTestQueue(t)
+	second := newSendQueue("other " + t.Name())
+	defer second.close(ErrConnectionClosed)
+
+	d := delivery{}
+	for _, name := range []string{"ptt", "connect"} {
+		if err := d.push(t, first, name, KeyPttPublisher, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.push(t, second, "ptt", KeyPttPublisher, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queueDepths.Get(t.Name()).String(); got != "2" {
+		t.Errorf("first queue depth %s", got)
+	}
+	if got := queueDepths.Get("other " + t.Name()).String(); got != "1" {
+		t.Errorf("second queue depth %s", got)
+	}
+
+	// a connection replaced under the same name keeps publishing the depth of the new one
+	replaced := newSendQueue(t.Name())
+	defer replaced.close(ErrConnectionClosed)
+	first.close(ErrConnectionClosed)
+	if queueDepths.Get(t.Name()) != replaced.depth {
+		t.Error("closing the old queue removed the depth of the new one")
+	}
+}
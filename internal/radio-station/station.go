@@ -0,0 +1,255 @@
+package radiostation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/nccasia/mezon-go-sdk/configs"
+)
+
+var ErrSessionExists = errors.New("radio station session already open for this channel")
+
+var (
+	stationsMu sync.Mutex
+	stations   = make(map[string]*station) // map[domain|userId]*station
+)
+
+// station is one long-lived websocket to a station domain, shared by every channel session of a bot
+type station struct {
+	key  string
+	conn IWSConnection
+
+	mu       sync.RWMutex
+	sessions map[string]*session // map[channelId/userId]*session
+}
+
+// session is the IWSConnection of a single channel publisher on a shared station
+type session struct {
+	station   *station
+	route     string
+	clanId    string
+	channelId string
+	userId    string
+
+	mu            sync.RWMutex
+	closed        bool
+	onMessage     func(*WsMsg) error
+	onReconnect   func()
+	onDisconnect  func(err error)
+	onStateChange func(ConnectionState)
+}
+
+var _ IWSConnection = (*session)(nil)
+
+func routeKey(channelId, userId string) string {
+	return channelId + "/" + userId
+}
+
+// Join opens a channel session on the shared connection of the station domain, dialing it on first use.
+// The connection is closed when the last session is closed.
+func Join(c *configs.Config, clanId, channelId, userId, username, token string, opts ...Option) (IWSConnection, error) {
+	stationsMu.Lock()
+	defer stationsMu.Unlock()
+
+	key := fmt.Sprintf("%s|%s", c.BasePath, userId)
+	st, ok := stations[key]
+	if !ok {
+		conn, err := NewWSConnection(c, clanId, channelId, userId, username, token, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		st = &station{
+			key:      key,
+			conn:     conn,
+			sessions: make(map[string]*session),
+		}
+		conn.SetOnMessage(st.route)
+		conn.SetOnReconnect(st.onReconnect)
+		conn.SetOnDisconnect(st.onDisconnect)
+		conn.SetOnStateChange(st.onStateChange)
+		stations[key] = st
+	}
+
+	route := routeKey(channelId, userId)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, exists := st.sessions[route]; exists {
+		return nil, fmt.Errorf("%w: %s", ErrSessionExists, channelId)
+	}
+
+	sess := &session{
+		station:       st,
+		route:         route,
+		clanId:        clanId,
+		channelId:     channelId,
+		userId:        userId,
+		onMessage:     recvDefaultHandler,
+		onReconnect:   func() {},
+		onDisconnect:  func(error) {},
+		onStateChange: func(ConnectionState) {},
+	}
+	st.sessions[route] = sess
+
+	return sess, nil
+}
+
+// route hands an incoming message to the session of its channel (and user when the station sets it)
+func (st *station) route(msg *WsMsg) error {
+	st.mu.RLock()
+	sess, ok := st.sessions[routeKey(msg.ChannelId, msg.UserId)]
+	if !ok {
+		for _, s := range st.sessions {
+			if s.channelId == msg.ChannelId {
+				sess, ok = s, true
+				break
+			}
+		}
+	}
+	st.mu.RUnlock()
+
+	if !ok {
+		log.Printf("radio station: no session for %q on channel %s \n", msg.Key, msg.ChannelId)
+		return nil
+	}
+
+	sess.mu.RLock()
+	handler := sess.onMessage
+	sess.mu.RUnlock()
+	return handler(msg)
+}
+
+func (st *station) snapshot() []*session {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	list := make([]*session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+func (st *station) onReconnect() {
+	for _, s := range st.snapshot() {
+		s.mu.RLock()
+		handler := s.onReconnect
+		s.mu.RUnlock()
+		handler()
+	}
+}
+
+func (st *station) onDisconnect(err error) {
+	// the connection is dead, the next Join must dial again
+	stationsMu.Lock()
+	if stations[st.key] == st {
+		delete(stations, st.key)
+	}
+	stationsMu.Unlock()
+
+	for _, s := range st.snapshot() {
+		s.mu.RLock()
+		handler := s.onDisconnect
+		s.mu.RUnlock()
+		handler(err)
+	}
+}
+
+func (st *station) onStateChange(state ConnectionState) {
+	for _, s := range st.snapshot() {
+		s.mu.RLock()
+		handler := s.onStateChange
+		s.mu.RUnlock()
+		handler(state)
+	}
+}
+
+// release drops a session and closes the shared connection with the last one
+func (st *station) release(sess *session) error {
+	stationsMu.Lock()
+	defer stationsMu.Unlock()
+
+	st.mu.Lock()
+	if st.sessions[sess.route] == sess {
+		delete(st.sessions, sess.route)
+	}
+	remaining := len(st.sessions)
+	st.mu.Unlock()
+
+	if remaining > 0 {
+		return nil
+	}
+
+	if stations[st.key] == st {
+		delete(stations, st.key)
+	}
+	return st.conn.Close()
+}
+
+func (s *session) SendMessage(data *WsMsg) error {
+	return s.SendAsync(data, nil)
+}
+
+func (s *session) SendAsync(data *WsMsg, onDelivered func(err error)) error {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		if onDelivered != nil {
+			onDelivered(ErrConnectionClosed)
+		}
+		return ErrConnectionClosed
+	}
+
+	return s.station.conn.SendAsync(data, onDelivered)
+}
+
+func (s *session) State() ConnectionState {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return StateClosed
+	}
+
+	return s.station.conn.State()
+}
+
+func (s *session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	return s.station.release(s)
+}
+
+func (s *session) SetOnMessage(recvHandler func(*WsMsg) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onMessage = recvHandler
+}
+
+func (s *session) SetOnReconnect(handler func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReconnect = handler
+}
+
+func (s *session) SetOnDisconnect(handler func(err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDisconnect = handler
+}
+
+func (s *session) SetOnStateChange(handler func(ConnectionState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStateChange = handler
+}
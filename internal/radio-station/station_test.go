@@ -0,0 +1,175 @@
+package radiostation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nccasia/mezon-go-sdk/configs"
+)
+
+// fakeConn stands in for the socket of a station, it keeps what was sent
+type fakeConn struct {
+	sent   []*WsMsg
+	closed bool
+
+	onMessage    func(*WsMsg) error
+	onDisconnect func(err error)
+}
+
+func (c *fakeConn) SetOnMessage(handler func(*WsMsg) error)        { c.onMessage = handler }
+func (c *fakeConn) SetOnReconnect(handler func())                  {}
+func (c *fakeConn) SetOnDisconnect(handler func(err error))        { c.onDisconnect = handler }
+func (c *fakeConn) SetOnStateChange(handler func(ConnectionState)) {}
+func (c *fakeConn) State() ConnectionState                         { return StateConnected }
+func (c *fakeConn) SendMessage(data *WsMsg) error                  { return c.SendAsync(data, nil) }
+
+func (c *fakeConn) SendAsync(data *WsMsg, onDelivered func(err error)) error {
+	c.sent = append(c.sent, data)
+	if onDelivered != nil {
+		onDelivered(nil)
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// newTestStation registers a station on a fake socket, Join uses it instead of dialing
+func newTestStation(t *testing.T) (*configs.Config, *station, *fakeConn) {
+	t.Helper()
+	c := &configs.Config{BasePath: t.Name()}
+	conn := &fakeConn{}
+	st := &station{key: c.BasePath + "|bot", conn: conn, sessions: make(map[string]*session)}
+	conn.SetOnMessage(st.route)
+	conn.SetOnDisconnect(st.onDisconnect)
+
+	stationsMu.Lock()
+	stations[st.key] = st
+	stationsMu.Unlock()
+	t.Cleanup(func() {
+		stationsMu.Lock()
+		delete(stations, st.key)
+		stationsMu.Unlock()
+	})
+	return c, st, conn
+}
+
+func joinTest(t *testing.T, c *configs.Config, channelId string) (IWSConnection, *[]*WsMsg) {
+	t.Helper()
+	sess, err := Join(c, "clan", channelId, "bot", "bot", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []*WsMsg
+	sess.SetOnMessage(func(msg *WsMsg) error {
+		received = append(received, msg)
+		return nil
+	})
+	return sess, &received
+}
+
+func TestStationRoutesByChannel(t *testing.T) {
+	c, _, conn := newTestStation(t)
+	_, music := joinTest(t, c, "music")
+	_, news := joinTest(t, c, "news")
+
+	tests := []struct {
+		name string
+		msg  WsMsg
+		to   *[]*WsMsg // nil when no session gets it
+	}{
+		{name: "channel and user", msg: WsMsg{Key: KeySdAnswer, ChannelId: "music", UserId: "bot"}, to: music},
+		{name: "other channel", msg: WsMsg{Key: KeySdAnswer, ChannelId: "news", UserId: "bot"}, to: news},
+		{name: "station without user", msg: WsMsg{Key: KeyIceCandidate, ChannelId: "news"}, to: news},
+		{name: "no session", msg: WsMsg{Key: KeySdAnswer, ChannelId: "sports", UserId: "bot"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := [2]int{len(*music), len(*news)}
+			if err := conn.onMessage(&tt.msg); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, received := range []*[]*WsMsg{music, news} {
+				want := before[i]
+				if received == tt.to {
+					want++
+				}
+				if len(*received) != want {
+					t.Errorf("session %d got %d messages, want %d", i, len(*received), want)
+				}
+			}
+		})
+	}
+}
+
+func TestStationSharedUntilLastSession(t *testing.T) {
+	c, st, conn := newTestStation(t)
+	music, _ := joinTest(t, c, "music")
+	news, _ := joinTest(t, c, "news")
+
+	if _, err := Join(c, "clan", "music", "bot", "bot", "token"); !errors.Is(err, ErrSessionExists) {
+		t.Errorf("second session of a channel: %v", err)
+	}
+
+	if err := music.SendMessage(&WsMsg{Key: KeyPttPublisher, ChannelId: "music"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := music.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := music.SendMessage(&WsMsg{Key: KeyPttPublisher, ChannelId: "music"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("send on a closed session: %v", err)
+	}
+	if music.State() != StateClosed || news.State() != StateConnected {
+		t.Errorf("states %s and %s after closing one session", music.State(), news.State())
+	}
+	if conn.closed || len(conn.sent) != 1 {
+		t.Fatalf("socket closed %v with %d sent, while a session is open", conn.closed, len(conn.sent))
+	}
+
+	// the channel can join again on the same socket
+	again, _ := joinTest(t, c, "music")
+	if again.(*session).station != st {
+		t.Error("joined a new station while one is open")
+	}
+
+	again.Close()
+	news.Close()
+	news.Close()
+	if !conn.closed {
+		t.Error("socket open after the last session closed")
+	}
+	stationsMu.Lock()
+	_, registered := stations[st.key]
+	stationsMu.Unlock()
+	if registered {
+		t.Error("closed station still registered")
+	}
+}
+
+func TestStationDisconnectTellsSessions(t *testing.T) {
+	c, st, conn := newTestStation(t)
+
+	var disconnected []string
+	for _, channelId := range []string{"music", "news"} {
+		sess, _ := joinTest(t, c, channelId)
+		sess.SetOnDisconnect(func(err error) {
+			disconnected = append(disconnected, channelId)
+		})
+	}
+
+	conn.onDisconnect(ErrDisconnected)
+	if len(disconnected) != 2 {
+		t.Errorf("disconnected %v", disconnected)
+	}
+	stationsMu.Lock()
+	registered := stations[st.key] == st
+	stationsMu.Unlock()
+	if registered {
+		t.Error("dead station still registered, the next Join would use it")
+	}
+}
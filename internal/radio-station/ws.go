@@ -3,54 +3,162 @@ package radiostation
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/nccasia/mezon-go-sdk/configs"
 	"github.com/nccasia/mezon-go-sdk/utils"
 )
 
+const (
+	reconnectMinDelay    = 500 * time.Millisecond
+	reconnectMaxDelay    = 30 * time.Second
+	reconnectMaxAttempts = 20
+
+	DefaultPingInterval = 15 * time.Second
+	DefaultPongTimeout  = 10 * time.Second
+	writeTimeout        = 5 * time.Second
+)
+
+var (
+	ErrConnectionClosed = errors.New("radio station connection closed")
+	// ErrDisconnected is returned for messages sent after reconnecting gave up
+	ErrDisconnected = errors.New("radio station disconnected")
+)
+
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	// StateDisconnected means the station is gone for good: reconnect gave up or the error is not recoverable
+	StateDisconnected
+	// StateClosed means Close was called
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type Option func(*WSConnection)
+
+// WithKeepalive pings the station every interval, the connection is considered dead
+// when no pong (or any other frame) arrives within interval+timeout.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(s *WSConnection) {
+		if interval > 0 {
+			s.pingInterval = interval
+		}
+		if timeout > 0 {
+			s.pongTimeout = timeout
+		}
+	}
+}
+
+// WithTokenSource replaces the static token passed to NewWSConnection
+func WithTokenSource(tokens TokenSource, inHeader bool) Option {
+	return func(s *WSConnection) {
+		s.tokens = tokens
+		s.tokenInHeader = inHeader
+	}
+}
+
 func recvDefaultHandler(e *WsMsg) error {
 	return nil
 }
 
 type WSConnection struct {
-	conn      *websocket.Conn
-	dialer    *websocket.Dialer
-	basePath  string
-	token     string
-	clanId    string
-	channelId string
-	userId    string
-	username  string
-	mu        sync.Mutex
-	onMessage func(*WsMsg) error
+	conn     *websocket.Conn
+	dialer   *websocket.Dialer
+	basePath string
+	tokens   TokenSource
+	// tokenInHeader sends the token as an Authorization header instead of the query string
+	tokenInHeader bool
+	clanId        string
+	channelId     string
+	userId        string
+	username      string
+
+	mu        sync.Mutex // guards conn writes and connected
+	connected bool
+	queue     *sendQueue
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	missedPongs  atomic.Int32
+
+	// stateMu guards the state and the handlers, the owner sets them while the read loop calls them
+	stateMu       sync.Mutex
+	state         ConnectionState
+	onStateChange func(ConnectionState)
+	onMessage     func(*WsMsg) error
+	onReconnect   func()
+	onDisconnect  func(err error)
 }
 
 type IWSConnection interface {
 	SetOnMessage(recvHandler func(*WsMsg) error)
+	// SetOnReconnect is called after the socket came back, queued messages are replayed in priority order
+	SetOnReconnect(handler func())
+	// SetOnDisconnect is called once reconnecting gave up, the connection is unusable afterwards
+	SetOnDisconnect(handler func(err error))
+	// SetOnStateChange is called on every connection state transition
+	SetOnStateChange(handler func(ConnectionState))
+	State() ConnectionState
+	// SendMessage queues data for delivery, it fails when the queue rejects it or the station is gone
 	SendMessage(data *WsMsg) error
+	// SendAsync is SendMessage with a callback once data is written or dropped
+	SendAsync(data *WsMsg, onDelivered func(err error)) error
+	Close() error
 }
 
-// TODO: implement (TODO) for IWSConnection
-
-func NewWSConnection(c *configs.Config, clanId, channelId, userId, username, token string) (IWSConnection, error) {
-
-	// TODO: authenticate token for ws
-	// token, err := getAuthenticate(c)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
+func NewWSConnection(c *configs.Config, clanId, channelId, userId, username, token string, opts ...Option) (IWSConnection, error) {
 	client := &WSConnection{
 		username: username,
-		token:    token,
+		tokens:   NewStaticTokenSource(token),
 		basePath: utils.GetBasePath("wss", c.BasePath, c.UseSSL),
 		// basePath:  utils.GetBasePath("ws", c.BasePath, c.UseSSL),
-		clanId:    clanId,
-		onMessage: recvDefaultHandler,
+		clanId:        clanId,
+		channelId:     channelId,
+		userId:        userId,
+		done:          make(chan struct{}),
+		queue:         newSendQueue(fmt.Sprintf("%s|%s", c.BasePath, userId)),
+		pingInterval:  DefaultPingInterval,
+		pongTimeout:   DefaultPongTimeout,
+		state:         StateConnecting,
+		onStateChange: func(ConnectionState) {},
+		onMessage:     recvDefaultHandler,
+		onReconnect:   func() {},
+		onDisconnect:  func(error) {},
+	}
+
+	for _, opt := range opts {
+		opt(client)
 	}
 
 	if c.InsecureSkip {
@@ -72,61 +180,318 @@ func NewWSConnection(c *configs.Config, clanId, channelId, userId, username, tok
 }
 
 func (s *WSConnection) newWSConnection() error {
-
-	// TODO: authenticate token for ws
-	conn, _, err := s.dialer.Dial(fmt.Sprintf("%s/ws?username=%s&token=%s", s.basePath, s.username, s.token), nil)
+	conn, err := s.dial()
 	if err != nil {
 		log.Println("WebSocket connection open err: ", err)
 		return err
 	}
 
 	s.conn = conn
+	s.connected = true
+	s.setState(StateConnected)
 
-	s.reconnect()
 	s.pingPong()
+	s.sendLoop()
 	s.recvMessage()
 
 	return nil
 }
 
+func (s *WSConnection) State() ConnectionState {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.state
+}
+
+func (s *WSConnection) setState(state ConnectionState) {
+	s.stateMu.Lock()
+	if s.state == state || s.state == StateClosed {
+		s.stateMu.Unlock()
+		return
+	}
+	s.state = state
+	handler := s.onStateChange
+	s.stateMu.Unlock()
+
+	handler(state)
+}
+
+func (s *WSConnection) dial() (*websocket.Conn, error) {
+	token, err := s.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"username": {s.username}}
+	header := http.Header{}
+	if s.tokenInHeader {
+		header.Set("Authorization", "Bearer "+token.Value)
+	} else {
+		query.Set("token", token.Value)
+	}
+
+	conn, resp, err := s.dialer.Dial(fmt.Sprintf("%s/ws?%s", s.basePath, query.Encode()), header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			// next attempt fetches a fresh token
+			s.tokens.Invalidate()
+			return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return nil, err
+	}
+
+	// any frame from the station proves it is alive, a pong only extends the deadline when nothing else arrives
+	s.missedPongs.Store(0)
+	conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		s.missedPongs.Store(0)
+		return conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.pongTimeout))
+	})
+
+	return conn, nil
+}
+
 func (s *WSConnection) Close() error {
-	return s.conn.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		s.setState(StateClosed)
+		close(s.done)
+
+		s.mu.Lock()
+		s.connected = false
+		err = s.conn.Close()
+		s.mu.Unlock()
+
+		s.queue.close(ErrConnectionClosed)
+	})
+	return err
+}
+
+func (s *WSConnection) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *WSConnection) SendMessage(data *WsMsg) error {
+	return s.SendAsync(data, nil)
+}
+
+// SendAsync queues data, the send loop writes it as soon as the socket is up.
+// onDelivered gets nil once written, or why the message was dropped.
+func (s *WSConnection) SendAsync(data *WsMsg, onDelivered func(err error)) error {
+	if s.isClosed() {
+		if onDelivered != nil {
+			onDelivered(ErrConnectionClosed)
+		}
+		return ErrConnectionClosed
+	}
+	if s.State() == StateDisconnected {
+		if onDelivered != nil {
+			onDelivered(ErrDisconnected)
+		}
+		return ErrDisconnected
+	}
+
+	return s.queue.push(data, onDelivered)
+}
+
+// sendLoop writes queued messages while connected. A failed write puts the message back
+// and breaks the socket, so the read loop reconnects and the loop resumes afterwards.
+func (s *WSConnection) sendLoop() {
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.queue.wake:
+			}
+
+			for s.sendNext() {
+			}
+		}
+	}()
+}
+
+// sendNext writes one message, it reports false when there is nothing more to do for now
+func (s *WSConnection) sendNext() bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if !s.connected {
+		s.mu.Unlock()
+		return false
+	}
+
+	item := s.queue.pop()
+	if item == nil {
+		s.mu.Unlock()
+		return false
+	}
+
+	if err := s.write(item.msg); err != nil {
+		log.Println("WebSocket write err, retry after reconnect: ", err)
+		s.connected = false
+		s.conn.Close()
+		s.mu.Unlock()
+
+		s.queue.retry(item)
+		return false
+	}
+	s.mu.Unlock()
 
+	signalingStats.Add("sent", 1)
+	item.finish(nil)
+	return true
+}
+
+// write must be called with mu held
+func (s *WSConnection) write(data *WsMsg) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	return s.conn.WriteMessage(websocket.TextMessage, jsonData)
 }
 
+// pingPong sends a ping every pingInterval for the whole life of the connection, across reconnects.
+// Missed pongs surface as a read deadline error in recvMessage, which then reconnects.
 func (s *WSConnection) pingPong() {
-	// Ping Handler
-	// TODO:
+	go func() {
+		ticker := time.NewTicker(s.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+
+			s.mu.Lock()
+			if !s.connected {
+				s.mu.Unlock()
+				continue
+			}
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			s.mu.Unlock()
+
+			if missed := s.missedPongs.Add(1); missed > 1 {
+				log.Printf("WebSocket missed %d pong(s) \n", missed-1)
+			}
+			if err != nil {
+				log.Println("WebSocket ping err: ", err)
+			}
+		}
+	}()
+}
+
+// isRecoverable reports whether reconnecting can help after a read error.
+// The station rejecting the bot (policy, auth) will not change by dialing again.
+func isRecoverable(err error) bool {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case CloseTokenExpired:
+			return true
+		case websocket.CloseNormalClosure, websocket.ClosePolicyViolation, websocket.CloseUnsupportedData,
+			websocket.CloseInvalidFramePayloadData, websocket.CloseMessageTooBig:
+			return false
+		}
+	}
+	return true
 }
 
-func (s *WSConnection) reconnect() {
-	// TODO:
+// reconnect dials again with exponential backoff, resumes the send queue and
+// notifies the owner so it can renegotiate its session.
+func (s *WSConnection) reconnect() error {
+	s.mu.Lock()
+	s.connected = false
+	s.conn.Close()
+	s.mu.Unlock()
+	s.setState(StateReconnecting)
+
+	delay := reconnectMinDelay
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		// full jitter keeps many bots from reconnecting in lockstep after a station restart
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-s.done:
+			return ErrConnectionClosed
+		case <-time.After(wait):
+		}
+
+		conn, err := s.dial()
+		if err != nil {
+			log.Printf("WebSocket reconnect attempt %d/%d err: %v \n", attempt, reconnectMaxAttempts, err)
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		if s.isClosed() {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrConnectionClosed
+		}
+		s.conn = conn
+		s.connected = true
+		s.mu.Unlock()
+		s.queue.signal()
+		s.setState(StateConnected)
+
+		log.Printf("WebSocket reconnected after %d attempt(s) \n", attempt)
+		s.stateMu.Lock()
+		onReconnect := s.onReconnect
+		s.stateMu.Unlock()
+		onReconnect()
+		return nil
+	}
+
+	return fmt.Errorf("reconnect failed after %d attempts", reconnectMaxAttempts)
 }
 
 func (s *WSConnection) recvMessage() {
 	go func() {
 		for {
-			msgType, databytes, err := s.conn.ReadMessage()
+			s.mu.Lock()
+			conn := s.conn
+			s.mu.Unlock()
+
+			msgType, databytes, err := conn.ReadMessage()
 			if err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) ||
-					websocket.IsUnexpectedCloseError(err) {
-					log.Println("WebSocket connection closed:", err)
+				if s.isClosed() {
+					return
+				}
+
+				if !isRecoverable(err) {
+					log.Println("WebSocket connection terminated:", err)
+					s.disconnect(err)
+					return
+				}
+
+				log.Println("WebSocket connection lost:", err)
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && closeErr.Code == CloseTokenExpired {
+					s.tokens.Invalidate()
+				}
+				if err := s.reconnect(); err != nil {
+					if !errors.Is(err, ErrConnectionClosed) {
+						log.Println("WebSocket reconnect give up:", err)
+						s.disconnect(err)
+					}
 					return
 				}
 				continue
 			}
 
+			conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.pongTimeout))
+
 			if msgType != websocket.TextMessage {
 				log.Println("unknown message type: ", msgType)
 				continue
@@ -139,7 +504,10 @@ func (s *WSConnection) recvMessage() {
 				continue
 			}
 
-			if err := s.onMessage(&msg); err != nil {
+			s.stateMu.Lock()
+			onMessage := s.onMessage
+			s.stateMu.Unlock()
+			if err := onMessage(&msg); err != nil {
 				log.Println("on message error: ", err.Error())
 				continue
 			}
@@ -147,6 +515,42 @@ func (s *WSConnection) recvMessage() {
 	}()
 }
 
+// disconnect marks the connection as dead and tells the owner, the read loop must exit after it
+func (s *WSConnection) disconnect(err error) {
+	s.mu.Lock()
+	s.connected = false
+	s.conn.Close()
+	s.mu.Unlock()
+
+	s.setState(StateDisconnected)
+	// nothing writes the queue anymore, fail what waits there and what comes later
+	s.queue.close(ErrDisconnected)
+	s.stateMu.Lock()
+	onDisconnect := s.onDisconnect
+	s.stateMu.Unlock()
+	onDisconnect(err)
+}
+
 func (s *WSConnection) SetOnMessage(recvHandler func(*WsMsg) error) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
 	s.onMessage = recvHandler
 }
+
+func (s *WSConnection) SetOnReconnect(handler func()) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.onReconnect = handler
+}
+
+func (s *WSConnection) SetOnDisconnect(handler func(err error)) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.onDisconnect = handler
+}
+
+func (s *WSConnection) SetOnStateChange(handler func(ConnectionState)) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.onStateChange = handler
+}
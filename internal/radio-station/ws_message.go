@@ -2,11 +2,64 @@ package radiostation
 
 import "encoding/json"
 
+type MessageKey string
+
+const (
+	KeySessionPublisher MessageKey = "session_publisher"
+	KeySdAnswer         MessageKey = "sd_answer"
+	KeyIceCandidate     MessageKey = "ice_candidate"
+	KeyConnectPublisher MessageKey = "connect_publisher"
+	KeyPttPublisher     MessageKey = "ptt_publisher"
+	KeyLeavePublisher   MessageKey = "leave_publisher"
+)
+
+// WsMsg is the wire envelope, Value holds the JSON of the Payload named by Key
 type WsMsg struct {
-	Key         string
+	Key         MessageKey
 	ClanId      string
 	ChannelId   string
 	UserId      string
 	DisplayName string
 	Value       json.RawMessage
 }
+
+// Header is the routing part shared by every message
+type Header struct {
+	ClanId      string
+	ChannelId   string
+	UserId      string
+	DisplayName string
+}
+
+// SessionPublisher is the SDP offer of a publisher joining a channel
+type SessionPublisher struct {
+	Type string `json:"type" doc:"always \"offer\""`
+	SDP  string `json:"sdp" doc:"SDP of the publisher"`
+}
+
+// SdAnswer is the SDP answer of the station, sent as a bare JSON string
+type SdAnswer string
+
+// IceCandidate is a trickled ICE candidate, in both directions
+type IceCandidate struct {
+	Candidate        string  `json:"candidate" doc:"candidate attribute line"`
+	SDPMid           *string `json:"sdpMid,omitempty" doc:"media stream id"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty" doc:"m-line index"`
+	UsernameFragment *string `json:"usernameFragment,omitempty" doc:"ICE ufrag"`
+}
+
+// ConnectPublisher tells the other side the publisher ICE connection is up
+type ConnectPublisher struct {
+	ChannelId string `doc:"voice channel of the publisher"`
+}
+
+// PttPublisher starts or stops talking in the channel
+type PttPublisher struct {
+	ChannelId string `doc:"voice channel of the publisher"`
+	IsTalk    bool   `doc:"true while the publisher is on air"`
+}
+
+// LeavePublisher ends the publisher session in the channel
+type LeavePublisher struct {
+	ChannelId string `doc:"voice channel of the publisher"`
+}
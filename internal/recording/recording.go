@@ -0,0 +1,310 @@
+// Package recording archives broadcasts and calls. Each recording is a directory of media files in the
+// archive directory, listed in an index, and is deleted once it is older than the retention.
+package recording
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	KindBroadcast = "broadcast"
+	KindCall      = "call"
+
+	indexName = "recordings.json"
+	// pruneInterval is how often recordings past the retention are deleted
+	pruneInterval = time.Hour
+)
+
+var ErrNoSuchRecording = errors.New("no such recording")
+
+type Recording struct {
+	Id         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	ClanId     string   `json:"clan_id"`
+	ChannelIds []string `json:"channel_ids"`
+	// UserId is who the bot was in a call with
+	UserId string `json:"user_id,omitempty"`
+	// Files are relative to the directory of the recording, Dir
+	Files     []string   `json:"files"`
+	Bytes     int64      `json:"bytes"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"` // nil while recording
+}
+
+// Dir is the directory of the recording in the archive
+func (r Recording) Dir() string {
+	return r.Id
+}
+
+// Filter selects recordings, empty fields match everything
+type Filter struct {
+	Kind      string
+	ClanId    string
+	ChannelId string
+	Since     time.Time
+}
+
+func (f Filter) match(r *Recording) bool {
+	return (f.Kind == "" || r.Kind == f.Kind) &&
+		(f.ClanId == "" || r.ClanId == f.ClanId) &&
+		(f.ChannelId == "" || slices.Contains(r.ChannelIds, f.ChannelId)) &&
+		!r.StartedAt.Before(f.Since)
+}
+
+type Archive struct {
+	dir       string
+	retention time.Duration
+
+	mu         sync.Mutex
+	recordings map[string]*Recording
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open loads the index of dir and deletes what is past retention, then once every pruneInterval.
+// Retention 0 keeps recordings forever. Recordings left open by a crash are ended at their last write.
+func Open(dir string, retention time.Duration) (*Archive, error) {
+	a := &Archive{
+		dir:        dir,
+		retention:  retention,
+		recordings: make(map[string]*Recording),
+		done:       make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var recordings []*Recording
+		if err := json.Unmarshal(data, &recordings); err != nil {
+			return nil, fmt.Errorf("recording index: %w", err)
+		}
+		for _, r := range recordings {
+			if r.EndedAt == nil {
+				a.finishInterrupted(r)
+			}
+			a.recordings[r.Id] = r
+		}
+	}
+
+	a.mu.Lock()
+	err = a.save()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if retention > 0 {
+		a.Prune()
+		go a.pruneLoop()
+	}
+	return a, nil
+}
+
+// Close stops pruning, recordings in progress are closed by their sessions
+func (a *Archive) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
+
+// Start opens a recording, its files are added by the returned session
+func (a *Archive) Start(kind, clanId string, channelIds []string, userId string) (*Session, error) {
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+	r := &Recording{
+		Id:         id,
+		Kind:       kind,
+		ClanId:     clanId,
+		ChannelIds: channelIds,
+		UserId:     userId,
+		StartedAt:  time.Now().UTC(),
+	}
+	if err := os.MkdirAll(filepath.Join(a.dir, r.Dir()), 0o755); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recordings[id] = r
+	if err := a.save(); err != nil {
+		delete(a.recordings, id)
+		return nil, err
+	}
+	return &Session{a: a, id: id, dir: filepath.Join(a.dir, r.Dir())}, nil
+}
+
+// List returns the matching recordings, newest first
+func (a *Archive) List(f Filter) []Recording {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var list []Recording
+	for _, r := range a.recordings {
+		if f.match(r) {
+			list = append(list, *r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list
+}
+
+func (a *Archive) Get(id string) (Recording, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, ok := a.recordings[id]
+	if !ok {
+		return Recording{}, fmt.Errorf("%w: %s", ErrNoSuchRecording, id)
+	}
+	return *r, nil
+}
+
+// File returns the path of a file of a recording, only files listed in the index are found
+func (a *Archive) File(id, name string) (string, error) {
+	r, err := a.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(r.Files, name) {
+		return "", fmt.Errorf("%w: %s/%s", ErrNoSuchRecording, id, name)
+	}
+	return filepath.Join(a.dir, r.Dir(), name), nil
+}
+
+// Prune deletes the ended recordings older than the retention and returns how many
+func (a *Archive) Prune() int {
+	if a.retention <= 0 {
+		return 0
+	}
+	cutoff := time.Now().Add(-a.retention)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pruned := 0
+	for id, r := range a.recordings {
+		if r.EndedAt == nil || r.EndedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.dir, r.Dir())); err != nil {
+			log.Printf("recording prune %s: %v \n", id, err)
+			continue
+		}
+		delete(a.recordings, id)
+		pruned++
+	}
+	if pruned > 0 {
+		if err := a.save(); err != nil {
+			log.Printf("recording index save: %v \n", err)
+		}
+		log.Printf("recording pruned %d recording(s) older than %s \n", pruned, a.retention)
+	}
+	return pruned
+}
+
+func (a *Archive) pruneLoop() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.Prune()
+		}
+	}
+}
+
+// finish ends a recording with its files, called by Session.Close
+func (a *Archive) finish(id string, files []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, ok := a.recordings[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchRecording, id)
+	}
+	now := time.Now().UTC()
+	r.Files, r.EndedAt = files, &now
+	r.Bytes = a.size(r)
+	return a.save()
+}
+
+// finishInterrupted ends a recording at the last write of its files, which are listed from its directory
+func (a *Archive) finishInterrupted(r *Recording) {
+	ended := r.StartedAt
+	entries, _ := os.ReadDir(filepath.Join(a.dir, r.Dir()))
+	r.Files = nil
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		r.Files = append(r.Files, e.Name())
+		if info.ModTime().After(ended) {
+			ended = info.ModTime().UTC()
+		}
+	}
+	r.EndedAt = &ended
+	r.Bytes = a.size(r)
+	log.Printf("recording %s was interrupted, ended at %s \n", r.Id, ended.Format(time.RFC3339))
+}
+
+func (a *Archive) size(r *Recording) int64 {
+	var size int64
+	for _, name := range r.Files {
+		if info, err := os.Stat(filepath.Join(a.dir, r.Dir(), name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// save writes the index to a temp file and renames it, must be called with mu held
+func (a *Archive) save() error {
+	recordings := make([]*Recording, 0, len(a.recordings))
+	for _, r := range a.recordings {
+		recordings = append(recordings, r)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartedAt.Before(recordings[j].StartedAt) })
+
+	data, err := json.MarshalIndent(recordings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+
+	index := filepath.Join(a.dir, indexName)
+	tmp := index + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, index)
+}
+
+// newId is sortable by start time and unique: 20060102-150405-<random>
+func newId() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,148 @@
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	pionmedia "github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// broadcastFile is where a session writes the published audio
+const broadcastFile = "broadcast.ogg"
+
+var (
+	ErrSessionClosed    = errors.New("recording closed")
+	ErrUnsupportedCodec = errors.New("codec can not be recorded")
+)
+
+// Session writes the files of one recording until Close. It is safe for concurrent use: the published
+// audio and every remote track write from goroutines of their own.
+type Session struct {
+	a   *Archive
+	id  string
+	dir string
+
+	mu      sync.Mutex
+	files   []string
+	writers []pionmedia.Writer
+	audio   *os.File
+	ogg     *media.OggWriter
+	closed  bool
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+// WriteSample records a sample of the published audio, Opus at 48 kHz, to broadcast.ogg
+func (s *Session) WriteSample(sample pionmedia.Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if s.ogg == nil {
+		file, err := os.Create(filepath.Join(s.dir, broadcastFile))
+		if err != nil {
+			return err
+		}
+		ogg, err := media.NewOggWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		s.audio, s.ogg = file, ogg
+		s.files = append(s.files, broadcastFile)
+	}
+	return s.ogg.WritePacket(media.OpusPacket{
+		Data:     sample.Data,
+		Samples:  int(sample.Duration * media.OPUS_SAMPLE_RATE / time.Second),
+		Duration: sample.Duration,
+	})
+}
+
+// Track returns the writer of a remote track named name: Opus to <name>.ogg, VP8 and AV1 to <name>.ivf.
+// The writer is closed with the session.
+func (s *Session) Track(name, mimeType string) (pionmedia.Writer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	var file string
+	var writer pionmedia.Writer
+	var err error
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		file = name + ".ogg"
+		writer, err = oggwriter.New(filepath.Join(s.dir, file), media.OPUS_SAMPLE_RATE, 2)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8), strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		file = name + ".ivf"
+		writer, err = ivfwriter.New(filepath.Join(s.dir, file), ivfwriter.WithCodec(mimeType))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, mimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.files = append(s.files, file)
+	locked := &lockedWriter{s: s, w: writer}
+	s.writers = append(s.writers, locked)
+	return locked, nil
+}
+
+// Close closes the files and ends the recording in the index
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, w := range s.writers {
+		w.(*lockedWriter).w.Close()
+	}
+	if s.audio != nil {
+		s.audio.Close()
+	}
+	files := s.files
+	s.mu.Unlock()
+
+	return s.a.finish(s.id, files)
+}
+
+// lockedWriter keeps the writes of a track out of Close, pion writers are not safe for concurrent use
+type lockedWriter struct {
+	s *Session
+	w pionmedia.Writer
+}
+
+func (l *lockedWriter) WriteRTP(packet *rtp.Packet) error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+
+	if l.s.closed {
+		return ErrSessionClosed
+	}
+	return l.w.WriteRTP(packet)
+}
+
+// Close is left to the session
+func (l *lockedWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,240 @@
+package rtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	audio "mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+	radiostation "mezon-go-bot/internal/radio-station"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// BroadcastTarget is one channel of a Broadcast with its station session
+type BroadcastTarget struct {
+	ClanId    string
+	ChannelId string
+	Ws        radiostation.IWSConnection
+}
+
+// Broadcast publishes one source to several channels. Every connection is bound to the same tracks,
+// so the file is read and paced once and pion fans the packets out to each peer.
+type Broadcast struct {
+	members      []*StreamingRTCConn
+	audioTrack   *webrtc.TrackLocalStaticSample
+	keyframeWant chan struct{}
+	mix          mixStage
+	rec          recordTap
+
+	videoMu    sync.Mutex
+	videoTrack *webrtc.TrackLocalStaticSample
+
+	// done is closed once every member is closed
+	done chan struct{}
+}
+
+var _ IStreamingRTCConnection = (*Broadcast)(nil)
+
+// NewBroadcast connects every target and takes over their station sessions, all of them are closed
+// when one target fails.
+func NewBroadcast(config webrtc.Configuration, targets []BroadcastTarget, userId, displayName string) (*Broadcast, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("broadcast needs at least one channel")
+	}
+
+	ids := make([]string, len(targets))
+	for i, t := range targets {
+		ids[i] = t.ChannelId
+	}
+	streamId := strings.Join(ids, "_")
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio_opus_"+streamId, "audio_opus_"+streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broadcast{
+		audioTrack:   audioTrack,
+		keyframeWant: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	for i, t := range targets {
+		member, err := newStreamingRTCConn(config, t.Ws, t.ClanId, t.ChannelId, userId, displayName, audioTrack, b.keyframeWant)
+		if err != nil {
+			b.Close("")
+			for _, rest := range targets[i:] {
+				rest.Ws.Close()
+			}
+			return nil, fmt.Errorf("channel %s: %w", t.ChannelId, err)
+		}
+		b.members = append(b.members, member)
+	}
+
+	go func() {
+		for _, m := range b.members {
+			<-m.done
+		}
+		close(b.done)
+	}()
+
+	return b, nil
+}
+
+// WaitReady waits until every channel still connected hears the broadcast, see StreamingRTCConn.WaitReady.
+// It fails once every member closed.
+func (b *Broadcast) WaitReady(ctx context.Context) error {
+	err := ErrStreamClosed
+	for _, m := range b.members {
+		switch memberErr := m.WaitReady(ctx); {
+		case memberErr == nil:
+			err = nil
+		case !errors.Is(memberErr, ErrStreamClosed):
+			return memberErr
+		}
+	}
+	return err
+}
+
+func (b *Broadcast) SendAudioTrack(filePath string) error {
+	return b.PlayAudioTrack(context.Background(), filePath, nil)
+}
+
+// PlayAudioTrack streams the file to every channel still connected, see StreamingRTCConn.PlayAudioTrack
+func (b *Broadcast) PlayAudioTrack(ctx context.Context, filePath string, pb *audio.Playback) error {
+	return playAudio(ctx, b, filePath, pb)
+}
+
+// PlayVideoTrack streams the movie to every channel still connected, see StreamingRTCConn.PlayVideoTrack
+func (b *Broadcast) PlayVideoTrack(ctx context.Context, videoPath, audioPath string, pb *audio.Playback) error {
+	return playVideo(ctx, b, videoPath, audioPath, pb)
+}
+
+// PlaySource streams the source to every channel still connected, see StreamingRTCConn.PlaySource
+func (b *Broadcast) PlaySource(ctx context.Context, src audio.Source, pb *audio.Playback) error {
+	return playSource(ctx, b, src, pb)
+}
+
+// PlayOverlay mixes the file over what every channel hears, see StreamingRTCConn.PlayOverlay
+func (b *Broadcast) PlayOverlay(ctx context.Context, filePath string, role mixer.Role, gain float64) error {
+	return playOverlay(ctx, b, filePath, role, gain)
+}
+
+// Record copies what every channel hears to rec, see StreamingRTCConn.Record
+func (b *Broadcast) Record(rec Recorder) {
+	b.rec.set(rec)
+}
+
+// Close tears every member down at once, so their leaves are waited for together. channelId is ignored.
+func (b *Broadcast) Close(channelId string) {
+	b.mix.close()
+	b.rec.close()
+
+	var wg sync.WaitGroup
+	for _, m := range b.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Close(m.channelId)
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Broadcast) audio() audioOut {
+	return audioOut{track: b.audioTrack, tap: &b.rec}
+}
+
+func (b *Broadcast) closed() <-chan struct{} {
+	return b.done
+}
+
+func (b *Broadcast) mixer() (*mixer.Mixer, error) {
+	return b.mix.mixer(b.audio())
+}
+
+func (b *Broadcast) holdTrack() func() {
+	return b.mix.hold()
+}
+
+// sendPtt talks on every member still open, a member that dropped out does not stop the others
+func (b *Broadcast) sendPtt(talking bool) error {
+	var errs []error
+	for _, m := range b.open() {
+		if err := m.sendPtt(talking); err != nil {
+			errs = append(errs, fmt.Errorf("channel %s: %w", m.channelId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// video binds one video track to every member, each renegotiates with its station
+func (b *Broadcast) video(ctx context.Context, codec string) (*webrtc.TrackLocalStaticSample, error) {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+
+	if b.videoTrack == nil || b.videoTrack.Codec().MimeType != videoMimeType(codec) {
+		track, err := newVideoTrack(codec, b.audioTrack.StreamID())
+		if err != nil {
+			return nil, err
+		}
+		b.videoTrack = track
+	}
+
+	members := b.open()
+	if len(members) == 0 {
+		return nil, ErrStreamClosed
+	}
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			m.videoMu.Lock()
+			defer m.videoMu.Unlock()
+			if m.videoTrack == b.videoTrack {
+				return
+			}
+			if err := m.setVideoTrackLocked(ctx, b.videoTrack); err != nil {
+				errs[i] = err
+				log.Printf("broadcast video for channel %s: %v \n", m.channelId, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the movie goes on for the channels that took the track
+	for _, err := range errs {
+		if err == nil {
+			return b.videoTrack, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (b *Broadcast) keyframeRequested() bool {
+	select {
+	case <-b.keyframeWant:
+		return true
+	default:
+		return false
+	}
+}
+
+// open returns the members that are not closed
+func (b *Broadcast) open() []*StreamingRTCConn {
+	var open []*StreamingRTCConn
+	for _, m := range b.members {
+		select {
+		case <-m.done:
+		default:
+			open = append(open, m)
+		}
+	}
+	return open
+}
@@ -0,0 +1,205 @@
+package rtc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	audio "mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// mixPollInterval is how often a mixed stream checks its controls and reports its position
+const mixPollInterval = 50 * time.Millisecond
+
+var (
+	ErrNoMixer   = errors.New("mixing needs ffmpeg")
+	ErrTrackBusy = errors.New("a movie is playing, nothing can be mixed over it")
+
+	codec Codec
+)
+
+// Codec decodes streams to PCM for the mixer and encodes the mix, see ingest.Pipeline
+type Codec interface {
+	DecodePCM(src audio.Source) (io.ReadCloser, error)
+	NewEncoder() (mixer.Encoder, error)
+}
+
+// SetCodec routes audio through a mixer per connection, it is set once on start. The programme is then
+// mixed with announcements and effects and gains apply without re-opening the file. Without a codec,
+// packets are sent as they are read.
+func SetCodec(c Codec) {
+	codec = c
+}
+
+// mixStage is the mixer feeding an audio track, started on first use and kept until the connection
+// closes. A movie writes its sound to the track directly and holds the stage meanwhile.
+type mixStage struct {
+	mu     sync.Mutex
+	mix    *mixer.Mixer
+	movie  bool
+	closed bool
+}
+
+func (s *mixStage) mixer(track audioOut) (*mixer.Mixer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case codec == nil:
+		return nil, ErrNoMixer
+	case s.closed:
+		return nil, ErrStreamClosed
+	case s.movie:
+		return nil, ErrTrackBusy
+	case s.mix != nil:
+		return s.mix, nil
+	}
+
+	enc, err := codec.NewEncoder()
+	if err != nil {
+		return nil, err
+	}
+	s.mix = mixer.New(enc, func(packet audio.OpusPacket) error {
+		return track.WriteSample(media.Sample{Data: packet.Data, Duration: packet.Duration})
+	})
+	return s.mix, nil
+}
+
+// hold gives the track to a movie until release is called, what the mixer plays is stopped
+func (s *mixStage) hold() (release func()) {
+	s.mu.Lock()
+	mix := s.mix
+	s.mix, s.movie = nil, true
+	s.mu.Unlock()
+
+	if mix != nil {
+		mix.Close()
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.movie = false
+	}
+}
+
+func (s *mixStage) close() {
+	s.mu.Lock()
+	mix := s.mix
+	s.mix, s.closed = nil, true
+	s.mu.Unlock()
+
+	if mix != nil {
+		mix.Close()
+	}
+}
+
+// addLayer decodes src into the mixer, offset is where src starts
+func addLayer(mix *mixer.Mixer, src audio.Source, role mixer.Role, gain float64, offset time.Duration) (*mixer.Layer, error) {
+	pcm, err := codec.DecodePCM(src)
+	if err != nil {
+		return nil, err
+	}
+	return mix.Add(pcm, role, gain, offset)
+}
+
+// playMixed plays src as the music layer of the mixer. Gains are applied by the mixer, a seek reopens the
+// source at the target; seeks are dropped when reopen is nil.
+func playMixed(ctx context.Context, out sink, mix *mixer.Mixer, src audio.Source, reopen func(to time.Duration) (audio.Source, error), pb *audio.Playback) error {
+	gain, _ := pb.TakeGain()
+	layer, err := addLayer(mix, src, mixer.Music, gain, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { layer.Stop() }()
+
+	ticker := time.NewTicker(mixPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.closed():
+			return ErrStreamClosed
+		case <-layer.Done():
+			pb.SetPosition(layer.Position())
+			err := layerErr(out, layer)
+			if err == nil {
+				log.Println("All audio pages parsed and sent")
+			}
+			return err
+		case <-ticker.C:
+		case <-pb.Wake():
+		}
+
+		if gain, ok := pb.TakeGain(); ok {
+			layer.SetGain(gain)
+		}
+		if to, ok := pb.TakeSeek(); ok && reopen != nil {
+			seeked, err := reopen(to)
+			if err != nil {
+				return err
+			}
+			next, err := addLayer(mix, seeked, mixer.Music, pb.Gain(), to)
+			if err != nil {
+				return err
+			}
+			next.SetPaused(layer.Paused())
+			layer.Stop()
+			layer = next
+		}
+
+		// announcements and effects keep playing over a paused programme
+		if paused := pb.Paused(); paused != layer.Paused() {
+			layer.SetPaused(paused)
+			if err := out.sendPtt(!paused); err != nil {
+				log.Printf("send ptt_publisher error: %v \n", err)
+			}
+		}
+		pb.SetPosition(layer.Position())
+	}
+}
+
+// playOverlay mixes an Ogg Opus file over whatever the track plays, until it ends or ctx is done
+func playOverlay(ctx context.Context, out sink, filePath string, role mixer.Role, gain float64) error {
+	mix, err := out.mixer()
+	if err != nil {
+		return err
+	}
+	src, err := openOggStream(filePath, 0)
+	if err != nil {
+		return err
+	}
+	layer, err := addLayer(mix, src, role, gain, 0)
+	if err != nil {
+		return err
+	}
+	defer layer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-out.closed():
+		return ErrStreamClosed
+	case <-layer.Done():
+		return layerErr(out, layer)
+	}
+}
+
+// layerErr is why a layer ended. The mixer closes with the connection, or when a movie takes the track.
+func layerErr(out sink, layer *mixer.Layer) error {
+	err := layer.Err()
+	if !errors.Is(err, mixer.ErrClosed) {
+		return err
+	}
+	select {
+	case <-out.closed():
+		return ErrStreamClosed
+	default:
+		return ErrTrackBusy
+	}
+}
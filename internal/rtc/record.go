@@ -0,0 +1,75 @@
+package rtc
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Recorder gets a copy of the published audio, see recording.Session
+type Recorder interface {
+	WriteSample(sample media.Sample) error
+	Close() error
+}
+
+// CallRecorder gets the remote tracks of a call, see recording.Session
+type CallRecorder interface {
+	// Track returns the writer of a remote track, closed with the recorder
+	Track(name, mimeType string) (media.Writer, error)
+	Close() error
+}
+
+// recordTap holds the recorder of a connection, stopped and closed with the connection
+type recordTap struct {
+	mu  sync.Mutex
+	rec Recorder
+}
+
+// set replaces the recorder, the previous one is closed
+func (t *recordTap) set(rec Recorder) {
+	t.mu.Lock()
+	prev := t.rec
+	t.rec = rec
+	t.mu.Unlock()
+
+	if prev != nil {
+		if err := prev.Close(); err != nil {
+			log.Printf("close recorder error: %v \n", err)
+		}
+	}
+}
+
+// write records a sample, a recorder that fails is dropped so playback goes on
+func (t *recordTap) write(sample media.Sample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rec == nil {
+		return
+	}
+	if err := t.rec.WriteSample(sample); err != nil {
+		log.Printf("record sample error, recording stopped: %v \n", err)
+		t.rec.Close()
+		t.rec = nil
+	}
+}
+
+func (t *recordTap) close() {
+	t.set(nil)
+}
+
+// audioOut is where the published audio is written: the track, and the recorder while recording
+type audioOut struct {
+	track *webrtc.TrackLocalStaticSample
+	tap   *recordTap
+}
+
+func (o audioOut) WriteSample(sample media.Sample) error {
+	if err := o.track.WriteSample(sample); err != nil {
+		return err
+	}
+	o.tap.write(sample)
+	return nil
+}
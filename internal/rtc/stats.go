@@ -0,0 +1,188 @@
+package rtc
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	StreamBroadcast = "broadcast"
+	StreamCall      = "call"
+
+	audioClockRate = 48000
+	videoClockRate = 90000
+
+	// ntpEpochOffset is the number of seconds from 1900 (NTP) to 1970 (Unix)
+	ntpEpochOffset = 2208988800
+)
+
+var (
+	streamsMu sync.Mutex
+	streams   = make(map[string]*streamStats) // map[kind/channelId]*streamStats, the open connections
+)
+
+func init() {
+	// published with expvar (GET /admin/vars) next to the signaling counters
+	expvar.Publish("rtc_streams", expvar.Func(func() any { return AllStreamStats() }))
+}
+
+// StreamStats is how the other end receives what the bot publishes on a channel: for a broadcast the
+// radio station, which relays to the listeners, for a call the caller. It sums up their RTCP receiver
+// reports and feedback.
+type StreamStats struct {
+	Kind      string      `json:"kind"`
+	ChannelId string      `json:"channel_id"`
+	Since     time.Time   `json:"since"`
+	Audio     TrackStats  `json:"audio"`
+	Video     *TrackStats `json:"video,omitempty"`
+}
+
+type TrackStats struct {
+	Reports int64 `json:"reports"`
+	// FractionLost is the share of packets lost since the previous report, 0 to 1
+	FractionLost float64 `json:"fraction_lost"`
+	// AvgFractionLost is the mean FractionLost over every report
+	AvgFractionLost float64 `json:"avg_fraction_lost"`
+	// PacketsLost is the total reported by the receiver
+	PacketsLost int64   `json:"packets_lost"`
+	JitterMs    float64 `json:"jitter_ms"`
+	// RttMs is 0 until a report refers to one of our sender reports
+	RttMs      float64   `json:"rtt_ms"`
+	Nacks      int64     `json:"nacks"`
+	Plis       int64     `json:"plis"`
+	LastReport time.Time `json:"last_report"`
+}
+
+// streamStats collects the RTCP of one connection, its tracks report from goroutines of their own
+type streamStats struct {
+	mu    sync.Mutex
+	stats StreamStats
+}
+
+// newStreamStats registers the stats of a connection until unregister, a newer connection of the
+// channel replaces them
+func newStreamStats(kind, channelId string) *streamStats {
+	s := &streamStats{stats: StreamStats{Kind: kind, ChannelId: channelId, Since: time.Now()}}
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	streams[kind+"/"+channelId] = s
+	return s
+}
+
+func (s *streamStats) unregister() {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	key := s.stats.Kind + "/" + s.stats.ChannelId
+	if streams[key] == s {
+		delete(streams, key)
+	}
+}
+
+// observe adds the RTCP read from the sender of the audio or the video track
+func (s *streamStats) observe(video bool, packets []rtcp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	track, clockRate := &s.stats.Audio, float64(audioClockRate)
+	if video {
+		if s.stats.Video == nil {
+			s.stats.Video = &TrackStats{}
+		}
+		track, clockRate = s.stats.Video, videoClockRate
+	}
+
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.ReceiverReport:
+			for _, r := range p.Reports {
+				track.report(r, clockRate)
+			}
+		case *rtcp.SenderReport:
+			for _, r := range p.Reports {
+				track.report(r, clockRate)
+			}
+		case *rtcp.TransportLayerNack:
+			track.Nacks++
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			track.Plis++
+		}
+	}
+}
+
+func (t *TrackStats) report(r rtcp.ReceptionReport, clockRate float64) {
+	now := time.Now()
+
+	t.FractionLost = float64(r.FractionLost) / 256
+	t.AvgFractionLost = (t.AvgFractionLost*float64(t.Reports) + t.FractionLost) / float64(t.Reports+1)
+	t.Reports++
+	t.PacketsLost = int64(r.TotalLost)
+	t.JitterMs = float64(r.Jitter) / clockRate * 1000
+	t.LastReport = now
+
+	// RTT = arrival - LSR - DLSR, all in the middle 32 bits of NTP time (1/65536 s)
+	if r.LastSenderReport != 0 {
+		rtt := ntpMiddle(now) - r.LastSenderReport - r.Delay
+		if rtt < 1<<31 {
+			t.RttMs = float64(rtt) / 65536 * 1000
+		}
+	}
+}
+
+// ntpMiddle is the middle 32 bits of the NTP timestamp of t, as carried by reception reports
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix()+ntpEpochOffset) << 32
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32((seconds | fraction) >> 16)
+}
+
+func (s *streamStats) snapshot() StreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	if stats.Video != nil {
+		video := *stats.Video
+		stats.Video = &video
+	}
+	return stats
+}
+
+// AllStreamStats returns the stats of every open connection, by kind and channel
+func AllStreamStats() []StreamStats {
+	streamsMu.Lock()
+	all := make([]*streamStats, 0, len(streams))
+	for _, s := range streams {
+		all = append(all, s)
+	}
+	streamsMu.Unlock()
+
+	list := make([]StreamStats, len(all))
+	for i, s := range all {
+		list[i] = s.snapshot()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].ChannelId < list[j].ChannelId
+	})
+	return list
+}
+
+// StatsOf returns the stats of the open connection of kind on a channel
+func StatsOf(kind, channelId string) (StreamStats, bool) {
+	streamsMu.Lock()
+	s, ok := streams[kind+"/"+channelId]
+	streamsMu.Unlock()
+
+	if !ok {
+		return StreamStats{}, false
+	}
+	return s.snapshot(), true
+}
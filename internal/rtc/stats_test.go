@@ -0,0 +1,153 @@
+package rtc
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// ntpDuration is d in the 1/65536 s units of the middle 32 bits of NTP time
+func ntpDuration(d time.Duration) uint32 {
+	return uint32(d * 65536 / time.Second)
+}
+
+func TestNtpMiddle(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		want uint32
+	}{
+		// 1970 is 2208988800 = 0x83AA7E80 s after the NTP epoch, the middle bits keep 0x7E80
+		{name: "unix epoch", time: time.Unix(0, 0), want: 0x7E80_0000},
+		{name: "half a second", time: time.Unix(0, int64(500*time.Millisecond)), want: 0x7E80_8000},
+		{name: "a second and a quarter", time: time.Unix(1, int64(250*time.Millisecond)), want: 0x7E81_4000},
+		// the seconds wrap every 65536 s, the difference of two timestamps keeps working
+		{name: "wraps", time: time.Unix(0x10000-0x7E80, 0), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ntpMiddle(tt.time); got != tt.want {
+				t.Errorf("ntpMiddle = %#08x, want %#08x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackStatsReportRtt(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent is how long ago the sender report went out, held is the delay the receiver reports
+		sent, held time.Duration
+		rtt        time.Duration
+		// keep is true when the report can not give an RTT and the previous one stays
+		keep bool
+	}{
+		{name: "round trip", sent: 150 * time.Millisecond, held: 100 * time.Millisecond, rtt: 50 * time.Millisecond},
+		{name: "held long", sent: 5 * time.Second, held: 4900 * time.Millisecond, rtt: 100 * time.Millisecond},
+		{name: "no delay", sent: 30 * time.Millisecond, rtt: 30 * time.Millisecond},
+		{name: "no sender report yet", keep: true},
+		{name: "delay past arrival", sent: 100 * time.Millisecond, held: 300 * time.Millisecond, keep: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const previous = 42
+			stats := TrackStats{RttMs: previous}
+
+			r := rtcp.ReceptionReport{Delay: ntpDuration(tt.held)}
+			if tt.sent > 0 {
+				r.LastSenderReport = ntpMiddle(time.Now().Add(-tt.sent))
+			}
+			stats.report(r, audioClockRate)
+
+			want := float64(tt.rtt.Milliseconds())
+			if tt.keep {
+				want = previous
+			}
+			// the report reads the clock again and NTP units are 15 µs
+			if math.Abs(stats.RttMs-want) > 5 {
+				t.Errorf("rtt %.1f ms, want %.1f ms", stats.RttMs, want)
+			}
+		})
+	}
+}
+
+func TestTrackStatsReportLoss(t *testing.T) {
+	reports := []struct {
+		fractionLost uint8
+		totalLost    uint32
+		jitter       uint32
+	}{
+		{fractionLost: 0, totalLost: 0, jitter: 480},
+		{fractionLost: 64, totalLost: 12, jitter: 960},
+		{fractionLost: 128, totalLost: 40, jitter: 240},
+	}
+
+	var stats TrackStats
+	for _, r := range reports {
+		stats.report(rtcp.ReceptionReport{FractionLost: r.fractionLost, TotalLost: r.totalLost, Jitter: r.jitter}, audioClockRate)
+	}
+
+	if stats.Reports != 3 {
+		t.Errorf("%d reports", stats.Reports)
+	}
+	if stats.FractionLost != 0.5 {
+		t.Errorf("fraction lost %v, want the last report 0.5", stats.FractionLost)
+	}
+	if stats.AvgFractionLost != 0.25 {
+		t.Errorf("average fraction lost %v, want 0.25", stats.AvgFractionLost)
+	}
+	if stats.PacketsLost != 40 {
+		t.Errorf("packets lost %d, want the last total 40", stats.PacketsLost)
+	}
+	// 240 samples at 48 kHz
+	if stats.JitterMs != 5 {
+		t.Errorf("jitter %v ms, want 5", stats.JitterMs)
+	}
+	if stats.RttMs != 0 {
+		t.Errorf("rtt %v ms without a sender report", stats.RttMs)
+	}
+}
+
+func TestStreamStatsObserve(t *testing.T) {
+	s := newStreamStats(StreamCall, t.Name())
+	defer s.unregister()
+
+	s.observe(false, []rtcp.Packet{
+		&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{FractionLost: 128, Jitter: 480}}},
+		&rtcp.TransportLayerNack{},
+	})
+	s.observe(true, []rtcp.Packet{
+		&rtcp.SenderReport{Reports: []rtcp.ReceptionReport{{Jitter: 900}}},
+		&rtcp.PictureLossIndication{},
+		&rtcp.FullIntraRequest{},
+		&rtcp.TransportLayerNack{},
+		&rtcp.TransportLayerNack{},
+	})
+
+	stats, ok := StatsOf(StreamCall, t.Name())
+	if !ok {
+		t.Fatal("stats not registered")
+	}
+	if a := stats.Audio; a.Reports != 1 || a.FractionLost != 0.5 || a.JitterMs != 10 || a.Nacks != 1 || a.Plis != 0 {
+		t.Errorf("audio %+v", a)
+	}
+	// the video clock runs at 90 kHz
+	if v := stats.Video; v == nil || v.Reports != 1 || v.JitterMs != 10 || v.Nacks != 2 || v.Plis != 2 {
+		t.Errorf("video %+v", v)
+	}
+
+	// a newer connection of the channel replaces the stats, the old one leaves them registered
+	newer := newStreamStats(StreamCall, t.Name())
+	s.unregister()
+	if _, ok := StatsOf(StreamCall, t.Name()); !ok {
+		t.Error("unregistering the old connection removed the newer stats")
+	}
+	newer.unregister()
+	if _, ok := StatsOf(StreamCall, t.Name()); ok {
+		t.Error("stats registered after unregister")
+	}
+}
@@ -1,11 +1,13 @@
 package rtc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	audio "mezon-go-bot/internal/media"
+	"mezon-go-bot/internal/mixer"
 	radiostation "mezon-go-bot/internal/radio-station"
 
 	"os"
@@ -14,13 +16,23 @@ import (
 
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
-	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 )
 
 var (
 	MapStreamingRtcConn sync.Map // map[channelId]*RTCConnection
+
+	processor Processor
 )
 
+// Processor re-encodes an Ogg Opus file from offset with a linear gain, see ingest.Pipeline.OpenProcessed
+type Processor func(filePath string, offset time.Duration, gain float64) (audio.Source, error)
+
+// SetProcessor enables gains (loudness normalization, volume) on played files, it is set once on start.
+// Without one, files play as they are.
+func SetProcessor(p Processor) {
+	processor = p
+}
+
 type StreamingRTCConn struct {
 	peer *webrtc.PeerConnection
 	ws   radiostation.IWSConnection
@@ -30,67 +42,111 @@ type StreamingRTCConn struct {
 	userId      string
 	displayName string
 
-	// TODO: streaming video (#rapchieuphim)
-	// videoTrack *webrtc.TrackLocalStaticRTP
 	audioTrack *webrtc.TrackLocalStaticSample
+	mix        mixStage
+	rec        recordTap
+	stats      *streamStats
+
+	// the video track (#rapchieuphim) is added by the first movie, audio only sessions never offer one
+	videoMu      sync.Mutex
+	videoTrack   *webrtc.TrackLocalStaticSample
+	videoSender  *webrtc.RTPSender
+	keyframeWant chan struct{} // a receiver asked for a keyframe (PLI/FIR)
+
+	// ready is closed once the station hears the publisher: the peer is connected and the station echoed
+	// connect_publisher. Audio sent before is lost, see WaitReady.
+	readyMu   sync.Mutex
+	connected bool
+	granted   bool
+	ready     chan struct{}
+
+	// done is closed first thing by Close and ends any PlayAudioTrack in progress
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// leaveTimeout bounds how long Close waits for the station to take ptt_publisher and leave_publisher
+const leaveTimeout = 2 * time.Second
+
+var ErrStreamClosed = errors.New("streaming connection closed")
+
 type IStreamingRTCConnection interface {
+	WaitReady(ctx context.Context) error
 	SendAudioTrack(filePath string) error
+	PlayAudioTrack(ctx context.Context, filePath string, pb *audio.Playback) error
+	PlayVideoTrack(ctx context.Context, videoPath, audioPath string, pb *audio.Playback) error
+	PlaySource(ctx context.Context, src audio.Source, pb *audio.Playback) error
+	PlayOverlay(ctx context.Context, filePath string, role mixer.Role, gain float64) error
+	Record(rec Recorder)
 	Close(channelId string)
 }
 
 func NewStreamingRTCConnection(config webrtc.Configuration, wsConn radiostation.IWSConnection, clanId, channelId, userId, displayName string) (IStreamingRTCConnection, error) {
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	// Create a audio track
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, fmt.Sprintf("audio_opus_%s", channelId), fmt.Sprintf("audio_opus_%s", channelId))
 	if err != nil {
 		return nil, err
 	}
 
-	// // Create a video track
-	// videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, fmt.Sprintf("video_vp8_%s", channelId), fmt.Sprintf("video_vp8_%s", channelId))
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// _, err = peerConnection.AddTrack(videoTrack)
-	// if err != nil {
-	// 	return nil, err
-	// }
+	rtcConnection, err := newStreamingRTCConn(config, wsConn, clanId, channelId, userId, displayName, audioTrack, make(chan struct{}, 1))
+	if err != nil {
+		return nil, err
+	}
+	return rtcConnection, nil
+}
 
-	// Create a audio track
-	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, fmt.Sprintf("audio_opus_%s", channelId), fmt.Sprintf("audio_opus_%s", channelId))
+// newStreamingRTCConn publishes audioTrack on one channel. The track and keyframeWant may be shared
+// by several connections, see Broadcast.
+func newStreamingRTCConn(config webrtc.Configuration, wsConn radiostation.IWSConnection, clanId, channelId, userId, displayName string,
+	audioTrack *webrtc.TrackLocalStaticSample, keyframeWant chan struct{}) (*StreamingRTCConn, error) {
+	peerConnection, err := webrtc.NewPeerConnection(config)
 	if err != nil {
 		return nil, err
 	}
+
 	rtpSender, err := peerConnection.AddTrack(audioTrack)
 	if err != nil {
+		peerConnection.Close()
 		return nil, err
 	}
 
+	stats := newStreamStats(StreamBroadcast, channelId)
+
 	// Read incoming RTCP packets
 	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
+	// like NACK this needs to be called. The receiver reports feed the stats of the channel.
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			stats.observe(false, packets)
 		}
 	}()
 
 	// save to store
 	rtcConnection := &StreamingRTCConn{
-		peer:        peerConnection,
-		ws:          wsConn,
-		clanId:      clanId,
-		channelId:   channelId,
-		userId:      userId,
-		displayName: displayName,
-		audioTrack:  audioTrack,
+		peer:         peerConnection,
+		ws:           wsConn,
+		clanId:       clanId,
+		channelId:    channelId,
+		userId:       userId,
+		displayName:  displayName,
+		audioTrack:   audioTrack,
+		keyframeWant: keyframeWant,
+		stats:        stats,
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
 	}
 
 	// ws receive message handler ( on event )
 	wsConn.SetOnMessage(rtcConnection.onWebsocketEvent)
+	wsConn.SetOnReconnect(rtcConnection.onReconnect)
+	wsConn.SetOnDisconnect(func(err error) {
+		log.Printf("radio station lost for channel %s: %v \n", channelId, err)
+		rtcConnection.Close(channelId)
+	})
 	MapStreamingRtcConn.Store(channelId, rtcConnection)
 
 	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
@@ -98,151 +154,240 @@ func NewStreamingRTCConnection(config webrtc.Configuration, wsConn radiostation.
 
 		switch state {
 		case webrtc.ICEConnectionStateConnected:
-			// TODO: event ice connected
-			jsonData, _ := json.Marshal(map[string]string{"ChannelId": channelId})
-			wsConn.SendMessage(&radiostation.WsMsg{
-				ClanId:      clanId,
-				ChannelId:   channelId,
-				Key:         "connect_publisher",
-				Value:       jsonData,
-				UserId:      userId,
-				DisplayName: displayName,
-			})
-		case webrtc.ICEConnectionStateClosed:
-			rtcConn, ok := MapStreamingRtcConn.Load(channelId)
-			if !ok {
-				return
+			if err := rtcConnection.send(&radiostation.ConnectPublisher{ChannelId: channelId}); err != nil {
+				log.Printf("send connect_publisher error: %v \n", err)
 			}
-
-			if rtcConn.(*StreamingRTCConn).peer == nil {
-				return
-			}
-
-			if rtcConn.(*StreamingRTCConn).peer.ConnectionState() != webrtc.PeerConnectionStateClosed {
-				rtcConn.(*StreamingRTCConn).peer.Close()
-			}
-
-			MapStreamingRtcConn.Delete(channelId)
+		case webrtc.ICEConnectionStateClosed:
+			go rtcConnection.Close(channelId)
+		}
+	})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		// ICE alone is not enough, samples are dropped until DTLS is up too
+		if state == webrtc.PeerConnectionStateConnected {
+			rtcConnection.setReady(func() { rtcConnection.connected = true })
 		}
 	})
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-		rtcConnection.onICECandidate(i, channelId, clanId, userId, displayName)
+		if err := rtcConnection.onICECandidate(i); err != nil {
+			log.Printf("send ice_candidate error: %v \n", err)
+		}
 	})
 
 	// send offer
-	rtcConnection.sendOffer()
+	rtcConnection.sendOffer(nil)
 
 	return rtcConnection, nil
 }
 
-func (c *StreamingRTCConn) Close(channelId string) {
-	rtcConn, ok := MapStreamingRtcConn.Load(channelId)
-	if !ok {
-		return
+// WaitReady blocks until the station hears the connection, audio sent before is lost. It fails when the
+// connection closes first or ctx is done.
+func (c *StreamingRTCConn) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.done:
+		return ErrStreamClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	if rtcConn.(*StreamingRTCConn).peer == nil {
-		return
-	}
+// setReady applies a step towards ready, ready is closed once both came
+func (c *StreamingRTCConn) setReady(step func()) {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
 
-	if rtcConn.(*StreamingRTCConn).peer.ConnectionState() != webrtc.PeerConnectionStateClosed {
-		rtcConn.(*StreamingRTCConn).peer.Close()
+	wasReady := c.connected && c.granted
+	step()
+	if !wasReady && c.connected && c.granted {
+		close(c.ready)
 	}
+}
 
-	MapStreamingRtcConn.Delete(channelId)
+// Close tears the publisher down: the stream in progress stops, the station is told the publisher is off
+// air and leaving, then the peer and the station session are closed. It runs once, later and concurrent
+// calls wait for the first to finish. Callbacks of the peer must call it on a goroutine of their own,
+// closing the peer waits for them. channelId is ignored, the connection knows its channel.
+func (c *StreamingRTCConn) Close(channelId string) {
+	c.closeOnce.Do(c.teardown)
 }
 
-func (c *StreamingRTCConn) onWebsocketEvent(event *radiostation.WsMsg) error {
+func (c *StreamingRTCConn) teardown() {
+	// stop a stream in progress right away instead of letting it write into a closed peer
+	close(c.done)
+	c.mix.close()
+	c.rec.close()
+
+	// closing the session drops what is still queued, so both are delivered (or given up) first.
+	// A station that is gone already has nobody to tell.
+	if state := c.ws.State(); state != radiostation.StateDisconnected && state != radiostation.StateClosed {
+		c.sendAndWait(
+			&radiostation.PttPublisher{ChannelId: c.channelId, IsTalk: false},
+			&radiostation.LeavePublisher{ChannelId: c.channelId},
+		)
+	}
+
+	if c.peer.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		if err := c.peer.Close(); err != nil {
+			log.Printf("close publisher peer for channel %s: %v \n", c.channelId, err)
+		}
+	}
+
+	// release the channel session, the shared station socket closes with its last session
+	c.ws.Close()
 
-	// TODO: fix hardcode
-	switch event.Key {
-	case "sd_answer":
-		// unzipData, _ := utils.GzipUncompress(eventData.JsonData)
-		// var answer webrtc.SessionDescription
-		var answerSDP string
-		err := json.Unmarshal(event.Value, &answerSDP)
+	// a newer connection of the channel may be stored already
+	MapStreamingRtcConn.CompareAndDelete(c.channelId, c)
+	c.stats.unregister()
+}
+
+// sendAndWait sends the payloads in order and waits until they are written or dropped, at most leaveTimeout
+func (c *StreamingRTCConn) sendAndWait(payloads ...radiostation.Payload) {
+	delivered := make(chan struct{}, len(payloads))
+	pending := 0
+	for _, p := range payloads {
+		msg, err := radiostation.Encode(c.header(), p)
 		if err != nil {
-			return err
+			log.Printf("radio station %q for channel %s: %v \n", p.Key(), c.channelId, err)
+			continue
+		}
+
+		pending++
+		c.ws.SendAsync(msg, func(err error) {
+			if err != nil {
+				log.Printf("radio station %q for channel %s not delivered: %v \n", msg.Key, c.channelId, err)
+			}
+			delivered <- struct{}{}
+		})
+	}
+
+	timeout := time.After(leaveTimeout)
+	for ; pending > 0; pending-- {
+		select {
+		case <-delivered:
+		case <-timeout:
+			log.Printf("radio station did not take the leave of channel %s within %s \n", c.channelId, leaveTimeout)
+			return
 		}
+	}
+}
 
+func (c *StreamingRTCConn) onWebsocketEvent(event *radiostation.WsMsg) error {
+	payload, err := radiostation.Decode(event)
+	if errors.Is(err, radiostation.ErrUnknownKey) {
+		log.Printf("radio station: skip unknown message %q for channel %s \n", event.Key, event.ChannelId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch p := payload.(type) {
+	case *radiostation.SdAnswer:
 		return c.peer.SetRemoteDescription(webrtc.SessionDescription{
 			Type: webrtc.SDPTypeAnswer,
-			SDP:  answerSDP,
+			SDP:  string(*p),
 		})
 
-	case "ice_candidate":
+	case *radiostation.IceCandidate:
+		return c.addICECandidate(webrtc.ICECandidateInit{
+			Candidate:        p.Candidate,
+			SDPMid:           p.SDPMid,
+			SDPMLineIndex:    p.SDPMLineIndex,
+			UsernameFragment: p.UsernameFragment,
+		})
 
-		var i webrtc.ICECandidateInit
-		err := json.Unmarshal(event.Value, &i)
-		if err != nil {
+	case *radiostation.ConnectPublisher:
+		if err := c.sendPtt(true); err != nil {
 			return err
 		}
+		c.setReady(func() { c.granted = true })
 
-		return c.addICECandidate(i)
-
-	case "connect_publisher":
-		return c.sendPtt()
+	default:
+		log.Printf("radio station: unexpected %q for a publisher \n", p.Key())
 	}
 
 	return nil
 }
 
-func (c *StreamingRTCConn) sendOffer() error {
-	offer, err := c.peer.CreateOffer(nil)
-	if err != nil {
-		return err
-	}
-	if err := c.peer.SetLocalDescription(offer); err != nil {
-		return err
+// onReconnect renegotiates the publisher on the new station session. The audio track is kept,
+// so SendAudioTrack keeps playing from where it was once the station answers.
+func (c *StreamingRTCConn) onReconnect() {
+	if c.peer.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
 	}
 
-	byteJson, _ := json.Marshal(offer)
-	// dataEnc, _ := utils.GzipCompress(string(byteJson))
+	log.Printf("radio station reconnected, renegotiate publisher for channel %s \n", c.channelId)
+	if err := c.sendOffer(&webrtc.OfferOptions{ICERestart: true}); err != nil {
+		log.Printf("renegotiate publisher error: %v \n", err)
+	}
+}
 
-	// send socket signaling, gzip compress data
-	return c.ws.SendMessage(&radiostation.WsMsg{
-		Key:         "session_publisher",
+func (c *StreamingRTCConn) header() radiostation.Header {
+	return radiostation.Header{
 		ClanId:      c.clanId,
 		ChannelId:   c.channelId,
 		UserId:      c.userId,
 		DisplayName: c.displayName,
-		Value:       byteJson,
+	}
+}
+
+// send encodes a typed payload with the routing header of this connection
+func (c *StreamingRTCConn) send(p radiostation.Payload) error {
+	msg, err := radiostation.Encode(c.header(), p)
+	if err != nil {
+		return err
+	}
+
+	// delivery is retried across reconnects, only a final drop is worth a log line
+	return c.ws.SendAsync(msg, func(err error) {
+		if err != nil && !errors.Is(err, radiostation.ErrMessageSuperseded) {
+			log.Printf("radio station %q for channel %s not delivered: %v \n", msg.Key, c.channelId, err)
+		}
 	})
 }
 
-func (c *StreamingRTCConn) sendPtt() error {
-	jsonData, _ := json.Marshal(map[string]interface{}{
-		"ChannelId": c.channelId,
-		"IsTalk":    true,
+func (c *StreamingRTCConn) sendOffer(options *webrtc.OfferOptions) error {
+	offer, err := c.peer.CreateOffer(options)
+	if err != nil {
+		return err
+	}
+	if err := c.peer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	return c.send(&radiostation.SessionPublisher{
+		Type: offer.Type.String(),
+		SDP:  offer.SDP,
 	})
-	return c.ws.SendMessage(&radiostation.WsMsg{
-		Key:         "ptt_publisher",
-		ClanId:      c.clanId,
-		ChannelId:   c.channelId,
-		UserId:      c.userId,
-		DisplayName: c.displayName,
-		Value:       jsonData,
+}
+
+func (c *StreamingRTCConn) sendPtt(talking bool) error {
+	return c.send(&radiostation.PttPublisher{
+		ChannelId: c.channelId,
+		IsTalk:    talking,
 	})
 }
 
-func (c *StreamingRTCConn) onICECandidate(i *webrtc.ICECandidate, clanId, channelId, userId, displayName string) error {
+func (c *StreamingRTCConn) onICECandidate(i *webrtc.ICECandidate) error {
 	if i == nil {
 		return nil
 	}
+	// gathering may still be running while the publisher leaves
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
 	// If you are serializing a candidate make sure to use ToJSON
 	// Using Marshal will result in errors around `sdpMid`
-	candidateString, err := json.Marshal(i.ToJSON())
-	if err != nil {
-		return err
-	}
+	init := i.ToJSON()
 
-	return c.ws.SendMessage(&radiostation.WsMsg{
-		Key:         "ice_candidate",
-		Value:       candidateString,
-		ClanId:      clanId,
-		ChannelId:   channelId,
-		UserId:      userId,
-		DisplayName: displayName,
+	return c.send(&radiostation.IceCandidate{
+		Candidate:        init.Candidate,
+		SDPMid:           init.SDPMid,
+		SDPMLineIndex:    init.SDPMLineIndex,
+		UsernameFragment: init.UsernameFragment,
 	})
 }
 
@@ -251,47 +396,229 @@ func (c *StreamingRTCConn) addICECandidate(i webrtc.ICECandidateInit) error {
 }
 
 func (c *StreamingRTCConn) SendAudioTrack(filePath string) error {
+	return c.PlayAudioTrack(context.Background(), filePath, nil)
+}
+
+// PlayAudioTrack streams the file until EOF, until ctx is done or until the connection closes.
+// pb (optional) pauses, resumes and seeks the stream; the connection stays open for the next file.
+func (c *StreamingRTCConn) PlayAudioTrack(ctx context.Context, filePath string, pb *audio.Playback) error {
+	return playAudio(ctx, c, filePath, pb)
+}
+
+// sink is what the play loops write to: one connection, or a Broadcast whose connections share their tracks
+type sink interface {
+	audio() audioOut
+	closed() <-chan struct{}
+	sendPtt(talking bool) error
+	// video returns the video track for a codec, negotiated and ready to use
+	video(ctx context.Context, codec string) (*webrtc.TrackLocalStaticSample, error)
+	// keyframeRequested reports (and clears) a pending PLI/FIR
+	keyframeRequested() bool
+	// mixer returns the mixer of the audio track, ErrNoMixer without a codec
+	mixer() (*mixer.Mixer, error)
+	// holdTrack stops the mixer and keeps it off the audio track until release, for a movie
+	holdTrack() (release func())
+}
+
+func (c *StreamingRTCConn) audio() audioOut {
+	return audioOut{track: c.audioTrack, tap: &c.rec}
+}
+
+func (c *StreamingRTCConn) closed() <-chan struct{} {
+	return c.done
+}
+
+func (c *StreamingRTCConn) mixer() (*mixer.Mixer, error) {
+	return c.mix.mixer(c.audio())
+}
+
+func (c *StreamingRTCConn) holdTrack() func() {
+	return c.mix.hold()
+}
+
+func playAudio(ctx context.Context, out sink, filePath string, pb *audio.Playback) error {
+	if pb == nil {
+		pb = audio.NewPlayback()
+	}
+	if info, err := audio.ProbeOgg(filePath); err == nil {
+		pb.SetDuration(info.Duration)
+	}
+
+	if mix, ok := mixerOf(out); ok {
+		src, err := openOggStream(filePath, 0)
+		if err != nil {
+			return err
+		}
+		return playMixed(ctx, out, mix, src, func(to time.Duration) (audio.Source, error) {
+			return openOggStream(filePath, to)
+		}, pb)
+	}
+
+	gain, _ := pb.TakeGain()
+	stream, err := openAudio(filePath, 0, gain)
+	if err != nil {
+		return err
+	}
+
+	// pages carry no index, a seek re-reads the file up to the target packet
+	return playPackets(ctx, out, stream, func(to time.Duration) (audio.Source, error) {
+		return openAudio(filePath, to, pb.Gain())
+	}, pb)
+}
+
+// openAudio opens an Ogg Opus file at offset, re-encoded by the processor when gain changes the audio
+func openAudio(filePath string, offset time.Duration, gain float64) (audio.Source, error) {
+	if gain == 1 || processor == nil {
+		return openOggStream(filePath, offset)
+	}
+	return processor(filePath, offset, gain)
+}
+
+// PlayOverlay mixes an Ogg Opus file over whatever plays until it ends or ctx is done: an announcement
+// (mixer.Voice) ducks the music, an effect (mixer.Effect) plays over it as it is. It needs a codec, see SetCodec.
+func (c *StreamingRTCConn) PlayOverlay(ctx context.Context, filePath string, role mixer.Role, gain float64) error {
+	return playOverlay(ctx, c, filePath, role, gain)
+}
+
+// Record copies the published audio to rec until the connection closes or Record is called again,
+// nil stops recording. rec is closed then.
+func (c *StreamingRTCConn) Record(rec Recorder) {
+	c.rec.set(rec)
+}
 
-	// Open a OGG file and start reading using our OGGReader
-	file, oggErr := os.Open(filePath)
-	if oggErr != nil {
-		return oggErr
+// mixerOf returns the mixer to play the programme through, false to send packets as they are read
+func mixerOf(out sink) (*mixer.Mixer, bool) {
+	mix, err := out.mixer()
+	if err != nil {
+		if !errors.Is(err, ErrNoMixer) {
+			log.Printf("mixer unavailable, playing unmixed: %v \n", err)
+		}
+		return nil, false
 	}
+	return mix, true
+}
+
+// PlaySource streams packets until the source ends, until ctx is done or until the connection closes.
+// The source is closed on return. It can not seek, pb only pauses and resumes it.
+func (c *StreamingRTCConn) PlaySource(ctx context.Context, src audio.Source, pb *audio.Playback) error {
+	return playSource(ctx, c, src, pb)
+}
 
-	// Open on oggfile in non-checksum mode.
-	ogg, _, oggErr := oggreader.NewWith(file)
-	if oggErr != nil {
-		return oggErr
+func playSource(ctx context.Context, out sink, src audio.Source, pb *audio.Playback) error {
+	if pb == nil {
+		pb = audio.NewPlayback()
 	}
+	if mix, ok := mixerOf(out); ok {
+		return playMixed(ctx, out, mix, src, nil, pb)
+	}
+	if gainSrc, ok := src.(audio.GainSource); ok {
+		gain, _ := pb.TakeGain()
+		gainSrc.SetGain(gain)
+	}
+	return playPackets(ctx, out, src, nil, pb)
+}
 
-	// Keep track of last granule, the difference is the amount of samples in the buffer
-	var lastGranule uint64
+// playPackets sends src on its own schedule and closes it on return. reopen restarts the stream at a
+// seek target or with a new gain, seeks and gains are dropped when it is nil unless src applies gains.
+func playPackets(ctx context.Context, out sink, src audio.Source, reopen func(to time.Duration) (audio.Source, error), pb *audio.Playback) error {
+	defer func() { src.Close() }()
+
+	// packets are due on a monotonic schedule, so a late wake up shortens the next wait instead of adding up
+	pacer := audio.NewPacer()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		timer.Reset(pacer.Wait())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.closed():
+			return ErrStreamClosed
+		case <-timer.C:
+		}
 
-	// It is important to use a time.Ticker instead of time.Sleep because
-	// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
-	// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-	ticker := time.NewTicker(20 * time.Millisecond)
-	defer ticker.Stop()
-	for ; true; <-ticker.C {
-		pageData, pageHeader, oggErr := ogg.ParseNextPage()
-		if errors.Is(oggErr, io.EOF) {
+		to, seek := pb.TakeSeek()
+		if gain, ok := pb.TakeGain(); ok {
+			if gainSrc, ok := src.(audio.GainSource); ok {
+				gainSrc.SetGain(gain)
+			} else if !seek {
+				to, seek = src.Position(), true
+			}
+		}
+		if seek && reopen != nil {
+			seeked, err := reopen(to)
+			if err != nil {
+				return err
+			}
+			src.Close()
+			src = seeked
+			pacer.Reset()
+		}
+
+		if pb.Paused() {
+			if err := waitResume(ctx, out, pb); err != nil {
+				return err
+			}
+			pacer.Reset()
+			continue
+		}
+
+		packet, err := src.ReadPacket()
+		if errors.Is(err, io.EOF) {
 			log.Println("All audio pages parsed and sent")
 			return nil
 		}
+		if err != nil {
+			return err
+		}
 
-		if oggErr != nil {
-			return oggErr
+		if err := out.audio().WriteSample(media.Sample{Data: packet.Data, Duration: packet.Duration}); err != nil {
+			return err
 		}
+		pacer.Sent(packet.Duration)
+		pb.SetPosition(src.Position())
+	}
+}
 
-		// The amount of samples is the difference between the last and current timestamp
-		sampleCount := float64(pageHeader.GranulePosition - lastGranule)
-		lastGranule = pageHeader.GranulePosition
-		sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
+// waitResume stops talking while the stream is paused, so the station does not hold an idle publisher on air
+func waitResume(ctx context.Context, out sink, pb *audio.Playback) error {
+	if err := out.sendPtt(false); err != nil {
+		log.Printf("send ptt_publisher error: %v \n", err)
+	}
 
-		if oggErr = c.audioTrack.WriteSample(media.Sample{Data: pageData, Duration: sampleDuration}); oggErr != nil {
-			return oggErr
+	for pb.Paused() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.closed():
+			return ErrStreamClosed
+		case <-pb.Wake():
 		}
 	}
-	return nil
 
+	return out.sendPtt(true)
+}
+
+// oggStream is an Ogg Opus file read packet by packet
+type oggStream struct {
+	*audio.OpusReader
+	file *os.File
+}
+
+// openOggStream opens the file positioned on the first packet that ends after offset
+func openOggStream(filePath string, offset time.Duration) (*oggStream, error) {
+	file, reader, err := audio.OpenOpusFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.SkipTo(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &oggStream{OpusReader: reader, file: file}, nil
+}
+
+func (s *oggStream) Close() error {
+	return s.file.Close()
 }
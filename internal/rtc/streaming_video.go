@@ -0,0 +1,311 @@
+package rtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	audio "mezon-go-bot/internal/media"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	// negotiationTimeout bounds the wait for the station to answer the offer carrying a new video track
+	negotiationTimeout = 5 * time.Second
+
+	// keyframeRequestInterval ignores PLI/FIR bursts and requests sent before the last keyframe arrived,
+	// each answered request costs a short freeze
+	keyframeRequestInterval = time.Second
+)
+
+var ErrNegotiationTimeout = errors.New("radio station did not answer the video offer")
+
+// PlayVideoTrack streams an IVF video (VP8/VP9) with its Ogg Opus sound track, audioPath may be
+// empty. Audio and video are paced on one clock by their timestamps, so they stay in sync across
+// pauses and seeks. pb works like in PlayAudioTrack.
+func (c *StreamingRTCConn) PlayVideoTrack(ctx context.Context, videoPath, audioPath string, pb *audio.Playback) error {
+	return playVideo(ctx, c, videoPath, audioPath, pb)
+}
+
+func playVideo(ctx context.Context, out sink, videoPath, audioPath string, pb *audio.Playback) error {
+	if pb == nil {
+		pb = audio.NewPlayback()
+	}
+
+	video, err := audio.OpenIVF(videoPath)
+	if err != nil {
+		return err
+	}
+	defer func() { video.Close() }()
+
+	// the sound is paced with the frames and written to the track as it is read
+	defer out.holdTrack()()
+
+	var sound audio.Source
+	if audioPath != "" {
+		gain, _ := pb.TakeGain()
+		if sound, err = openAudio(audioPath, 0, gain); err != nil {
+			return err
+		}
+		defer func() { sound.Close() }()
+
+		if info, err := audio.ProbeOgg(audioPath); err == nil {
+			pb.SetDuration(info.Duration)
+		}
+	} else if duration, err := audio.ProbeIVF(videoPath); err == nil {
+		pb.SetDuration(duration)
+	}
+
+	track, err := out.video(ctx, video.Codec)
+	if err != nil {
+		return err
+	}
+
+	// requests from an earlier movie are answered by the first frame of this one anyway
+	out.keyframeRequested()
+
+	soundDone := sound == nil
+	var lastKeyframe time.Time
+	pacer := audio.NewPacer()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		// the stream whose next packet is due first goes next
+		next, videoLeft := video.Next()
+		sendSound := !soundDone && (!videoLeft || sound.Position() <= next)
+		if sendSound {
+			next = sound.Position()
+		} else if !videoLeft {
+			log.Println("All video frames parsed and sent")
+			return nil
+		}
+
+		timer.Reset(pacer.Until(next))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.closed():
+			return ErrStreamClosed
+		case <-timer.C:
+		}
+
+		if to, ok := pb.TakeSeek(); ok {
+			seeked, err := audio.OpenIVF(videoPath)
+			if err != nil {
+				return err
+			}
+			video.Close()
+			video = seeked
+			// the picture resumes on the first keyframe after the target
+			video.SkipToKeyframe(to)
+
+			if audioPath != "" {
+				seekedSound, err := openAudio(audioPath, to, pb.Gain())
+				if err != nil {
+					return err
+				}
+				sound.Close()
+				sound = seekedSound
+				soundDone = false
+			}
+			pacer.Reset()
+			continue
+		}
+
+		if _, ok := pb.TakeGain(); ok && sound != nil && !soundDone {
+			// the sound track is re-encoded with the new gain from where it is, the picture goes on
+			regained, err := openAudio(audioPath, sound.Position(), pb.Gain())
+			if err != nil {
+				return err
+			}
+			sound.Close()
+			sound = regained
+		}
+
+		if pb.Paused() {
+			if err := waitResume(ctx, out, pb); err != nil {
+				return err
+			}
+			pacer.Reset()
+			continue
+		}
+
+		if sendSound {
+			packet, err := sound.ReadPacket()
+			if errors.Is(err, io.EOF) {
+				soundDone = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := out.audio().WriteSample(media.Sample{Data: packet.Data, Duration: packet.Duration}); err != nil {
+				return err
+			}
+			pb.SetPosition(sound.Position())
+			continue
+		}
+
+		frame, err := video.ReadFrame()
+		if err != nil {
+			return err
+		}
+		// a request right after a keyframe most likely crossed it on the way and is dropped
+		if !frame.Keyframe && out.keyframeRequested() && time.Since(lastKeyframe) > keyframeRequestInterval {
+			frame = nextKeyframe(video, frame)
+		}
+		if frame.Keyframe {
+			lastKeyframe = time.Now()
+		}
+
+		if err := track.WriteSample(media.Sample{Data: frame.Data, Duration: frame.Duration}); err != nil {
+			return err
+		}
+		if soundDone {
+			pb.SetPosition(frame.Timestamp + frame.Duration)
+		}
+	}
+}
+
+// nextKeyframe answers a keyframe request without an encoder: the next keyframe of the file is sent in
+// place of frame, stretched over the frames it replaces. The picture freezes until then instead of
+// staying broken until the keyframe would have come, and the timeline is unchanged.
+func nextKeyframe(video *audio.IVFReader, frame audio.VideoFrame) audio.VideoFrame {
+	video.SkipToKeyframe(frame.Timestamp)
+	keyframe, err := video.ReadFrame()
+	if err != nil {
+		// no keyframe left, the movie ends broken but on time
+		return frame
+	}
+
+	keyframe.Duration += keyframe.Timestamp - frame.Timestamp
+	keyframe.Timestamp = frame.Timestamp
+	return keyframe
+}
+
+func (c *StreamingRTCConn) keyframeRequested() bool {
+	select {
+	case <-c.keyframeWant:
+		return true
+	default:
+		return false
+	}
+}
+
+// video returns the video track for codec. A new track (or a codec change) is renegotiated with the
+// station before it is used, otherwise the first keyframe would go nowhere.
+func (c *StreamingRTCConn) video(ctx context.Context, codec string) (*webrtc.TrackLocalStaticSample, error) {
+	c.videoMu.Lock()
+	defer c.videoMu.Unlock()
+
+	if c.videoTrack != nil && c.videoTrack.Codec().MimeType == videoMimeType(codec) {
+		return c.videoTrack, nil
+	}
+
+	track, err := newVideoTrack(codec, c.channelId)
+	if err != nil {
+		return nil, err
+	}
+	return track, c.setVideoTrackLocked(ctx, track)
+}
+
+// setVideoTrackLocked replaces the video track and renegotiates, must be called with videoMu held
+func (c *StreamingRTCConn) setVideoTrackLocked(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	// a new session may still wait for the answer to its first offer
+	if err := c.waitNegotiated(ctx); err != nil {
+		return err
+	}
+
+	if c.videoSender != nil {
+		if err := c.peer.RemoveTrack(c.videoSender); err != nil {
+			return err
+		}
+	}
+	sender, err := c.peer.AddTrack(track)
+	if err != nil {
+		return err
+	}
+	go c.readVideoRTCP(sender)
+
+	c.videoTrack, c.videoSender = track, sender
+	if err := c.sendOffer(nil); err != nil {
+		return err
+	}
+	return c.waitNegotiated(ctx)
+}
+
+func videoMimeType(codec string) string {
+	switch codec {
+	case audio.CodecVP8:
+		return webrtc.MimeTypeVP8
+	case audio.CodecVP9:
+		return webrtc.MimeTypeVP9
+	}
+	return ""
+}
+
+func newVideoTrack(codec, streamId string) (*webrtc.TrackLocalStaticSample, error) {
+	mimeType := videoMimeType(codec)
+	if mimeType == "" {
+		return nil, fmt.Errorf("%w: %s", audio.ErrUnsupportedVideo, codec)
+	}
+
+	id := fmt.Sprintf("video_%s_%s", strings.ToLower(codec), streamId)
+	return webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, id, id)
+}
+
+// waitNegotiated waits for the station answer to the last offer and for ICE to connect
+func (c *StreamingRTCConn) waitNegotiated(ctx context.Context) error {
+	deadline := time.After(negotiationTimeout)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !c.negotiated() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return ErrStreamClosed
+		case <-deadline:
+			return ErrNegotiationTimeout
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// readVideoRTCP turns PLI and FIR from the receivers into keyframe requests and feeds the stats. Reading
+// also drives the interceptors (NACK), like the audio sender loop.
+func (c *StreamingRTCConn) readVideoRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		c.stats.observe(true, packets)
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				select {
+				case c.keyframeWant <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *StreamingRTCConn) negotiated() bool {
+	if c.peer.SignalingState() != webrtc.SignalingStateStable {
+		return false
+	}
+	state := c.peer.ICEConnectionState()
+	return state == webrtc.ICEConnectionStateConnected || state == webrtc.ICEConnectionStateCompleted
+}
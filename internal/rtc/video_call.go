@@ -9,7 +9,7 @@ import (
 	"image/jpeg"
 	"io"
 	"log"
-	"os"
+	audio "mezon-go-bot/internal/media"
 	"sync"
 	"time"
 
@@ -23,7 +23,6 @@ import (
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
 	"golang.org/x/image/vp8"
 )
@@ -44,6 +43,15 @@ type callRTCConn struct {
 	rtpChan                 chan *rtp.Packet
 	snapShootCount          int
 	isVideoCall             bool
+	stats                   *streamStats
+
+	// recorded calls play recordingNoticeFile once connected, and only then get a recorder
+	recorded            bool
+	recordingNoticeFile string
+
+	mu        sync.Mutex
+	recording CallRecorder // gets the tracks of the call, nil until the caller heard the notice
+	closed    bool
 }
 
 type callService struct {
@@ -56,6 +64,19 @@ type callService struct {
 	acceptCallAudioFile     string
 	exitCallAudioFile       string
 	onImage                 func(imgBase64 string) error
+
+	records             func(channelId string) bool
+	record              func(channelId, userId string) CallRecorder
+	recordingNoticeFile string
+	prompts             func(channelId string) CallPrompts
+}
+
+// CallPrompts are the audio files played in a call, empty ones keep the files set on the service
+type CallPrompts struct {
+	AcceptCall     string
+	ExitCall       string
+	CheckinSuccess string
+	CheckinFail    string
 }
 
 type ICallService interface {
@@ -64,6 +85,8 @@ type ICallService interface {
 	SetCheckinFailFileAudio(filePath string)
 	SetAcceptCallFileAudio(filePath string)
 	SetExitCallFileAudio(filePath string)
+	SetPrompts(prompts func(channelId string) CallPrompts)
+	SetRecorder(records func(channelId string) bool, record func(channelId, userId string) CallRecorder, noticeFilePath string)
 	OnWebsocketEvent(event *rtapi.Envelope) error
 	GetRTCConnectionState(channelId string) webrtc.PeerConnectionState
 }
@@ -93,15 +116,18 @@ func (c *callService) newCallRTCConnection(channelId, receiverId string) (*callR
 		return nil, err
 	}
 
+	stats := newStreamStats(StreamCall, channelId)
+
 	// Read incoming RTCP packets
 	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
+	// like NACK this needs to be called. The receiver reports feed the stats of the call.
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			stats.observe(false, packets)
 		}
 	}()
 
@@ -119,6 +145,14 @@ func (c *callService) newCallRTCConnection(channelId, receiverId string) (*callR
 		snapShootCount:          c.snapShootCount,
 		rtpChan:                 make(chan *rtp.Packet),
 		isVideoCall:             false,
+		stats:                   stats,
+		recordingNoticeFile:     c.recordingNoticeFile,
+	}
+	if c.prompts != nil {
+		rtcConnection.usePrompts(c.prompts(channelId))
+	}
+	if c.records != nil && c.recordingNoticeFile != "" {
+		rtcConnection.recorded = c.records(channelId)
 	}
 	mapCallRtcConn.Store(channelId, rtcConnection)
 
@@ -130,9 +164,17 @@ func (c *callService) newCallRTCConnection(channelId, receiverId string) (*callR
 	})
 
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		// the track is written once the recording started, see startRecording
+		var writer media.Writer
+		record := rtcConnection.recorded
 
 		// save image by time receive track
-		if rtcConnection.snapShootCount > 0 && track.Kind() == webrtc.RTPCodecTypeVideo {
+		snapshot := rtcConnection.snapShootCount > 0 && track.Kind() == webrtc.RTPCodecTypeVideo
+		if !snapshot && !record {
+			return
+		}
+
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
 			// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
 			go func() {
 				ticker := time.NewTicker(time.Second * 3)
@@ -143,18 +185,39 @@ func (c *callService) newCallRTCConnection(channelId, receiverId string) (*callR
 					}
 				}
 			}()
+		}
 
-			for {
-				// Read RTP Packets in a loop
-				rtpPacket, _, readErr := track.ReadRTP()
-				if readErr != nil {
-					log.Printf("track read rtp error: %+v \n", readErr)
+		for {
+			// Read RTP Packets in a loop
+			rtpPacket, _, readErr := track.ReadRTP()
+			if readErr != nil {
+				log.Printf("track read rtp error: %+v \n", readErr)
+				if snapshot {
 					c.onICEConnectionStateChange(webrtc.ICEConnectionStateClosed, channelId, receiverId)
-					return
 				}
+				return
+			}
 
-				// Use a lossy channel to send packets to snapshot handler
-				// We don't want to block and queue up old data
+			if record && writer == nil {
+				if rec := rtcConnection.currentRecording(); rec != nil {
+					w, err := rec.Track(track.Kind().String(), track.Codec().MimeType)
+					if err != nil {
+						log.Printf("record %s track error: %v \n", track.Kind(), err)
+						record = false
+					}
+					writer = w
+				}
+			}
+			if writer != nil {
+				if err := writer.WriteRTP(rtpPacket); err != nil {
+					log.Printf("record %s track error, track not recorded any more: %v \n", track.Kind(), err)
+					writer, record = nil, false
+				}
+			}
+
+			// Use a lossy channel to send packets to snapshot handler
+			// We don't want to block and queue up old data
+			if snapshot {
 				select {
 				case rtcConnection.rtpChan <- rtpPacket:
 				default:
@@ -298,11 +361,19 @@ func (c *callService) onICEConnectionStateChange(state webrtc.ICEConnectionState
 
 	switch state {
 	case webrtc.ICEConnectionStateConnected:
+		if rtcConn.(*callRTCConn).recorded {
+			// nothing is recorded before the caller heard the notice, nor when it could not be played
+			if err := rtcConn.(*callRTCConn).sendAudioTrack(rtcConn.(*callRTCConn).recordingNoticeFile); err != nil {
+				log.Printf("play recording notice error, call not recorded: %v \n", err)
+			} else if rec := c.record(channelId, receiverId); rec != nil {
+				rtcConn.(*callRTCConn).startRecording(rec)
+			}
+		}
 		if rtcConn.(*callRTCConn).isVideoCall {
-			rtcConn.(*callRTCConn).sendAudioTrack(c.acceptCallAudioFile)
+			rtcConn.(*callRTCConn).sendAudioTrack(rtcConn.(*callRTCConn).acceptCallAudioFile)
 			rtcConn.(*callRTCConn).saveTrackToImage(c.onImage, receiverId)
 		} else {
-			rtcConn.(*callRTCConn).sendAudioTrack(c.exitCallAudioFile)
+			rtcConn.(*callRTCConn).sendAudioTrack(rtcConn.(*callRTCConn).exitCallAudioFile)
 			c.onICEConnectionStateChange(webrtc.ICEConnectionStateClosed, channelId, receiverId)
 		}
 
@@ -311,6 +382,8 @@ func (c *callService) onICEConnectionStateChange(state webrtc.ICEConnectionState
 			rtcConn.(*callRTCConn).peer.Close()
 		}
 
+		rtcConn.(*callRTCConn).stopRecording()
+		rtcConn.(*callRTCConn).stats.unregister()
 		mapCallRtcConn.Delete(channelId)
 	}
 }
@@ -331,55 +404,101 @@ func (c *callService) SetCheckinFailFileAudio(filePath string) {
 	c.checkinFailAudioFile = filePath
 }
 
+// SetPrompts picks the prompts of each call by its channel, over the files set on the service
+func (c *callService) SetPrompts(prompts func(channelId string) CallPrompts) {
+	c.prompts = prompts
+}
+
+// SetRecorder records the calls on the channels records reports. noticeFilePath is played to tell the
+// caller once connected, then record starts the recorder; it returns nil when the call can not be recorded.
+func (c *callService) SetRecorder(records func(channelId string) bool, record func(channelId, userId string) CallRecorder, noticeFilePath string) {
+	c.records = records
+	c.record = record
+	c.recordingNoticeFile = noticeFilePath
+}
+
 func (c *callService) SetOnImage(onImage func(imgBase64 string) error, snapShootCount int) {
 	c.snapShootCount = snapShootCount
 	c.onImage = onImage
 }
 
-func (c *callRTCConn) sendAudioTrack(filePath string) error {
+func (c *callRTCConn) usePrompts(prompts CallPrompts) {
+	for _, p := range []struct {
+		file *string
+		use  string
+	}{
+		{&c.acceptCallAudioFile, prompts.AcceptCall},
+		{&c.exitCallAudioFile, prompts.ExitCall},
+		{&c.checkinSuccessAudioFile, prompts.CheckinSuccess},
+		{&c.checkinFailAudioFile, prompts.CheckinFail},
+	} {
+		if p.use != "" {
+			*p.file = p.use
+		}
+	}
+}
+
+// startRecording attaches the recorder, the tracks are written from their next packet. A call that
+// closed meanwhile is not recorded.
+func (c *callRTCConn) startRecording(rec CallRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Open a OGG file and start reading using our OGGReader
-	file, oggErr := os.Open(filePath)
-	if oggErr != nil {
-		return oggErr
+	if c.closed {
+		if err := rec.Close(); err != nil {
+			log.Printf("close call recording error: %v \n", err)
+		}
+		return
+	}
+	c.recording = rec
+}
+
+func (c *callRTCConn) currentRecording() CallRecorder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recording
+}
+
+// stopRecording closes the recorder with the call
+func (c *callRTCConn) stopRecording() {
+	c.mu.Lock()
+	rec := c.recording
+	c.recording, c.closed = nil, true
+	c.mu.Unlock()
+
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Printf("close call recording error: %v \n", err)
+		}
 	}
+}
 
-	// Open on oggfile in non-checksum mode.
-	ogg, _, oggErr := oggreader.NewWith(file)
-	if oggErr != nil {
-		return oggErr
+func (c *callRTCConn) sendAudioTrack(filePath string) error {
+	stream, err := openOggStream(filePath, 0)
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	// Keep track of last granule, the difference is the amount of samples in the buffer
-	var lastGranule uint64
-
-	// It is important to use a time.Ticker instead of time.Sleep because
-	// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
-	// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-	ticker := time.NewTicker(20 * time.Millisecond)
-	defer ticker.Stop()
-	for ; true; <-ticker.C {
-		pageData, pageHeader, oggErr := ogg.ParseNextPage()
-		if errors.Is(oggErr, io.EOF) {
+	// Sleep overshoot is harmless here: the pacer shortens the next wait by as much
+	pacer := audio.NewPacer()
+	for {
+		time.Sleep(pacer.Wait())
+
+		packet, err := stream.ReadPacket()
+		if errors.Is(err, io.EOF) {
 			log.Println("All audio pages parsed and sent")
 			return nil
 		}
-
-		if oggErr != nil {
-			return oggErr
+		if err != nil {
+			return err
 		}
 
-		// The amount of samples is the difference between the last and current timestamp
-		sampleCount := float64(pageHeader.GranulePosition - lastGranule)
-		lastGranule = pageHeader.GranulePosition
-		sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
-
-		if oggErr = c.audioTrack.WriteSample(media.Sample{Data: pageData, Duration: sampleDuration}); oggErr != nil {
-			return oggErr
+		if err := c.audioTrack.WriteSample(media.Sample{Data: packet.Data, Duration: packet.Duration}); err != nil {
+			return err
 		}
+		pacer.Sent(packet.Duration)
 	}
-	return nil
-
 }
 
 func (c *callRTCConn) saveTrackToImage(onImage func(imgBase64 string) error, receiverId string) error {
@@ -0,0 +1,341 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	KEY_BROADCAST_CHANNEL = "broadcast_channel"
+	KEY_LANGUAGE          = "language"
+	KEY_PREFIX            = "prefix"
+	KEY_MODULES           = "modules"
+	KEY_CHECKIN_CHANNEL   = "checkin_channel"
+	KEY_NOTIFY_CHANNELS   = "notify_channels"
+	KEY_VOLUME            = "volume"
+	KEY_SOUNDBOARD_USERS  = "soundboard_users"
+	KEY_RECORDING         = "recording"
+)
+
+const (
+	RecordingOn  = "on"
+	RecordingOff = "off"
+)
+
+const (
+	// DefaultVolume is the volume, in percent of the normalized loudness, of a channel without the setting
+	DefaultVolume = 100
+	MaxVolume     = 200
+)
+
+// Keys lists every setting that can be managed from chat, in display order.
+var Keys = []string{
+	KEY_BROADCAST_CHANNEL,
+	KEY_LANGUAGE,
+	KEY_PREFIX,
+	KEY_MODULES,
+	KEY_CHECKIN_CHANNEL,
+	KEY_NOTIFY_CHANNELS,
+	KEY_VOLUME,
+	KEY_SOUNDBOARD_USERS,
+	KEY_RECORDING,
+}
+
+var (
+	ErrUnknownKey   = errors.New("unknown setting key")
+	ErrInvalidValue = errors.New("invalid setting value")
+)
+
+// Settings holds the bot behaviour for a clan or a single channel.
+// Empty fields are unset and fall back to the enclosing scope.
+type Settings struct {
+	BroadcastChannelId string   `json:"broadcast_channel_id,omitempty"`
+	Language           string   `json:"language,omitempty"`
+	Prefix             string   `json:"prefix,omitempty"`
+	Modules            []string `json:"modules,omitempty"`
+	CheckinChannelId   string   `json:"checkin_channel_id,omitempty"`
+	NotifyChannelIds   []string `json:"notify_channel_ids,omitempty"`
+	// Volume is kept as text like the other values, so 0 (muted) is not mistaken for unset
+	Volume string `json:"volume,omitempty"`
+	// SoundboardUserIds may play soundboard clips, everyone when empty
+	SoundboardUserIds []string `json:"soundboard_user_ids,omitempty"`
+	// Recording is on or off, a channel can opt out of a clan that records
+	Recording string `json:"recording,omitempty"`
+}
+
+// ModuleEnabled reports whether the module (command) is enabled.
+// An unset module list enables everything.
+func (s Settings) ModuleEnabled(module string) bool {
+	if len(s.Modules) == 0 {
+		return true
+	}
+
+	for _, m := range s.Modules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// SoundboardAllowed reports whether the user may play soundboard clips.
+// An unset list allows everyone.
+func (s Settings) SoundboardAllowed(userId string) bool {
+	return len(s.SoundboardUserIds) == 0 || slices.Contains(s.SoundboardUserIds, userId)
+}
+
+// RecordingEnabled reports whether broadcasts and calls are recorded, off when unset
+func (s Settings) RecordingEnabled() bool {
+	return s.Recording == RecordingOn
+}
+
+// VolumePercent is the playback volume of a voice channel, DefaultVolume when unset
+func (s Settings) VolumePercent() int {
+	if volume, err := strconv.Atoi(s.Volume); err == nil {
+		return volume
+	}
+	return DefaultVolume
+}
+
+// ParseVolume reads a volume in percent, "80" or "80%", within 0-MaxVolume
+func ParseVolume(value string) (int, error) {
+	volume, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "%"))
+	if err != nil || volume < 0 || volume > MaxVolume {
+		return 0, fmt.Errorf("%w: volume must be 0-%d", ErrInvalidValue, MaxVolume)
+	}
+	return volume, nil
+}
+
+// Value returns the display value of a key.
+func (s Settings) Value(key string) (string, error) {
+	switch key {
+	case KEY_BROADCAST_CHANNEL:
+		return s.BroadcastChannelId, nil
+	case KEY_LANGUAGE:
+		return s.Language, nil
+	case KEY_PREFIX:
+		return s.Prefix, nil
+	case KEY_MODULES:
+		return strings.Join(s.Modules, ","), nil
+	case KEY_CHECKIN_CHANNEL:
+		return s.CheckinChannelId, nil
+	case KEY_NOTIFY_CHANNELS:
+		return strings.Join(s.NotifyChannelIds, ","), nil
+	case KEY_VOLUME:
+		return s.Volume, nil
+	case KEY_SOUNDBOARD_USERS:
+		return strings.Join(s.SoundboardUserIds, ","), nil
+	case KEY_RECORDING:
+		return s.Recording, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownKey, key)
+}
+
+// set assigns a key, an empty value unsets it.
+func (s *Settings) set(key, value string) error {
+	value = strings.TrimSpace(value)
+
+	switch key {
+	case KEY_BROADCAST_CHANNEL:
+		s.BroadcastChannelId = value
+	case KEY_LANGUAGE:
+		s.Language = strings.ToLower(value)
+	case KEY_PREFIX:
+		if strings.ContainsAny(value, " \t\n") || len(value) > 3 {
+			return fmt.Errorf("%w: prefix must be 1-3 characters without spaces", ErrInvalidValue)
+		}
+		s.Prefix = value
+	case KEY_MODULES:
+		s.Modules = splitList(value)
+	case KEY_CHECKIN_CHANNEL:
+		s.CheckinChannelId = value
+	case KEY_NOTIFY_CHANNELS:
+		s.NotifyChannelIds = splitList(value)
+	case KEY_VOLUME:
+		if value != "" {
+			volume, err := ParseVolume(value)
+			if err != nil {
+				return err
+			}
+			value = strconv.Itoa(volume)
+		}
+		s.Volume = value
+	case KEY_SOUNDBOARD_USERS:
+		s.SoundboardUserIds = splitList(value)
+	case KEY_RECORDING:
+		value = strings.ToLower(value)
+		if value != "" && value != RecordingOn && value != RecordingOff {
+			return fmt.Errorf("%w: recording must be %s or %s", ErrInvalidValue, RecordingOn, RecordingOff)
+		}
+		s.Recording = value
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownKey, key)
+	}
+	return nil
+}
+
+func (s Settings) isEmpty() bool {
+	return s.BroadcastChannelId == "" && s.Language == "" && s.Prefix == "" &&
+		len(s.Modules) == 0 && s.CheckinChannelId == "" && len(s.NotifyChannelIds) == 0 && s.Volume == "" &&
+		len(s.SoundboardUserIds) == 0 && s.Recording == ""
+}
+
+// merge overlays the set fields of o on top of s
+func (s Settings) merge(o Settings) Settings {
+	if o.BroadcastChannelId != "" {
+		s.BroadcastChannelId = o.BroadcastChannelId
+	}
+	if o.Language != "" {
+		s.Language = o.Language
+	}
+	if o.Prefix != "" {
+		s.Prefix = o.Prefix
+	}
+	if len(o.Modules) > 0 {
+		s.Modules = o.Modules
+	}
+	if o.CheckinChannelId != "" {
+		s.CheckinChannelId = o.CheckinChannelId
+	}
+	if len(o.NotifyChannelIds) > 0 {
+		s.NotifyChannelIds = o.NotifyChannelIds
+	}
+	if o.Volume != "" {
+		s.Volume = o.Volume
+	}
+	if len(o.SoundboardUserIds) > 0 {
+		s.SoundboardUserIds = o.SoundboardUserIds
+	}
+	if o.Recording != "" {
+		s.Recording = o.Recording
+	}
+	return s
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+type IStore interface {
+	// Get returns the effective settings: defaults <- clan <- channel
+	Get(clanId, channelId string) Settings
+	// Scope returns the settings stored for exactly one scope, channelId empty is the clan scope
+	Scope(clanId, channelId string) Settings
+	Set(clanId, channelId, key, value string) error
+}
+
+type fileStore struct {
+	mu       sync.RWMutex
+	path     string
+	defaults Settings
+	scopes   map[string]Settings
+}
+
+// NewFileStore loads (or creates) a JSON settings file at path.
+func NewFileStore(path string, defaults Settings) (IStore, error) {
+	s := &fileStore{
+		path:     path,
+		defaults: defaults,
+		scopes:   make(map[string]Settings),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.scopes); err != nil {
+			return nil, fmt.Errorf("settings file %s: %w", path, err)
+		}
+	}
+
+	return s, nil
+}
+
+func scopeKey(clanId, channelId string) string {
+	if channelId == "" {
+		return clanId
+	}
+	return clanId + "/" + channelId
+}
+
+func (s *fileStore) Get(clanId, channelId string) Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	effective := s.defaults.merge(s.scopes[scopeKey(clanId, "")])
+	if channelId != "" {
+		effective = effective.merge(s.scopes[scopeKey(clanId, channelId)])
+	}
+	return effective
+}
+
+func (s *fileStore) Scope(clanId, channelId string) Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.scopes[scopeKey(clanId, channelId)]
+}
+
+func (s *fileStore) Set(clanId, channelId, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := scopeKey(clanId, channelId)
+	scope := s.scopes[k]
+	if err := scope.set(key, value); err != nil {
+		return err
+	}
+
+	// the change goes to a copy, memory keeps agreeing with the file when the save fails
+	scopes := maps.Clone(s.scopes)
+	if scope.isEmpty() {
+		delete(scopes, k)
+	} else {
+		scopes[k] = scope
+	}
+
+	if err := s.save(scopes); err != nil {
+		return err
+	}
+	s.scopes = scopes
+	return nil
+}
+
+// save writes scopes to a temp file and renames it, so a crash never leaves a half written file
+func (s *fileStore) save(scopes map[string]Settings) error {
+	data, err := json.MarshalIndent(scopes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
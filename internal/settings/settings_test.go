@@ -0,0 +1,183 @@
+package settings
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreResolvesScopes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	store, err := NewFileStore(path, Settings{Language: "en", Prefix: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := []struct{ clanId, channelId, key, value string }{
+		{"clan", "", KEY_LANGUAGE, "VI"},
+		{"clan", "", KEY_VOLUME, "80%"},
+		{"clan", "", KEY_RECORDING, "on"},
+		{"clan", "music", KEY_VOLUME, "0"},
+		{"clan", "music", KEY_RECORDING, "off"},
+		{"clan", "music", KEY_MODULES, "ncc8, radio,"},
+		{"other", "", KEY_PREFIX, "!"},
+	}
+	for _, s := range sets {
+		if err := store.Set(s.clanId, s.channelId, s.key, s.value); err != nil {
+			t.Fatalf("set %s=%q: %v", s.key, s.value, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		clanId    string
+		channelId string
+		key       string
+		want      string
+	}{
+		{name: "default", clanId: "clan", channelId: "music", key: KEY_PREFIX, want: "*"},
+		{name: "clan over default", clanId: "clan", key: KEY_LANGUAGE, want: "vi"},
+		{name: "clan in a channel without the key", clanId: "clan", channelId: "general", key: KEY_VOLUME, want: "80"},
+		{name: "channel over clan", clanId: "clan", channelId: "music", key: KEY_VOLUME, want: "0"},
+		{name: "channel opts out", clanId: "clan", channelId: "music", key: KEY_RECORDING, want: "off"},
+		{name: "channel list", clanId: "clan", channelId: "music", key: KEY_MODULES, want: "ncc8,radio"},
+		{name: "channel list not in the clan", clanId: "clan", key: KEY_MODULES, want: ""},
+		{name: "other clan", clanId: "other", channelId: "music", key: KEY_PREFIX, want: "!"},
+		{name: "other clan keeps the default", clanId: "other", channelId: "music", key: KEY_LANGUAGE, want: "en"},
+		{name: "unknown clan", clanId: "none", key: KEY_RECORDING, want: ""},
+	}
+
+	reopened, err := NewFileStore(path, Settings{Language: "en", Prefix: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, s := range map[string]IStore{"store": store, "reopened": reopened} {
+				got, err := s.Get(tt.clanId, tt.channelId).Value(tt.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("%s: %s = %q, want %q", name, tt.key, got, tt.want)
+				}
+			}
+		})
+	}
+
+	if volume := store.Get("clan", "music").VolumePercent(); volume != 0 {
+		t.Errorf("muted channel at %d%%", volume)
+	}
+	if volume := store.Get("other", "").VolumePercent(); volume != DefaultVolume {
+		t.Errorf("channel without volume at %d%%", volume)
+	}
+	if !store.Get("clan", "general").RecordingEnabled() || store.Get("clan", "music").RecordingEnabled() {
+		t.Error("recording should follow the clan unless the channel opts out")
+	}
+}
+
+func TestStoreSetUnsetsEmptyScopes(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "settings.json"), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set("clan", "music", KEY_VOLUME, "50"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("clan", "music", KEY_VOLUME, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fs := store.(*fileStore); len(fs.scopes) != 0 {
+		t.Errorf("scopes %v left after unsetting the only key", fs.scopes)
+	}
+}
+
+func TestStoreSetRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{key: KEY_VOLUME, value: "201", err: ErrInvalidValue},
+		{key: KEY_VOLUME, value: "-1", err: ErrInvalidValue},
+		{key: KEY_VOLUME, value: "loud", err: ErrInvalidValue},
+		{key: KEY_PREFIX, value: "a b", err: ErrInvalidValue},
+		{key: KEY_PREFIX, value: "long", err: ErrInvalidValue},
+		{key: KEY_RECORDING, value: "maybe", err: ErrInvalidValue},
+		{key: "colour", value: "red", err: ErrUnknownKey},
+	}
+
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "settings.json"), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if err := store.Set("clan", "", tt.key, tt.value); !errors.Is(err, tt.err) {
+			t.Errorf("set %s=%q: got %v, want %v", tt.key, tt.value, err, tt.err)
+		}
+	}
+	if scope := store.Scope("clan", ""); !scope.isEmpty() {
+		t.Errorf("rejected values stored: %+v", scope)
+	}
+}
+
+func TestStoreSetKeepsMemoryWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(filepath.Join(dir, "settings.json"), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("clan", "", KEY_VOLUME, "50"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in the way of the temp file fails every save
+	if err := os.Mkdir(filepath.Join(dir, "settings.json.tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("clan", "", KEY_VOLUME, "150"); err == nil {
+		t.Fatal("save did not fail")
+	}
+	if err := store.Set("clan", "music", KEY_VOLUME, "10"); err == nil {
+		t.Fatal("save did not fail")
+	}
+
+	if got := store.Get("clan", "music").Volume; got != "50" {
+		t.Errorf("volume %q after failed saves, want 50", got)
+	}
+}
+
+func TestSoundboardAllowed(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "settings.json"), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("clan", "", KEY_SOUNDBOARD_USERS, "dj, admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("clan", "music", KEY_SOUNDBOARD_USERS, "listener"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clanId    string
+		channelId string
+		userId    string
+		allowed   bool
+	}{
+		{clanId: "clan", channelId: "general", userId: "dj", allowed: true},
+		{clanId: "clan", channelId: "general", userId: "listener", allowed: false},
+		// the channel list replaces the clan list
+		{clanId: "clan", channelId: "music", userId: "listener", allowed: true},
+		{clanId: "clan", channelId: "music", userId: "dj", allowed: false},
+		// without a list everyone plays
+		{clanId: "other", channelId: "music", userId: "listener", allowed: true},
+	}
+	for _, tt := range tests {
+		if got := store.Get(tt.clanId, tt.channelId).SoundboardAllowed(tt.userId); got != tt.allowed {
+			t.Errorf("%s in %s/%s allowed %v, want %v", tt.userId, tt.clanId, tt.channelId, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package soundboard keeps the short clips played by *sb: Ogg Opus files in one directory, described by
+// an index that holds their cooldowns and who added them.
+package soundboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"mezon-go-bot/internal/media"
+)
+
+const (
+	// MaxDuration keeps clips short, longer audio belongs in the ncc8 queue
+	MaxDuration = 15 * time.Second
+	// DefaultCooldown is how long a clip rests in a channel after playing, when it was added without one
+	DefaultCooldown = 10 * time.Second
+
+	indexName = "clips.json"
+)
+
+var (
+	ErrNoSuchClip  = errors.New("no such clip")
+	ErrClipExists  = errors.New("a clip with this name exists already")
+	ErrInvalidName = errors.New("clip names are 1-32 lowercase letters, digits, - or _")
+	ErrTooLong     = fmt.Errorf("clips must be at most %s long", MaxDuration)
+	ErrCoolingDown = errors.New("clip is cooling down")
+
+	namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+type Clip struct {
+	Name     string        `json:"name"`
+	File     string        `json:"file"` // relative to the board directory
+	Duration time.Duration `json:"duration"`
+	Cooldown time.Duration `json:"cooldown"`
+	AddedBy  string        `json:"added_by"`
+	AddedAt  time.Time     `json:"added_at"`
+}
+
+type Board struct {
+	dir string
+
+	mu       sync.Mutex
+	clips    map[string]Clip
+	lastPlay map[string]time.Time // map[channelId/name]time
+}
+
+// Open loads the index of dir, an empty board when there is none yet
+func Open(dir string) (*Board, error) {
+	b := &Board{dir: dir, clips: make(map[string]Clip), lastPlay: make(map[string]time.Time)}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var clips []Clip
+		if err := json.Unmarshal(data, &clips); err != nil {
+			return nil, fmt.Errorf("soundboard index: %w", err)
+		}
+		for _, c := range clips {
+			b.clips[c.Name] = c
+		}
+	}
+	return b, nil
+}
+
+// ValidName reports whether name can be used for a clip
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Add copies an Ogg Opus file into the board as name, cooldown 0 is DefaultCooldown
+func (b *Board) Add(name, oggPath string, cooldown time.Duration, by string) (Clip, error) {
+	if !ValidName(name) {
+		return Clip{}, ErrInvalidName
+	}
+	info, err := media.ProbeOgg(oggPath)
+	if err != nil {
+		return Clip{}, err
+	}
+	if info.Duration > MaxDuration {
+		return Clip{}, fmt.Errorf("%w, %s is %s", ErrTooLong, name, info.Duration.Round(time.Second))
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.clips[name]; ok {
+		return Clip{}, fmt.Errorf("%w: %s", ErrClipExists, name)
+	}
+	clip := Clip{
+		Name:     name,
+		File:     name + ".ogg",
+		Duration: info.Duration,
+		Cooldown: cooldown,
+		AddedBy:  by,
+		AddedAt:  time.Now(),
+	}
+	if err := copyFile(oggPath, b.Path(clip)); err != nil {
+		return Clip{}, err
+	}
+
+	b.clips[name] = clip
+	if err := b.save(); err != nil {
+		delete(b.clips, name)
+		os.Remove(b.Path(clip))
+		return Clip{}, err
+	}
+	return clip, nil
+}
+
+// Remove deletes a clip and its file
+func (b *Board) Remove(name string) (Clip, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clip, ok := b.clips[name]
+	if !ok {
+		return Clip{}, fmt.Errorf("%w: %s", ErrNoSuchClip, name)
+	}
+	delete(b.clips, name)
+	if err := b.save(); err != nil {
+		b.clips[name] = clip
+		return Clip{}, err
+	}
+	if err := os.Remove(b.Path(clip)); err != nil {
+		log.Printf("soundboard remove %s: %v \n", clip.File, err)
+	}
+	return clip, nil
+}
+
+func (b *Board) Get(name string) (Clip, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clip, ok := b.clips[name]
+	if !ok {
+		return Clip{}, fmt.Errorf("%w: %s", ErrNoSuchClip, name)
+	}
+	return clip, nil
+}
+
+// List returns the clips sorted by name
+func (b *Board) List() []Clip {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clips := make([]Clip, 0, len(b.clips))
+	for _, c := range b.clips {
+		clips = append(clips, c)
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].Name < clips[j].Name })
+	return clips
+}
+
+// Use takes a clip for playing in a channel. A clip that played there less than its cooldown ago is
+// ErrCoolingDown, the returned duration is how long it still rests.
+func (b *Board) Use(name, channelId string) (Clip, time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clip, ok := b.clips[name]
+	if !ok {
+		return Clip{}, 0, fmt.Errorf("%w: %s", ErrNoSuchClip, name)
+	}
+
+	key := channelId + "/" + name
+	if wait := clip.Cooldown - time.Since(b.lastPlay[key]); wait > 0 {
+		return clip, wait, ErrCoolingDown
+	}
+	b.lastPlay[key] = time.Now()
+	return clip, 0, nil
+}
+
+// Path is the file of a clip
+func (b *Board) Path(clip Clip) string {
+	return filepath.Join(b.dir, clip.File)
+}
+
+// save writes the index to a temp file and renames it, must be called with mu held
+func (b *Board) save() error {
+	clips := make([]Clip, 0, len(b.clips))
+	for _, c := range b.clips {
+		clips = append(clips, c)
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].Name < clips[j].Name })
+
+	data, err := json.MarshalIndent(clips, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return err
+	}
+
+	index := filepath.Join(b.dir, indexName)
+	tmp := index + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, index)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
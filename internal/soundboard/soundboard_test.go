@@ -0,0 +1,164 @@
+package soundboard
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testClip is a short Ogg Opus file, about 4 s
+const testClip = "../../audio/hello.ogg"
+
+func newTestBoard(t *testing.T) *Board {
+	t.Helper()
+	b, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBoardUseCooldown(t *testing.T) {
+	b := newTestBoard(t)
+	if _, err := b.Add("airhorn", testClip, time.Minute, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add("drum", testClip, 0, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		clip      string
+		channelId string
+		ago       time.Duration // since the clip last played in the channel, 0 for never
+		wait      time.Duration // at least this much left, 0 when it plays
+		err       error
+	}{
+		{name: "first play", clip: "airhorn", channelId: "general"},
+		{name: "just played", clip: "airhorn", channelId: "general", ago: time.Second, wait: 58 * time.Second, err: ErrCoolingDown},
+		{name: "cooldown over", clip: "airhorn", channelId: "general", ago: time.Minute + time.Second},
+		{name: "other channel", clip: "airhorn", channelId: "music", ago: 0},
+		{name: "default cooldown", clip: "drum", channelId: "general", ago: DefaultCooldown / 2, wait: DefaultCooldown/2 - time.Second, err: ErrCoolingDown},
+		{name: "default cooldown over", clip: "drum", channelId: "general", ago: DefaultCooldown},
+		{name: "missing clip", clip: "cowbell", channelId: "general", err: ErrNoSuchClip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.channelId + "/" + tt.clip
+			b.lastPlay = map[string]time.Time{}
+			if tt.ago > 0 {
+				b.lastPlay[key] = time.Now().Add(-tt.ago)
+			}
+			// another clip playing in the channel does not hold this one back
+			b.lastPlay[tt.channelId+"/other"] = time.Now()
+
+			clip, wait, err := b.Use(tt.clip, tt.channelId)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err == ErrNoSuchClip {
+				return
+			}
+			if clip.Name != tt.clip {
+				t.Errorf("got clip %q", clip.Name)
+			}
+			if tt.err == nil {
+				if wait != 0 {
+					t.Errorf("played with a wait of %s", wait)
+				}
+				if time.Since(b.lastPlay[key]) > time.Second {
+					t.Error("play time not recorded")
+				}
+				return
+			}
+			if wait < tt.wait || wait > tt.wait+2*time.Second {
+				t.Errorf("wait %s, want about %s", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestBoardUseStartsCooldown(t *testing.T) {
+	b := newTestBoard(t)
+	if _, err := b.Add("airhorn", testClip, time.Minute, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := b.Use("airhorn", "general"); err != nil {
+		t.Fatal(err)
+	}
+	if _, wait, err := b.Use("airhorn", "general"); !errors.Is(err, ErrCoolingDown) || wait <= 0 {
+		t.Errorf("second play: wait %s, %v", wait, err)
+	}
+}
+
+func TestBoardAddRemove(t *testing.T) {
+	dir := t.TempDir()
+	b, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notOgg := filepath.Join(t.TempDir(), "clip.mp3")
+	if err := os.WriteFile(notOgg, []byte("ID3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		clip    string
+		file    string
+		wantErr bool
+		err     error // when wantErr, nil for any error
+	}{
+		{name: "added", clip: "airhorn", file: testClip},
+		{name: "exists", clip: "airhorn", file: testClip, wantErr: true, err: ErrClipExists},
+		{name: "invalid name", clip: "Air Horn", file: testClip, wantErr: true, err: ErrInvalidName},
+		{name: "not ogg", clip: "drum", file: notOgg, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clip, err := b.Add(tt.clip, tt.file, 0, "admin")
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if clip.Cooldown != DefaultCooldown || clip.Duration <= 0 {
+					t.Errorf("added %+v", clip)
+				}
+				return
+			}
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clip, err := reopened.Get("airhorn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reopened.Path(clip)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := reopened.Remove("airhorn"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reopened.Path(clip)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("clip file left: %v", err)
+	}
+	if _, err := reopened.Remove("airhorn"); !errors.Is(err, ErrNoSuchClip) {
+		t.Errorf("second remove: %v", err)
+	}
+	if again, err := Open(dir); err != nil || len(again.clips) != 0 {
+		t.Errorf("clips %v after remove, %v", again.clips, err)
+	}
+}
@@ -0,0 +1,177 @@
+package tts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	EngineEspeak = "espeak"
+	EnginePiper  = "piper"
+	EngineFake   = "fake"
+)
+
+var ErrNoVoice = errors.New("piper needs a voice, the name of a model in the voice directory")
+
+// NewEngine returns the engine called kind. path is its binary, empty for the usual name; voiceDir holds
+// the piper models.
+func NewEngine(kind, path, voiceDir string) (Engine, error) {
+	switch kind {
+	case EngineEspeak:
+		bin, err := lookPath(path, "espeak-ng")
+		if err != nil {
+			return nil, err
+		}
+		return &Espeak{Path: bin}, nil
+	case EnginePiper:
+		bin, err := lookPath(path, "piper")
+		if err != nil {
+			return nil, err
+		}
+		return &Piper{Path: bin, VoiceDir: voiceDir}, nil
+	case EngineFake:
+		return Fake{}, nil
+	}
+	return nil, fmt.Errorf("unknown tts engine %q, use %s, %s or %s", kind, EngineEspeak, EnginePiper, EngineFake)
+}
+
+func lookPath(path, fallback string) (string, error) {
+	if path == "" {
+		path = fallback
+	}
+	return exec.LookPath(path)
+}
+
+// Espeak speaks with espeak-ng: Lang is the espeak voice ("en", "vi"), Name a variant such as "f3"
+type Espeak struct {
+	Path string
+}
+
+func (e *Espeak) Name() string {
+	return EngineEspeak
+}
+
+func (e *Espeak) Synthesize(ctx context.Context, text string, voice Voice, out string) error {
+	args := []string{"-w", out, "--stdin"}
+	if v := voice.Lang; v != "" {
+		if voice.Name != "" {
+			v += "+" + voice.Name
+		}
+		args = append(args, "-v", v)
+	}
+	return run(ctx, e.Path, args, text)
+}
+
+// Piper speaks with a piper model, Name is the model file in VoiceDir without .onnx; the model sets the
+// language
+type Piper struct {
+	Path     string
+	VoiceDir string
+}
+
+func (p *Piper) Name() string {
+	return EnginePiper
+}
+
+func (p *Piper) Synthesize(ctx context.Context, text string, voice Voice, out string) error {
+	if voice.Name == "" {
+		return ErrNoVoice
+	}
+	model := filepath.Join(p.VoiceDir, voice.Name+".onnx")
+	if _, err := os.Stat(model); err != nil {
+		return err
+	}
+	return run(ctx, p.Path, []string{"--model", model, "--output_file", out}, text)
+}
+
+// run runs an engine with text on stdin, its output is returned in the error
+func run(ctx context.Context, path string, args []string, text string) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = strings.NewReader(text)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Fake "speaks" a short tone per word, its pitch taken from the word and the voice. It needs no tool,
+// for offline runs against the mock station.
+type Fake struct{}
+
+const (
+	fakeRate    = 16000
+	fakeWord    = fakeRate / 4 // samples of tone per word
+	fakePause   = fakeRate / 16
+	fakeLevel   = 8000
+	fakeMinTone = 220.0
+)
+
+func (Fake) Name() string {
+	return EngineFake
+}
+
+func (Fake) Synthesize(ctx context.Context, text string, voice Voice, out string) error {
+	words := strings.Fields(text)
+	samples := len(words) * (fakeWord + fakePause)
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	// RIFF header of 16 bit mono PCM
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+samples*2))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) // PCM
+	header = binary.LittleEndian.AppendUint16(header, 1) // mono
+	header = binary.LittleEndian.AppendUint32(header, fakeRate)
+	header = binary.LittleEndian.AppendUint32(header, fakeRate*2)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(samples*2))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	sample := make([]byte, 2)
+	for _, word := range words {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h := fnv.New32a()
+		h.Write([]byte(voice.String() + "/" + word))
+		freq := fakeMinTone * (1 + float64(h.Sum32()%24)/12) // two octaves up from fakeMinTone
+
+		for i := range fakeWord + fakePause {
+			var v float64
+			if i < fakeWord {
+				v = fakeLevel * math.Sin(2*math.Pi*freq*float64(i)/fakeRate)
+			}
+			binary.LittleEndian.PutUint16(sample, uint16(int16(v)))
+			if _, err := w.Write(sample); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,179 @@
+// Package tts speaks text for *say, Bot.Announce and the check-in prompts. An Engine writes WAV, which is
+// encoded to Ogg Opus and cached by engine, voice, language and text, so a repeated text is rendered once.
+package tts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxTextLength bounds what one render speaks, in characters
+const MaxTextLength = 500
+
+var (
+	ErrEmptyText    = errors.New("nothing to say")
+	ErrTextTooLong  = fmt.Errorf("text is limited to %d characters", MaxTextLength)
+	ErrInvalidVoice = errors.New("voices and languages are letters, digits, -, _, . or +")
+
+	// voicePattern keeps voice names from reaching out of the voice directory or into tool flags
+	voicePattern = regexp.MustCompile(`^[A-Za-z0-9_.+][A-Za-z0-9_.+-]{0,63}$`)
+)
+
+// Voice selects how text is spoken. Name is engine specific (an espeak variant, a piper model), Lang a
+// language code such as "en" or "vi"; engines ignore what they do not use.
+type Voice struct {
+	Name string
+	Lang string
+}
+
+func (v Voice) String() string {
+	switch {
+	case v.Name == "":
+		return v.Lang
+	case v.Lang == "":
+		return v.Name
+	default:
+		return v.Lang + "/" + v.Name
+	}
+}
+
+// Engine synthesizes speech, see Espeak, Piper and Fake
+type Engine interface {
+	// Name identifies the engine in cache keys and logs
+	Name() string
+	// Synthesize writes text spoken in voice to out as a WAV file
+	Synthesize(ctx context.Context, text string, voice Voice, out string) error
+}
+
+// Encode turns the WAV file in into streamable Ogg Opus at out, see ingest.Pipeline.EncodeWav
+type Encode func(ctx context.Context, in, out, title string) error
+
+type Synthesizer struct {
+	engine   Engine
+	encode   Encode
+	cacheDir string
+	voice    Voice
+
+	mu       sync.Mutex
+	inflight map[string]*sync.Mutex // map[key]lock, one render per text and voice at a time
+}
+
+// New renders with engine into cacheDir, voice is used for what a render leaves empty
+func New(engine Engine, encode Encode, cacheDir string, voice Voice) *Synthesizer {
+	return &Synthesizer{
+		engine:   engine,
+		encode:   encode,
+		cacheDir: cacheDir,
+		voice:    voice,
+		inflight: make(map[string]*sync.Mutex),
+	}
+}
+
+func (s *Synthesizer) Engine() Engine {
+	return s.engine
+}
+
+// Voice is the default voice
+func (s *Synthesizer) Voice() Voice {
+	return s.voice
+}
+
+// Render returns an Ogg Opus file of text spoken in voice, from the cache when it was spoken before.
+// Empty fields of voice are the default ones.
+func (s *Synthesizer) Render(ctx context.Context, text string, voice Voice) (string, error) {
+	text = strings.Join(strings.Fields(text), " ")
+	switch {
+	case text == "":
+		return "", ErrEmptyText
+	case utf8.RuneCountInString(text) > MaxTextLength:
+		return "", ErrTextTooLong
+	}
+
+	if voice.Name == "" {
+		voice.Name = s.voice.Name
+	}
+	if voice.Lang == "" {
+		voice.Lang = s.voice.Lang
+	}
+	for _, v := range []string{voice.Name, voice.Lang} {
+		if v != "" && !voicePattern.MatchString(v) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidVoice, v)
+		}
+	}
+
+	key := s.key(text, voice)
+	out := filepath.Join(s.cacheDir, key+".ogg")
+
+	lock := s.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+	if err := os.MkdirAll(s.cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	wav := filepath.Join(s.cacheDir, key+".wav.tmp")
+	defer os.Remove(wav)
+	if err := s.engine.Synthesize(ctx, text, voice, wav); err != nil {
+		return "", fmt.Errorf("%s: %w", s.engine.Name(), err)
+	}
+
+	tmp := out + ".tmp"
+	if err := s.encode(ctx, wav, tmp, title(text)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+
+	log.Printf("tts %s (%s) %q -> %s in %s \n", s.engine.Name(), voice, title(text), out, time.Since(start).Round(time.Millisecond))
+	return out, nil
+}
+
+// key hashes what changes the rendered audio
+func (s *Synthesizer) key(text string, voice Voice) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{s.engine.Name(), voice.Name, voice.Lang, text}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Synthesizer) lock(key string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, ok := s.inflight[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.inflight[key] = lock
+	}
+	return lock
+}
+
+// title shortens text for tags and logs
+func title(text string) string {
+	const max = 60
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max-3]) + "..."
+}
+
+// Title is how a spoken text is shown in queues and now playing messages
+func Title(text string) string {
+	return "say: " + title(strings.Join(strings.Fields(text), " "))
+}
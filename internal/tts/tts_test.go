@@ -0,0 +1,166 @@
+package tts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingEngine writes the text as its WAV and counts the renders
+type countingEngine struct {
+	name string
+
+	mu      sync.Mutex
+	renders map[string]int // map[voice/text]renders
+}
+
+func (e *countingEngine) Name() string {
+	return e.name
+}
+
+func (e *countingEngine) Synthesize(ctx context.Context, text string, voice Voice, out string) error {
+	e.mu.Lock()
+	e.renders[voice.String()+"/"+text]++
+	e.mu.Unlock()
+	return os.WriteFile(out, []byte(text), 0o644)
+}
+
+func (e *countingEngine) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for _, r := range e.renders {
+		n += r
+	}
+	return n
+}
+
+func copyEncode(ctx context.Context, in, out, title string) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0o644)
+}
+
+func newTestSynthesizer(t *testing.T, cacheDir string, engine string) (*Synthesizer, *countingEngine) {
+	t.Helper()
+	e := &countingEngine{name: engine, renders: make(map[string]int)}
+	return New(e, copyEncode, cacheDir, Voice{Name: "f3", Lang: "en"}), e
+}
+
+func TestRenderCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	s, e := newTestSynthesizer(t, dir, "espeak")
+	first, err := s.Render(context.Background(), "hello world", Voice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		engine string
+		text   string
+		voice  Voice
+		cached bool
+	}{
+		{name: "same text", engine: "espeak", text: "hello world", cached: true},
+		{name: "spacing", engine: "espeak", text: "  hello \n world ", cached: true},
+		{name: "default voice spelled out", engine: "espeak", text: "hello world", voice: Voice{Name: "f3", Lang: "en"}, cached: true},
+		{name: "default name", engine: "espeak", text: "hello world", voice: Voice{Lang: "en"}, cached: true},
+		{name: "other text", engine: "espeak", text: "hello there"},
+		{name: "case", engine: "espeak", text: "Hello world"},
+		{name: "other language", engine: "espeak", text: "hello world", voice: Voice{Lang: "vi"}},
+		{name: "other voice", engine: "espeak", text: "hello world", voice: Voice{Name: "m1"}},
+		{name: "other engine", engine: "piper", text: "hello world"},
+		// the fields are kept apart in the key
+		{name: "name and language swapped", engine: "espeak", text: "hello world", voice: Voice{Name: "en", Lang: "f3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := newTestSynthesizer(t, dir, tt.engine)
+			out, err := s.Render(context.Background(), tt.text, tt.voice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := out == first; cached != tt.cached {
+				t.Errorf("cached %v, want %v", cached, tt.cached)
+			}
+			if rendered := e.count() == 1; rendered == tt.cached {
+				t.Errorf("rendered %d times", e.count())
+			}
+		})
+	}
+
+	if e.count() != 1 {
+		t.Errorf("first synthesizer rendered %d times", e.count())
+	}
+	data, err := os.ReadFile(first)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("cached %q, %v", data, err)
+	}
+}
+
+func TestRenderOncePerText(t *testing.T) {
+	s, e := newTestSynthesizer(t, t.TempDir(), "espeak")
+
+	var wg sync.WaitGroup
+	outs := make([]string, 8)
+	for i := range outs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := s.Render(context.Background(), "check-in time", Voice{})
+			if err != nil {
+				t.Error(err)
+			}
+			outs[i] = out
+		}()
+	}
+	wg.Wait()
+
+	if e.count() != 1 {
+		t.Errorf("rendered %d times", e.count())
+	}
+	for _, out := range outs {
+		if out != outs[0] {
+			t.Errorf("renders at %s and %s", out, outs[0])
+		}
+	}
+}
+
+func TestRenderRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		voice Voice
+		err   error
+	}{
+		{name: "empty", text: " \n ", err: ErrEmptyText},
+		{name: "too long", text: strings.Repeat("é", MaxTextLength+1), err: ErrTextTooLong},
+		{name: "path in the voice", text: "hi", voice: Voice{Name: "../model"}, err: ErrInvalidVoice},
+		{name: "flag as language", text: "hi", voice: Voice{Lang: "-v"}, err: ErrInvalidVoice},
+	}
+
+	s, e := newTestSynthesizer(t, t.TempDir(), "espeak")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Render(context.Background(), tt.text, tt.voice); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+	if e.count() != 0 {
+		t.Errorf("rendered %d times", e.count())
+	}
+
+	// the limit counts characters, not bytes
+	if _, err := s.Render(context.Background(), strings.Repeat("é", MaxTextLength), Voice{}); err != nil {
+		t.Error(err)
+	}
+}
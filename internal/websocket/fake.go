@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	mezonsdk "github.com/nccasia/mezon-go-sdk"
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/rtapi"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// FakeSocket is an offline mezonsdk.IWSConnection, every outbound envelope is written to out as JSON.
+// Sent channel messages come back to the channel message handler with an id, like on mezon.
+type FakeSocket struct {
+	out      io.Writer
+	senderId string
+
+	mu               sync.Mutex
+	lastId           int
+	onChannelMessage func(*rtapi.Envelope) error
+}
+
+var _ mezonsdk.IWSConnection = (*FakeSocket)(nil)
+
+// NewFakeSocket writes to out, senderId is the sender of the echoed messages
+func NewFakeSocket(out io.Writer, senderId string) *FakeSocket {
+	return &FakeSocket{out: out, senderId: senderId}
+}
+
+func (s *FakeSocket) SendMessage(data *rtapi.Envelope) error {
+	jsonData, err := protojson.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.out.Write(append(jsonData, '\n')); err != nil {
+		return err
+	}
+
+	if send := data.GetChannelMessageSend(); send != nil && s.onChannelMessage != nil {
+		s.lastId++
+		echo := &rtapi.Envelope{Message: &rtapi.Envelope_ChannelMessage{ChannelMessage: &api.ChannelMessage{
+			ClanId:    send.GetClanId(),
+			ChannelId: send.GetChannelId(),
+			MessageId: strconv.Itoa(s.lastId),
+			SenderId:  s.senderId,
+			Content:   send.GetContent(),
+			Mode:      send.GetMode(),
+			IsPublic:  send.GetIsPublic(),
+		}}}
+		go s.onChannelMessage(echo)
+	}
+	return nil
+}
+
+func (s *FakeSocket) SetOnJoinStreamingChannel(recvHandler func(*rtapi.Envelope) error) {}
+
+func (s *FakeSocket) SetOnWebrtcSignalingFwd(recvHandler func(*rtapi.Envelope) error) {}
+
+func (s *FakeSocket) SetOnPong(recvHandler func(*rtapi.Envelope) error) {}
+
+func (s *FakeSocket) SetOnChannelMessage(recvHandler func(*rtapi.Envelope) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChannelMessage = recvHandler
+}
+
+func (s *FakeSocket) Close() error {
+	return nil
+}
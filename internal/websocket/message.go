@@ -1,5 +1,33 @@
 package websocket
 
+import (
+	"encoding/json"
+
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
+)
+
 type MsgContent struct {
 	Content string `json:"t"`
 }
+
+// EncodeContent wraps text into the JSON content of a channel message
+func EncodeContent(text string) (string, error) {
+	content, err := json.Marshal(&MsgContent{Content: text})
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// DecodeAttachments reads the JSON attachment list of a channel message
+func DecodeAttachments(attachments string) ([]*api.MessageAttachment, error) {
+	if attachments == "" {
+		return nil, nil
+	}
+
+	var list []*api.MessageAttachment
+	if err := json.Unmarshal([]byte(attachments), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -1,25 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"mezon-go-bot/config"
 	"mezon-go-bot/internal/constants"
 	"mezon-go-bot/internal/logger"
+	"mezon-go-bot/internal/player"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-// healthCheckHandler handles the health check request
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status": "ok"}`))
-}
-
 var bot IBot
 
 func main() {
+	if err := runCli(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// registerCommands registry all command here
+func registerCommands(b IBot) {
+	b.RegisterCmd(constants.NCC8_COMMAND, Ncc8Handler)
+	b.RegisterCmd(constants.MOVIE_COMMAND, MovieHandler)
+	b.RegisterCmd(constants.SETTINGS_COMMAND, SettingsHandler)
+	b.RegisterCmd(constants.SB_COMMAND, SoundboardHandler)
+	b.RegisterCmd(constants.SAY_COMMAND, SayHandler)
+}
+
+func runBot(configPath, port string) error {
 	// Load Config
-	cfg := config.LoadConfig()
+	cfg := config.LoadConfig(configPath)
 
 	// Setup Logger
 	log := logger.NewLogger(cfg.LogFile)
@@ -32,21 +50,47 @@ func main() {
 		log.Fatal("Failed to initialize bot checkin", zap.Error(err))
 	}
 
-	// registry all command here
-	bot.RegisterCmd(constants.NCC8_COMMAND, Ncc8Handler)
+	registerCommands(bot)
 
 	bot.Start()
 
-	// Register the health check endpoint
-	http.HandleFunc("/health", healthCheckHandler)
-
-	// Define the port
-	port := "8080"
+	// Register the health check endpoint. The default mux is left out: importing expvar serves
+	// /debug/vars there, which only the admin API exposes
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthCheckHandler)
+	if cfg.AdminApiToken != "" {
+		registerAdminAPI(mux, cfg.AdminApiToken)
+	}
 
 	log.Info("Starting server on port", zap.Any("port", port))
 
 	// Start the HTTP server
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal("Error starting server", zap.Error(err))
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error starting server", zap.Error(err))
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// leave the voice channels cleanly: stop talking, leave the station, close the peers
+	log.Info("Shutting down")
+	stopped := make(chan struct{})
+	go func() {
+		player.StopAll("shutdown")
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(constants.SHUTDOWN_TIMEOUT):
+		log.Warn("Playback sessions not closed in time", zap.Duration("timeout", constants.SHUTDOWN_TIMEOUT))
 	}
+	stopStationTokens()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), constants.SHUTDOWN_TIMEOUT)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
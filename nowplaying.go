@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mezon-go-bot/internal/constants"
+	"mezon-go-bot/internal/helper"
+	"mezon-go-bot/internal/player"
+	radiostation "mezon-go-bot/internal/radio-station"
+	"strings"
+	"sync"
+
+	"github.com/nccasia/mezon-go-sdk/mezon-protobuf/mezon/v2/common/api"
+	"go.uber.org/zap"
+)
+
+// nowPlaying keeps the status message of a playback session: posted when an item starts, edited with
+// its progress, and closed when it ends, which is also announced in a message of its own
+type nowPlaying struct {
+	msg *api.ChannelMessage
+
+	mu        sync.Mutex
+	messageId string // "" when the message could not be tracked, progress is then not shown
+	item      player.Item
+	status    player.Status
+}
+
+// endings names an outcome in the closed status message
+var endings = map[player.Outcome]string{
+	player.Finished: "finished",
+	player.Skipped:  "skipped",
+	player.Stopped:  "stopped",
+	player.Failed:   "failed",
+}
+
+// ncc8Hooks reports playback to the channel the session was started from
+func ncc8Hooks(msg *api.ChannelMessage) player.Hooks {
+	np := &nowPlaying{msg: msg}
+	return player.Hooks{
+		OnStart:          np.start,
+		OnProgress:       np.progress,
+		ProgressInterval: constants.NCC8_PROGRESS_INTERVAL,
+		OnTitle:          np.liveTitle,
+		OnEnd:            np.end,
+	}
+}
+
+func (np *nowPlaying) start(item player.Item) {
+	bot.Logger().Info("[ncc8] now playing", zap.String("title", item.Title), zap.String("path", item.Path))
+
+	status := player.Status{Duration: item.Duration}
+	id, err := bot.ReplyWithId(np.msg, nowPlayingText("now playing", item, status))
+	if err != nil {
+		bot.Logger().Error("[ncc8] reply error", zap.Error(err))
+	}
+
+	np.mu.Lock()
+	np.messageId, np.item, np.status = id, item, status
+	np.mu.Unlock()
+}
+
+func (np *nowPlaying) progress(item player.Item, status player.Status) {
+	np.mu.Lock()
+	np.item, np.status = item, status
+	np.mu.Unlock()
+
+	state := "now playing"
+	if status.Paused {
+		state = "paused"
+	}
+	np.edit(nowPlayingText(state, item, status))
+}
+
+// liveTitle shows the new title right away instead of at the next progress edit
+func (np *nowPlaying) liveTitle(item player.Item, title string) {
+	bot.Logger().Info("[ncc8] live title", zap.String("station", item.Title), zap.String("title", title))
+
+	np.mu.Lock()
+	np.item.Title = fmt.Sprintf("%s: %s", item.Title, title)
+	current, status, tracked := np.item, np.status, np.messageId != ""
+	np.mu.Unlock()
+
+	if !tracked {
+		if err := bot.Reply(np.msg, fmt.Sprintf("now playing on %s: %s", item.Title, title)); err != nil {
+			bot.Logger().Error("[ncc8] reply error", zap.Error(err))
+		}
+		return
+	}
+	np.edit(nowPlayingText("now playing", current, status))
+}
+
+func (np *nowPlaying) end(item player.Item, end player.Ending) {
+	np.mu.Lock()
+	if np.item.Title != "" {
+		// a live item ends with the last title it announced
+		item.Title = np.item.Title
+	}
+	status := np.status
+	np.mu.Unlock()
+
+	status.Position, status.Paused = end.Position, false
+	np.edit(nowPlayingText(endings[end.Outcome], item, status))
+
+	np.mu.Lock()
+	np.messageId, np.item, np.status = "", player.Item{}, player.Status{}
+	np.mu.Unlock()
+
+	var text string
+	switch end.Outcome {
+	case player.Finished:
+		text = fmt.Sprintf("finished: %s (%s)", item.Title, helper.FormatTimestamp(end.Position))
+	case player.Skipped:
+		text = fmt.Sprintf("skipped %s at %s by %s", item.Title, helper.FormatTimestamp(end.Position), end.By)
+	case player.Stopped:
+		text = fmt.Sprintf("stopped %s at %s by %s", item.Title, helper.FormatTimestamp(end.Position), end.By)
+	case player.Failed:
+		bot.Logger().Error("[ncc8] playback error", zap.String("title", item.Title), zap.Error(end.Err))
+		err := end.Err
+		if errors.Is(err, radiostation.ErrSessionExists) {
+			err = errors.New("ncc8 is already playing in this channel")
+		}
+		text = fmt.Sprintf("can not play %s: %v", item.Title, err)
+	}
+	if err := bot.Reply(np.msg, text); err != nil {
+		bot.Logger().Error("[ncc8] reply error", zap.Error(err))
+	}
+}
+
+// edit rewrites the status message, a session without one (the echo never came) has nothing to edit
+func (np *nowPlaying) edit(text string) {
+	np.mu.Lock()
+	id := np.messageId
+	np.mu.Unlock()
+	if id == "" {
+		return
+	}
+
+	if err := bot.EditMessage(np.msg, id, text); err != nil {
+		bot.Logger().Error("[ncc8] edit now playing error", zap.Error(err))
+	}
+}
+
+// nowPlayingText is the status message: title, progress and who queued the item
+func nowPlayingText(state string, item player.Item, status player.Status) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: %s\n", state, item.Title)
+	if item.Open != nil {
+		fmt.Fprintf(&sb, "%s / live\n", helper.FormatTimestamp(status.Position))
+	} else {
+		fmt.Fprintf(&sb, "%s %s / %s\n", progressBar(status.Position.Seconds(), status.Duration.Seconds()),
+			helper.FormatTimestamp(status.Position), helper.FormatTimestamp(status.Duration))
+	}
+	if item.RequestedByName != "" {
+		fmt.Fprintf(&sb, "queued by %s", item.RequestedByName)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func progressBar(pos, dur float64) string {
+	const width = 20
+	filled := 0
+	if dur > 0 {
+		filled = min(int(pos/dur*width), width)
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+// senderName is how replies name the sender of msg
+func senderName(msg *api.ChannelMessage) string {
+	for _, name := range []string{msg.GetClanNick(), msg.GetDisplayName(), msg.GetUsername()} {
+		if name != "" {
+			return name
+		}
+	}
+	return msg.GetSenderId()
+}